@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config holds the defaults read from a --config file. Each key sets the
+// flag of the same name, with underscores for dashes, and is validated the
+// same way; flags given on the command line override it, and add to its
+// exclude, exclude_from, include and ext lists.
+type config struct {
+	Jobs           *int     `toml:"jobs"`
+	Hash           string   `toml:"hash"`
+	Match          string   `toml:"match"`
+	Keep           string   `toml:"keep"`
+	Link           string   `toml:"link"`
+	Exclude        []string `toml:"exclude"`
+	ExcludeFrom    []string `toml:"exclude_from"`
+	Include        []string `toml:"include"`
+	Ext            []string `toml:"ext"`      // e.g. [".jpg", "png"]
+	MinSize        string   `toml:"min_size"` // e.g. "4k"
+	MaxSize        string   `toml:"max_size"`
+	Cache          string   `toml:"cache"`
+	Trash          string   `toml:"trash"`
+	DryRun         *bool    `toml:"dry_run"`
+	Apply          *bool    `toml:"apply"`
+	Verify         *bool    `toml:"verify"`
+	RelativeLinks  *bool    `toml:"relative_links"`
+	PreserveTimes  *bool    `toml:"preserve_times"`
+	FollowSymlinks *bool    `toml:"follow_symlinks"`
+	OneFileSystem  *bool    `toml:"one_file_system"`
+	IncludeEmpty   *bool    `toml:"include_empty"`
+	Retries        *int     `toml:"retries"`
+	RetryDelay     string   `toml:"retry_delay"` // e.g. "500ms"
+	ConfirmAt      *int     `toml:"confirm_threshold"`
+	ConfirmPercent *float64 `toml:"confirm_percent"`
+}
+
+// loadConfig reads the TOML config file at path, rejecting keys it doesn't
+// know.
+func loadConfig(path string) (config, error) {
+	var c config
+	meta, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		return config{}, fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return config{}, fmt.Errorf("unknown keys in config file %s: %s", path, strings.Join(keys, ", "))
+	}
+	return c, nil
+}
+
+// apply sets the flags the config gives values for, before the command line
+// is parsed.
+func (c config) apply(flags *flag.FlagSet) error {
+	values := map[string]string{
+		"hash":        c.Hash,
+		"match":       c.Match,
+		"keep":        c.Keep,
+		"link":        c.Link,
+		"min-size":    c.MinSize,
+		"max-size":    c.MaxSize,
+		"cache":       c.Cache,
+		"trash":       c.Trash,
+		"retry-delay": c.RetryDelay,
+	}
+	if c.Jobs != nil {
+		values["jobs"] = strconv.Itoa(*c.Jobs)
+	}
+	if c.Retries != nil {
+		values["retries"] = strconv.Itoa(*c.Retries)
+	}
+	if c.ConfirmAt != nil {
+		values["confirm-threshold"] = strconv.Itoa(*c.ConfirmAt)
+	}
+	if c.ConfirmPercent != nil {
+		values["confirm-percent"] = strconv.FormatFloat(*c.ConfirmPercent, 'f', -1, 64)
+	}
+	for name, value := range map[string]*bool{
+		"dry-run":         c.DryRun,
+		"apply":           c.Apply,
+		"verify":          c.Verify,
+		"relative-links":  c.RelativeLinks,
+		"preserve-times":  c.PreserveTimes,
+		"follow-symlinks": c.FollowSymlinks,
+		"one-file-system": c.OneFileSystem,
+		"include-empty":   c.IncludeEmpty,
+	} {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+
+	var errs []error
+	set := func(name, value string) {
+		if err := flags.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("config key %s: %w", strings.ReplaceAll(name, "-", "_"), err))
+		}
+	}
+	for name, value := range values {
+		if value != "" {
+			set(name, value)
+		}
+	}
+	for _, pattern := range c.Exclude {
+		set("exclude", pattern)
+	}
+	for _, path := range c.ExcludeFrom {
+		set("exclude-from", path)
+	}
+	for _, pattern := range c.Include {
+		set("include", pattern)
+	}
+	for _, ext := range c.Ext {
+		set("ext", ext)
+	}
+	return errors.Join(errs...)
+}
+
+// configPath returns the value of --config in args, if given.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// trackedValue records that its flag was set before setting it, so flags
+// given on the command line can be told apart from the config's values.
+type trackedValue struct {
+	flag.Value
+	name string
+	seen map[string]bool
+}
+
+func (v trackedValue) Set(value string) error {
+	v.seen[v.name] = true
+	return v.Value.Set(value)
+}
+
+// IsBoolFlag keeps boolean flags usable without a value.
+func (v trackedValue) IsBoolFlag() bool {
+	b, ok := v.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// trackFlags returns the set of flags set on flags from now on, by name.
+// Called once the config is applied, it holds those given on the command
+// line, which flag.FlagSet.Visit can't tell from the config's.
+func trackFlags(flags *flag.FlagSet) map[string]bool {
+	seen := make(map[string]bool)
+	flags.VisitAll(func(f *flag.Flag) {
+		f.Value = trackedValue{Value: f.Value, name: f.Name, seen: seen}
+	})
+	return seen
+}
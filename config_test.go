@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// writeConfig writes contents to a config file in a temporary directory and
+// returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dedup.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigWithOverridingFlags(t *testing.T) {
+	path := writeConfig(t, `
+jobs = 3
+hash = "sha256"
+match = "name"
+exclude = ["*.lock"]
+min_size = "4k"
+dry_run = true
+`)
+
+	opts, valid := validateArgs([]string{"--config", path, "--jobs", "5", "--exclude", "node_modules", "--apply", "a", "b"}, io.Discard, io.Discard)
+	if !valid {
+		t.Fatal("validateArgs rejected the config")
+	}
+	if opts.jobs != 5 {
+		t.Errorf("jobs = %d, want the flag's 5", opts.jobs)
+	}
+	if opts.scan.Hash != dedup.HashSHA256 || opts.match.Mode != dedup.MatchName || opts.scan.MinSize != 4<<10 {
+		t.Errorf("hash %s, match %s and min size %d, want the config's sha256, name and 4096", opts.scan.Hash, opts.match.Mode, opts.scan.MinSize)
+	}
+	if want := []string{"*.lock", "node_modules"}; !slices.Equal(opts.scan.Exclude, want) {
+		t.Errorf("excludes = %q, want %q", opts.scan.Exclude, want)
+	}
+	// --apply on the command line overrides the config's dry_run
+	if opts.apply.DryRun || !opts.confirmed {
+		t.Errorf("dry run %v, confirmed %v, want the flag's --apply", opts.apply.DryRun, opts.confirmed)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"unknown key", "jobz = 3\n", "unknown keys in config file"},
+		{"invalid value", `hash = "crc32"` + "\n", "config key hash"},
+		{"malformed", "jobs = \n", "error reading config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			if _, valid := validateArgs([]string{"--config", writeConfig(t, test.contents), "a", "b"}, &stdout, io.Discard); valid {
+				t.Fatal("validateArgs accepted the config")
+			}
+			if !strings.Contains(stdout.String(), test.want) {
+				t.Errorf("output doesn't mention %q:\n%s", test.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestConfigApplyOverriddenByDryRun(t *testing.T) {
+	path := writeConfig(t, "apply = true\n")
+
+	opts, valid := validateArgs([]string{"--config", path, "a", "b"}, io.Discard, io.Discard)
+	if !valid || opts.apply.DryRun {
+		t.Errorf("apply = true in the config gave dry run %v, valid %v, want it applied", opts.apply.DryRun, valid)
+	}
+	opts, valid = validateArgs([]string{"--config", path, "--dry-run", "a", "b"}, io.Discard, io.Discard)
+	if !valid || !opts.apply.DryRun || opts.confirmed {
+		t.Errorf("--dry-run over apply = true gave dry run %v, confirmed %v, valid %v, want a dry run", opts.apply.DryRun, opts.confirmed, valid)
+	}
+}
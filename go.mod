@@ -1,3 +1,10 @@
 module github.com/heshanpadmasiri/dedup
 
 go 1.23.0
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/cespare/xxhash/v2 v2.3.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/text v0.21.0
+)
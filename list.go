@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// readPathList reads the paths in r, one per entry separated by delim.
+// Empty entries are skipped, and so is the carriage return of a CRLF line.
+func readPathList(r io.Reader, delim byte) ([]string, error) {
+	reader := bufio.NewReader(r)
+	var paths []string
+	for {
+		entry, err := reader.ReadString(delim)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		entry = strings.TrimSuffix(entry, string(delim))
+		if delim == '\n' {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if entry != "" {
+			paths = append(paths, entry)
+		}
+		if err != nil {
+			return paths, nil
+		}
+	}
+}
+
+// loadPathList reads the --from-file list at path, or from stdin if path is
+// "-".
+func loadPathList(path string, null bool, stdin io.Reader) ([]string, error) {
+	delim := byte('\n')
+	if null {
+		delim = 0
+	}
+
+	if path == "-" {
+		paths, err := readPathList(stdin, delim)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file list from stdin: %w", err)
+		}
+		return paths, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file list %s: %w", path, err)
+	}
+	defer file.Close()
+	paths, err := readPathList(file, delim)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file list %s: %w", path, err)
+	}
+	return paths, nil
+}
+
+// scanListed scans the source paths and takes the destination files from
+// the --from-file list instead of walking the destination path.
+func scanListed(ctx context.Context, opts options, scanOpts dedup.ScanOptions) (map[string]*dedup.FileMetadata, map[string]*dedup.FileMetadata, dedup.ScanStats, error) {
+	sourceFiles, _, stats, err := dedup.ScanAll(ctx, opts.sourcePaths, nil, scanOpts)
+	if err != nil {
+		return nil, nil, dedup.ScanStats{}, err
+	}
+	// ScanList only knows OnFile, so route the destination counts there
+	destOpts := scanOpts
+	if destOpts.OnDestFile != nil {
+		destOpts.OnFile = destOpts.OnDestFile
+	}
+	destFiles, destStats, err := dedup.ScanList(ctx, opts.destPaths[0], opts.listedPaths, destOpts)
+	if err != nil {
+		return nil, nil, dedup.ScanStats{}, fmt.Errorf("error processing destination path: %w", err)
+	}
+	stats.Add(destStats)
+	return sourceFiles, destFiles, stats, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadPathList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		delim byte
+		want  []string
+	}{
+		{"lines", "a.txt\nsub/b.txt\n", '\n', []string{"a.txt", "sub/b.txt"}},
+		{"no final newline", "a.txt\nb.txt", '\n', []string{"a.txt", "b.txt"}},
+		{"CRLF and blanks", "a.txt\r\n\r\n\nb.txt\r\n", '\n', []string{"a.txt", "b.txt"}},
+		{"NUL", "a\nb.txt\x00c.txt\x00", 0, []string{"a\nb.txt", "c.txt"}},
+		{"empty", "", '\n', nil},
+	}
+	for _, test := range tests {
+		got, err := readPathList(strings.NewReader(test.input), test.delim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
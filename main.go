@@ -1,219 +1,2166 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+func printHelp(w io.Writer) {
+	fmt.Fprintln(w, "Usage: dedup [options] <source_path> <destination_path>")
+	fmt.Fprintln(w, "       dedup [options] --source <path>... --dest <path>...")
+	fmt.Fprintln(w, "       dedup [options] <path>")
+	fmt.Fprintln(w, "       dedup --undo <log_file>")
+	fmt.Fprintln(w, "\nArguments:")
+	fmt.Fprintln(w, "  source_path       Path to the source directory or file")
+	fmt.Fprintln(w, "  destination_path  Path to the destination directory or file")
+	fmt.Fprintln(w, "  path              Directory whose identical files are collapsed into one copy")
+	fmt.Fprintln(w, "  Two directories are compared as --match says. Two files are compared with")
+	fmt.Fprintln(w, "  each other whatever their names. A file and a directory are compared as if")
+	fmt.Fprintln(w, "  the file were the only entry of a directory, so with the default --match the")
+	fmt.Fprintln(w, "  file is paired with the entry of the same name at the top of the directory")
+	fmt.Fprintln(w, "  A path, or the PATH of --source and --dest, may be a quoted glob such as")
+	fmt.Fprintln(w, "  'backups/*'; every path it matches is scanned on that side")
+	fmt.Fprintln(w, "\nOptions:")
+	fmt.Fprintln(w, "  --source PATH     Source tree to keep (repeatable, requires --dest)")
+	fmt.Fprintln(w, "  --dest PATH       Destination tree to deduplicate (repeatable, requires --source)")
+	fmt.Fprintln(w, "                      When several trees contain the same relative path, the")
+	fmt.Fprintln(w, "                      one given first on the command line is used")
+	fmt.Fprintln(w, "  --match MODE      How files are paired:")
+	fmt.Fprintln(w, "                      relpath     same path relative to each root (default)")
+	fmt.Fprintln(w, "                      name        same base name anywhere in the tree")
+	fmt.Fprintln(w, "                      content     same contents regardless of name")
+	fmt.Fprintln(w, "                      size+mtime  same relative path, size and modification")
+	fmt.Fprintln(w, "                                  time, without reading the contents")
+	fmt.Fprintln(w, "  --ignore-case     Pair names that differ only in case, such as Photo.JPG")
+	fmt.Fprintln(w, "                      and photo.jpg")
+	fmt.Fprintln(w, "  --normalize-unicode")
+	fmt.Fprintln(w, "                    Pair names that differ only in Unicode normalization, as")
+	fmt.Fprintln(w, "                      names copied from macOS (NFD) and Linux (NFC) often do")
+	fmt.Fprintln(w, "  --keep POLICY     Copy kept while the others are linked to it:")
+	fmt.Fprintln(w, "                      first          the source, or the first in path order")
+	fmt.Fprintln(w, "                                     for a single path (default)")
+	fmt.Fprintln(w, "                      source         the source (two trees only)")
+	fmt.Fprintln(w, "                      dest           the destination (two trees only)")
+	fmt.Fprintln(w, "                      oldest         oldest modification time")
+	fmt.Fprintln(w, "                      newest         newest modification time")
+	fmt.Fprintln(w, "                      shortest-path  shortest path")
+	fmt.Fprintln(w, "                      longest-path   longest path")
+	fmt.Fprintln(w, "                      Ties are broken by path")
+	fmt.Fprintln(w, "  --direction DIR   Which side of each duplicate between two trees is replaced:")
+	fmt.Fprintln(w, "                      source-wins  the destination, by a link to the source")
+	fmt.Fprintln(w, "                                   (default)")
+	fmt.Fprintln(w, "                      dest-wins    the source, by a link to the destination")
+	fmt.Fprintln(w, "  --action ACTION   What replaces duplicates: symlink (default), hardlink, or")
+	fmt.Fprintln(w, "                      delete to remove them without a link (with --trash to")
+	fmt.Fprintln(w, "                      keep them recoverable)")
+	fmt.Fprintln(w, "  --link TYPE       Same as --action")
+	fmt.Fprintln(w, "  --relative-links  Create symlinks with targets relative to the destination")
+	fmt.Fprintln(w, "                      so they survive moving any directory holding both ends")
+	fmt.Fprintln(w, "  --windows-fallback MODE")
+	fmt.Fprintln(w, "                    What to do where Windows refuses to create symlinks without")
+	fmt.Fprintln(w, "                      Developer Mode or elevation: hardlink falls back to hard")
+	fmt.Fprintln(w, "                      links on the same volume, error (default) fails")
+	fmt.Fprintln(w, "  --link-base DIR   With --relative-links, refuse to link files outside DIR, so")
+	fmt.Fprintln(w, "                      DIR can be moved as a whole (default: no check)")
+	fmt.Fprintln(w, "  --preserve-times  Keep the replaced file's modification time on the symlink")
+	fmt.Fprintln(w, "  --follow-symlinks Follow symlinks to files and directories while scanning")
+	fmt.Fprintln(w, "  --max-depth N     Descend at most N directories below the path; 0 reads only")
+	fmt.Fprintln(w, "                      the path's own entries (default: no limit)")
+	fmt.Fprintln(w, "  --no-recursive    Only compare the files directly in each path, without reading")
+	fmt.Fprintln(w, "                      any subdirectory; the same as --max-depth 0")
+	fmt.Fprintln(w, "  --one-file-system, --no-cross-mounts")
+	fmt.Fprintln(w, "                    Don't descend into mount points or other directories on")
+	fmt.Fprintln(w, "                      another filesystem than the path's, listing each one")
+	fmt.Fprintln(w, "                      skipped (default: every subdirectory is scanned)")
+	fmt.Fprintln(w, "  --from-file LIST  Take the destination files (or, given one path, the files")
+	fmt.Fprintln(w, "                      of that tree) from LIST instead of walking it; - reads")
+	fmt.Fprintln(w, "                      stdin. Listed paths must be under the path they stand for")
+	fmt.Fprintln(w, "  --null            Separate --from-file entries with NUL, as find -print0 does")
+	fmt.Fprintln(w, "  --include-empty   Compare empty files too; they are skipped by default, since")
+	fmt.Fprintln(w, "                      every empty file duplicates every other")
+	fmt.Fprintln(w, "  --min-size SIZE   Ignore files smaller than SIZE (e.g. 4k, 1M)")
+	fmt.Fprintln(w, "  --max-size SIZE   Ignore files larger than SIZE (e.g. 500M, 2G)")
+	fmt.Fprintln(w, "  --exclude GLOB    Skip files and directories matching GLOB (repeatable)")
+	fmt.Fprintln(w, "                      e.g. '*.lock', 'node_modules', '.git/**'")
+	fmt.Fprintln(w, "  --exclude-from FILE")
+	fmt.Fprintln(w, "                    Also exclude the patterns in FILE, one per line as in")
+	fmt.Fprintln(w, "                      .dedupignore (repeatable)")
+	fmt.Fprintln(w, "  --ignore-file NAME")
+	fmt.Fprintln(w, "                    Exclude the patterns in the file NAME at each scanned root")
+	fmt.Fprintln(w, "                      (default .dedupignore; --ignore-file= to disable)")
+	fmt.Fprintln(w, "  --include GLOB    Only consider files matching GLOB (repeatable)")
+	fmt.Fprintln(w, "                      Excludes are applied first: a file matching both")
+	fmt.Fprintln(w, "                      an --exclude and an --include pattern is skipped")
+	fmt.Fprintln(w, "  --ext LIST        Only consider files with one of the comma-separated")
+	fmt.Fprintln(w, "                      extensions in LIST, ignoring case, e.g. .jpg,png,tar.gz")
+	fmt.Fprintln(w, "                      (repeatable)")
+	fmt.Fprintln(w, "  --config FILE     Read default options from the TOML file FILE; its keys are")
+	fmt.Fprintln(w, "                      the option names with _ for -, e.g. dry_run = true or")
+	fmt.Fprintln(w, "                      exclude = [\"*.lock\"], and options given here override them")
+	fmt.Fprintln(w, "  --jobs N          Number of concurrent directory scans, hashes and replacements")
+	fmt.Fprintln(w, "                      (default: CPU count)")
+	fmt.Fprintln(w, "  --max-open-files N")
+	fmt.Fprintln(w, "                    Files the concurrent scans, hashes and replacements may have")
+	fmt.Fprintln(w, "                      open at once, whatever --jobs is (default: half the")
+	fmt.Fprintln(w, "                      process's open file limit; 0 for no limit)")
+	fmt.Fprintln(w, "  --verify          Compare duplicates byte-by-byte before replacing them")
+	fmt.Fprintln(w, "  --apply, --force  Replace, restore or materialize files; without it every run")
+	fmt.Fprintln(w, "                      is a dry run")
+	fmt.Fprintln(w, "  --dry-run         Report what would be replaced without modifying anything")
+	fmt.Fprintln(w, "                      (the default unless --apply is given)")
+	fmt.Fprintln(w, "  --retries N       Retry a replacement up to N times when it fails with a")
+	fmt.Fprintln(w, "                      transient error, such as a busy file on a network")
+	fmt.Fprintln(w, "                      filesystem (default: 0)")
+	fmt.Fprintln(w, "  --retry-delay DURATION")
+	fmt.Fprintln(w, "                    Wait before the first retry, doubled for each one after")
+	fmt.Fprintln(w, "                      (default: 100ms)")
+	fmt.Fprintln(w, "  --prune-empty-dirs")
+	fmt.Fprintln(w, "                    Remove the directories left empty by the replacements, and")
+	fmt.Fprintln(w, "                      their parents if they are left empty too, but never a")
+	fmt.Fprintln(w, "                      path given on the command line")
+	fmt.Fprintln(w, "  --dir-level       Replace each destination subdirectory whose whole tree")
+	fmt.Fprintln(w, "                      duplicates the source's, file for file and with nothing")
+	fmt.Fprintln(w, "                      else in either, by one symlink to the source directory;")
+	fmt.Fprintln(w, "                      symlinks only, and not with --trash, --log, --interactive")
+	fmt.Fprintln(w, "                      or --direction=dest-wins")
+	fmt.Fprintln(w, "  --dedup-dest-internal")
+	fmt.Fprintln(w, "                    Also link the destination files that duplicate each other")
+	fmt.Fprintln(w, "                      but no source file, as with a single path; a file")
+	fmt.Fprintln(w, "                      identical to a duplicate of a source file is linked to")
+	fmt.Fprintln(w, "                      that source. Not with --dir-level")
+	fmt.Fprintln(w, "  --strict          Fail instead of warning when a source and a destination path")
+	fmt.Fprintln(w, "                      contain one another")
+	fmt.Fprintln(w, "  --confirm-threshold N")
+	fmt.Fprintln(w, "                    Ask before replacing more than N files (default 10000;")
+	fmt.Fprintln(w, "                      0 never asks); without a terminal, stop instead")
+	fmt.Fprintln(w, "  --confirm-percent P")
+	fmt.Fprintln(w, "                    Likewise ask before replacing more than P percent of the")
+	fmt.Fprintln(w, "                      files scanned on the side replaced (default 0, off)")
+	fmt.Fprintln(w, "  --yes             Replace without asking, whatever the thresholds or overlaps")
+	fmt.Fprintln(w, "  --interactive     List the duplicates and ask before replacing them, either")
+	fmt.Fprintln(w, "                      all at once or file by file")
+	fmt.Fprintln(w, "  --hash ALGORITHM  Hash used to compare contents: xxh64 (default), sha256 or")
+	fmt.Fprintln(w, "                      md5; xxh64 is fast but not collision-proof, so")
+	fmt.Fprintln(w, "                      --verify is recommended with it")
+	fmt.Fprintln(w, "  --prefix-hash SIZE Hash only the first SIZE bytes of each file, e.g. 1M, for a")
+	fmt.Fprintln(w, "                      fast pass finding approximate duplicates to review; files")
+	fmt.Fprintln(w, "                      that only start alike match too, so --apply needs --verify")
+	fmt.Fprintln(w, "  --buffer-size SIZE Read files SIZE bytes at a time when hashing and")
+	fmt.Fprintln(w, "                      verifying (default: 64k)")
+	fmt.Fprintln(w, "  --max-read-bytes-per-sec SIZE")
+	fmt.Fprintln(w, "                    Cap the combined rate files are read at when hashing and")
+	fmt.Fprintln(w, "                      verifying, e.g. 20M, to spare a shared disk (default: 0")
+	fmt.Fprintln(w, "                      for no limit)")
+	fmt.Fprintln(w, "  --cache FILE      Reuse file hashes stored in FILE by earlier runs while the")
+	fmt.Fprintln(w, "                      file's size and modification time are unchanged")
+	fmt.Fprintln(w, "  --trash DIR       Move replaced files into DIR instead of deleting them")
+	fmt.Fprintln(w, "  --log FILE        Append a record of every replacement to FILE")
+	fmt.Fprintln(w, "  --undo FILE       Restore the files replaced in the log FILE and exit")
+	fmt.Fprintln(w, "  --plan-out FILE   Write the replacements this dry run would make to FILE, to be")
+	fmt.Fprintln(w, "                      reviewed and later applied with --plan-apply")
+	fmt.Fprintln(w, "  --plan-apply FILE Replace the duplicates listed in the plan FILE, linked as the")
+	fmt.Fprintln(w, "                      plan says, skipping any file whose size, modification time")
+	fmt.Fprintln(w, "                      or hash changed since it was planned; with --apply only")
+	fmt.Fprintln(w, "  --manifest-out FILE")
+	fmt.Fprintln(w, "                    Write the size and hash of every file under the single path")
+	fmt.Fprintln(w, "                      to FILE and exit")
+	fmt.Fprintln(w, "  --manifest-in FILE")
+	fmt.Fprintln(w, "                    Use the tree recorded in FILE as the source and deduplicate")
+	fmt.Fprintln(w, "                      the single path against it without rescanning the source;")
+	fmt.Fprintln(w, "                      FILE may be an http:// or https:// URL serving the JSON")
+	fmt.Fprintln(w, "  --timeout DURATION")
+	fmt.Fprintln(w, "                    Give up fetching a --manifest-in URL after DURATION")
+	fmt.Fprintln(w, "                      (default: 30s)")
+	fmt.Fprintln(w, "  --verify-links    Check the symlinks under the single path and report those")
+	fmt.Fprintln(w, "                      that are broken; with --log FILE, also report links")
+	fmt.Fprintln(w, "                      recorded there whose target contents changed")
+	fmt.Fprintln(w, "  --materialize     Replace each symlink under the single path that points within")
+	fmt.Fprintln(w, "                      it with a copy of its target, undoing deduplication")
+	fmt.Fprintln(w, "  --format FORMAT   Report duplicates as text (default), json, jsonl or csv;")
+	fmt.Fprintln(w, "                      jsonl writes one JSON object per line as each duplicate")
+	fmt.Fprintln(w, "                      is found, when it can be; with any but text, progress")
+	fmt.Fprintln(w, "                      messages go to stderr")
+	fmt.Fprintln(w, "  --print0          Report only the destination of each duplicate, each followed")
+	fmt.Fprintln(w, "                      by a NUL byte, for xargs -0; progress messages go")
+	fmt.Fprintln(w, "                      to stderr")
+	fmt.Fprintln(w, "  --output FILE     Write the report to FILE instead of stdout")
+	fmt.Fprintln(w, "  --log-level LEVEL Log debug, info, warn (default) or error records to stderr;")
+	fmt.Fprintln(w, "                      replacements are logged at info, skips at debug")
+	fmt.Fprintln(w, "  --log-format FMT  Encode log records as text (default) or json")
+	fmt.Fprintln(w, "  -q, --quiet       Print nothing but errors and failure summaries; a json, csv")
+	fmt.Fprintln(w, "                      or --print0 report, or one sent to --output, is still")
+	fmt.Fprintln(w, "                      written")
+	fmt.Fprintln(w, "  --progress        Show scan and replace progress on stderr (default when")
+	fmt.Fprintln(w, "                      stderr is a terminal; --progress=false to hide it)")
+	fmt.Fprintln(w, "  --group           Report duplicates grouped by contents, listing every copy")
+	fmt.Fprintln(w, "                      and the bytes each group could reclaim")
+	fmt.Fprintln(w, "  --top N           Report the N directories holding the most reclaimable bytes")
+	fmt.Fprintln(w, "                      instead of each duplicate")
+	fmt.Fprintln(w, "  --report-unique   List the relative paths found only in the source or only")
+	fmt.Fprintln(w, "                      in the destination, and exit without replacing anything")
+	fmt.Fprintln(w, "  --diff            Like --report-unique, and also list the relative paths in")
+	fmt.Fprintln(w, "                      both trees as modified or identical by their contents")
+	fmt.Fprintln(w, "  --inspect-archives")
+	fmt.Fprintln(w, "                    Experimental: also compare the files inside .zip, .tar,")
+	fmt.Fprintln(w, "                      .tar.gz and .tgz archives, as archive!/member, and only")
+	fmt.Fprintln(w, "                      report the duplicates found, since members can't be linked")
+	fmt.Fprintln(w, "  --same-name-different-size")
+	fmt.Fprintln(w, "                    List the destination files whose counterpart in the source,")
+	fmt.Fprintln(w, "                      paired as --match pairs them, has a different size, and")
+	fmt.Fprintln(w, "                      exit without reading or replacing anything")
+	fmt.Fprintln(w, "  --stats           Print how long the scan, hashing and replace phases took and")
+	fmt.Fprintln(w, "                      the total size of the files scanned, with a histogram of")
+	fmt.Fprintln(w, "                      the duplicates' sizes and extensions")
+	fmt.Fprintln(w, "  --stats-buckets SIZES")
+	fmt.Fprintln(w, "                    Comma-separated, ascending sizes the --stats histogram is")
+	fmt.Fprintln(w, "                      split at (default: 1k,1M,100M)")
+	fmt.Fprintln(w, "  -v, --version     Print version and build information and exit")
+	fmt.Fprintln(w, "\nDescription:")
+	fmt.Fprintln(w, "  Compares two paths and performs deduplication operations.")
+	fmt.Fprintln(w, "\nExit status:")
+	fmt.Fprintln(w, "  0  Success, whether or not anything was replaced")
+	fmt.Fprintln(w, "  1  Invalid options or arguments")
+	fmt.Fprintln(w, "  2  The scan, or another step before replacing, failed")
+	fmt.Fprintln(w, "  3  One or more replacements, restores or materializations failed, or")
+	fmt.Fprintln(w, "     --verify-links found problems")
+	fmt.Fprintln(w, "  4  Cancelled by an interrupt")
+}
+
+// Exit codes returned by run.
+const (
+	exitOK        = 0
+	exitUsage     = 1
+	exitError     = 2 // A step before the replacements failed
+	exitFailed    = 3 // Some replacements failed
+	exitCancelled = 4
+)
+
+// outputFormat selects how the list of duplicates is reported.
+type outputFormat string
+
+const (
+	formatText  outputFormat = "text"
+	formatJSON  outputFormat = "json"
+	formatJSONL outputFormat = "jsonl" // One JSON object per line, streamed as duplicates are found
+	formatCSV   outputFormat = "csv"
+	formatNUL   outputFormat = "print0" // Set by --print0 rather than --format
 )
 
-func printHelp() {
-	fmt.Println("Usage: dedup <source_path> <destination_path>")
-	fmt.Println("\nArguments:")
-	fmt.Println("  source_path       Path to the source directory or file")
-	fmt.Println("  destination_path  Path to the destination directory or file")
-	fmt.Println("\nDescription:")
-	fmt.Println("  Compares two paths and performs deduplication operations.")
+func parseOutputFormat(value string) (outputFormat, error) {
+	switch format := outputFormat(value); format {
+	case formatText, formatJSON, formatJSONL, formatCSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (expected text, json, jsonl or csv)", value)
+	}
 }
 
-func validateArgs() (string, string, bool) {
-	args := os.Args[1:]
+type options struct {
+	sourcePaths  []string // Trees whose files are kept
+	destPaths    []string // Trees whose duplicates are replaced; empty to dedup sourcePaths[0] alone
+	match        dedup.MatchOptions
+	keep         dedup.KeepPolicy
+	direction    dedup.Direction
+	interactive  bool // Ask for confirmation before replacing anything
+	strict       bool // Fail rather than warn when the trees overlap
+	scan         dedup.ScanOptions
+	apply        dedup.ApplyOptions
+	format       outputFormat
+	output       string        // File the report is written to instead of stdout
+	cachePath    string        // File hashes are cached in between runs
+	logPath      string        // Action log recording each replacement
+	undoPath     string        // Action log to undo instead of deduplicating
+	planOut      string        // File the replacements a dry run would make are written to
+	planApply    string        // Plan whose replacements are made instead of deduplicating
+	jobs         int           // Number of concurrent directory scans and replacements
+	maxOpenFiles int           // Files the concurrent work may have open at once; 0 means no limit
+	help         bool          // Print the usage instead of deduplicating
+	version      bool          // Print the version instead of deduplicating
+	fromFile     string        // List of files read instead of walking the destination, or "-" for stdin
+	null         bool          // Entries in fromFile are NUL-separated
+	print0       bool          // Report the duplicate destinations NUL-separated
+	listedPaths  []string      // Paths read from fromFile
+	manifestOut  string        // File the hashes of the single path are written to instead of deduplicating
+	manifestIn   string        // Manifest standing in for the source tree, a file or an HTTP(S) URL
+	timeout      time.Duration // Limit on fetching a manifestIn URL
+	manifest     *dedup.Manifest
+
+	progress       bool       // Show scan and replace progress on stderr
+	quiet          bool       // Print only errors and any machine-readable report
+	logLevel       slog.Level // Least severe record written to the structured log
+	logFormat      logFormat
+	reportUnique   bool          // List the files found on only one side instead of deduplicating
+	diff           bool          // Like reportUnique, also listing modified and identical files
+	sizeMismatches bool          // List the files paired with a source file of another size instead
+	verifyLinks    bool          // Check the symlinks in the single path instead of deduplicating
+	materialize    bool          // Replace the symlinks within the single path with copies
+	group          bool          // Report duplicates grouped by contents
+	top            int           // Report this many directories with the most reclaimable bytes instead; 0 for the duplicates
+	pruneEmptyDirs bool          // Remove directories left empty by the replacements
+	confirmed      bool          // --apply was given, so files may be modified
+	implicitDryRun bool          // DryRun is set only because confirmed isn't
+	dirLevel       bool          // Link wholly duplicated destination directories instead of their files
+	yes            bool          // Don't ask before replacing more files than the thresholds below
+	confirmCount   int           // Ask before replacing more files than this; 0 never asks
+	confirmShare   float64       // Ask before replacing more than this percentage of the scanned files; 0 never asks
+	destInternal   bool          // Also link the destination files that duplicate each other
+	noRecursive    bool          // Scan only the entries directly in each path
+	stats          bool          // Print how long each phase took
+	statsBuckets   []int64       // Sizes the --stats histogram of duplicates is split at
+	timings        *phaseTimings // Filled in by each phase if stats is set
+}
+
+// parseSize parses a byte count with an optional binary suffix such as 4k,
+// 1M or 2G. A trailing "B" or "iB" is accepted, so 4KiB and 4KB equal 4k.
+func parseSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), "I")
+
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return size * multiplier, nil
+}
+
+// validateArgs parses the command line args, printing usage errors and help
+// on stdout. Progress is shown by default when stderr is a terminal.
+func validateArgs(args []string, stdout, stderr io.Writer) (options, bool) {
+	opts := options{
+		match:     dedup.MatchOptions{Mode: dedup.MatchRelPath},
+		keep:      dedup.KeepFirst,
+		direction: dedup.SourceWins,
+		scan:      dedup.ScanOptions{IgnoreFile: ".dedupignore", SkipEmpty: true},
+		apply:     dedup.ApplyOptions{Link: dedup.LinkSymlink},
+		format:    formatText,
+		jobs:      runtime.NumCPU(),
+		logLevel:  slog.LevelWarn,
+		logFormat: logText,
+	}
+	flags := flag.NewFlagSet("dedup", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Func("source", "", func(value string) error {
+		matches, err := expandGlob(value)
+		opts.sourcePaths = append(opts.sourcePaths, matches...)
+		return err
+	})
+	flags.Func("dest", "", func(value string) error {
+		matches, err := expandGlob(value)
+		opts.destPaths = append(opts.destPaths, matches...)
+		return err
+	})
+	flags.Func("match", "", func(value string) error {
+		mode, err := dedup.ParseMatchMode(value)
+		opts.match.Mode = mode
+		return err
+	})
+	flags.BoolVar(&opts.match.IgnoreCase, "ignore-case", false, "")
+	flags.BoolVar(&opts.match.NormalizeUnicode, "normalize-unicode", false, "")
+	flags.Func("keep", "", func(value string) error {
+		policy, err := dedup.ParseKeepPolicy(value)
+		opts.keep = policy
+		return err
+	})
+	flags.Func("direction", "", func(value string) error {
+		direction, err := dedup.ParseDirection(value)
+		opts.direction = direction
+		return err
+	})
+	setAction := func(value string) error {
+		link, err := dedup.ParseLinkType(value)
+		opts.apply.Link = link
+		return err
+	}
+	flags.Func("action", "", setAction)
+	flags.Func("link", "", setAction)
+	flags.BoolVar(&opts.apply.RelativeLinks, "relative-links", false, "")
+	flags.StringVar(&opts.apply.LinkBase, "link-base", "", "")
+	flags.Func("windows-fallback", "", func(value string) error {
+		switch value {
+		case "hardlink":
+			opts.apply.HardlinkFallback = true
+		case "error":
+			opts.apply.HardlinkFallback = false
+		default:
+			return fmt.Errorf("unknown fallback %q (expected hardlink or error)", value)
+		}
+		return nil
+	})
+	flags.BoolVar(&opts.scan.FollowSymlinks, "follow-symlinks", false, "")
+	flags.BoolVar(&opts.scan.OneFileSystem, "one-file-system", false, "")
+	flags.BoolVar(&opts.scan.OneFileSystem, "no-cross-mounts", false, "")
+	flags.Func("max-depth", "", func(value string) error {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			return fmt.Errorf("invalid depth %q", value)
+		}
+		// The library counts the root as the first level
+		opts.scan.MaxDepth = depth + 1
+		return nil
+	})
+	flags.BoolVar(&opts.noRecursive, "no-recursive", false, "")
+	flags.StringVar(&opts.fromFile, "from-file", "", "")
+	flags.BoolVar(&opts.null, "null", false, "")
+	flags.BoolFunc("include-empty", "", func(value string) error {
+		include, err := strconv.ParseBool(value)
+		opts.scan.SkipEmpty = !include
+		return err
+	})
+	flags.Func("min-size", "", func(value string) error {
+		size, err := parseSize(value)
+		opts.scan.MinSize = size
+		return err
+	})
+	flags.Func("max-size", "", func(value string) error {
+		size, err := parseSize(value)
+		opts.scan.MaxSize = size
+		return err
+	})
+	flags.Func("exclude", "", func(value string) error {
+		opts.scan.Exclude = append(opts.scan.Exclude, value)
+		return dedup.ValidatePattern(value)
+	})
+	flags.Func("exclude-from", "", func(value string) error {
+		rules, err := dedup.ReadIgnoreFile(value)
+		opts.scan.ExcludeRules = append(opts.scan.ExcludeRules, rules...)
+		return err
+	})
+	flags.StringVar(&opts.scan.IgnoreFile, "ignore-file", opts.scan.IgnoreFile, "")
+	flags.Func("include", "", func(value string) error {
+		opts.scan.Include = append(opts.scan.Include, value)
+		return dedup.ValidatePattern(value)
+	})
+	flags.Func("ext", "", func(value string) error {
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.TrimSpace(ext)
+			if strings.TrimPrefix(ext, ".") == "" {
+				return fmt.Errorf("empty extension in %q", value)
+			}
+			opts.scan.Extensions = append(opts.scan.Extensions, ext)
+		}
+		return nil
+	})
+	flags.BoolVar(&opts.print0, "print0", false, "")
+	flags.Func("format", "", func(value string) error {
+		format, err := parseOutputFormat(value)
+		opts.format = format
+		return err
+	})
+	flags.StringVar(&opts.output, "output", "", "")
+	flags.Func("hash", "", func(value string) error {
+		algorithm, err := dedup.ParseHashAlgorithm(value)
+		opts.scan.Hash = algorithm
+		return err
+	})
+	flags.Func("buffer-size", "", func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		if size < 1 || size > math.MaxInt32 {
+			return fmt.Errorf("buffer size %q must be between 1 byte and 2G", value)
+		}
+		opts.scan.BufferSize = int(size)
+		opts.apply.BufferSize = int(size)
+		return nil
+	})
+	flags.Func("prefix-hash", "", func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("prefix size must be positive")
+		}
+		opts.scan.PrefixHash = size
+		return nil
+	})
+	flags.Func("max-read-bytes-per-sec", "", func(value string) error {
+		rate, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		// One limiter is shared so the rate is capped across all reads
+		opts.scan.ReadLimit = dedup.NewReadLimiter(rate)
+		opts.apply.ReadLimit = opts.scan.ReadLimit
+		return nil
+	})
+	flags.StringVar(&opts.cachePath, "cache", "", "")
+	flags.StringVar(&opts.apply.TrashDir, "trash", "", "")
+	flags.StringVar(&opts.logPath, "log", "", "")
+	flags.StringVar(&opts.undoPath, "undo", "", "")
+	flags.StringVar(&opts.planOut, "plan-out", "", "")
+	flags.StringVar(&opts.planApply, "plan-apply", "", "")
+	flags.StringVar(&opts.manifestOut, "manifest-out", "", "")
+	flags.StringVar(&opts.manifestIn, "manifest-in", "", "")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "")
+	flags.IntVar(&opts.jobs, "jobs", opts.jobs, "")
+	flags.IntVar(&opts.maxOpenFiles, "max-open-files", defaultMaxOpenFiles(), "")
+	flags.BoolVar(&opts.apply.PreserveTimes, "preserve-times", false, "")
+	flags.BoolVar(&opts.apply.Verify, "verify", false, "")
+	flags.BoolVar(&opts.apply.DryRun, "dry-run", false, "")
+	flags.BoolVar(&opts.confirmed, "apply", false, "")
+	flags.BoolVar(&opts.confirmed, "force", false, "")
+	flags.IntVar(&opts.apply.Retries, "retries", 0, "")
+	flags.DurationVar(&opts.apply.RetryDelay, "retry-delay", 100*time.Millisecond, "")
+	flags.BoolVar(&opts.interactive, "interactive", false, "")
+	flags.BoolVar(&opts.strict, "strict", false, "")
+	flags.BoolVar(&opts.yes, "yes", false, "")
+	flags.IntVar(&opts.confirmCount, "confirm-threshold", 10000, "")
+	flags.Float64Var(&opts.confirmShare, "confirm-percent", 0, "")
+	flags.BoolVar(&opts.pruneEmptyDirs, "prune-empty-dirs", false, "")
+	flags.BoolVar(&opts.dirLevel, "dir-level", false, "")
+	flags.BoolVar(&opts.destInternal, "dedup-dest-internal", false, "")
+	flags.BoolVar(&opts.scan.InspectArchives, "inspect-archives", false, "")
+	flags.BoolVar(&opts.progress, "progress", isTerminal(stderr), "")
+	flags.BoolVar(&opts.quiet, "quiet", false, "")
+	flags.BoolVar(&opts.quiet, "q", false, "")
+	flags.Func("log-level", "", func(value string) error {
+		level, err := parseLogLevel(value)
+		opts.logLevel = level
+		return err
+	})
+	flags.Func("log-format", "", func(value string) error {
+		format, err := parseLogFormat(value)
+		opts.logFormat = format
+		return err
+	})
+	flags.BoolVar(&opts.reportUnique, "report-unique", false, "")
+	flags.BoolVar(&opts.sizeMismatches, "same-name-different-size", false, "")
+	flags.BoolVar(&opts.diff, "diff", false, "")
+	flags.BoolVar(&opts.verifyLinks, "verify-links", false, "")
+	flags.BoolVar(&opts.materialize, "materialize", false, "")
+	flags.BoolVar(&opts.group, "group", false, "")
+	flags.Func("top", "", func(value string) error {
+		top, err := strconv.Atoi(value)
+		if err != nil || top < 1 {
+			return fmt.Errorf("invalid count %q", value)
+		}
+		opts.top = top
+		return nil
+	})
+	flags.BoolVar(&opts.stats, "stats", false, "")
+	flags.Func("stats-buckets", "", func(value string) error {
+		var bounds []int64
+		for _, field := range strings.Split(value, ",") {
+			bound, err := parseSize(strings.TrimSpace(field))
+			if err != nil {
+				return err
+			}
+			if bound < 1 || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+				return fmt.Errorf("sizes must be positive and ascending, got %q", value)
+			}
+			bounds = append(bounds, bound)
+		}
+		opts.statsBuckets = bounds
+		return nil
+	})
+	flags.String("config", "", "")
+	flags.BoolVar(&opts.help, "help", false, "")
+	flags.BoolVar(&opts.help, "h", false, "")
+	flags.BoolVar(&opts.version, "version", false, "")
+	flags.BoolVar(&opts.version, "v", false, "")
+
+	// Apply the config file first, so the command line overrides it
+	if path := configPath(args); path != "" {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			err = cfg.apply(flags)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printHelp(stdout)
+			return options{}, false
+		}
+	}
+
+	// Parse repeatedly so options may appear before or after the paths
+	given := trackFlags(flags)
+	var paths []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printHelp(stdout)
+			return options{}, false
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		paths = append(paths, args[0])
+		args = args[1:]
+	}
+	// Read from the parsed flags, so a value such as --exclude -v isn't
+	// mistaken for them
+	if opts.help || opts.version {
+		return options{help: opts.help, version: opts.version}, true
+	}
+
+	// The command line overrides the config, so --apply and --dry-run only
+	// conflict when both are given there
+	givenApply := given["apply"] || given["force"]
+	if opts.confirmed && !givenApply && (given["dry-run"] || opts.planOut != "" || opts.scan.InspectArchives) {
+		opts.confirmed = false
+	}
+	if opts.apply.DryRun && !given["dry-run"] && givenApply {
+		opts.apply.DryRun = false
+	}
+
+	if opts.scan.InspectArchives && (opts.confirmed || opts.interactive || opts.dirLevel || opts.manifestOut != "" || opts.manifestIn != "") {
+		fmt.Fprintln(stdout, "Error: --inspect-archives only reports duplicates, so it can't be combined with --apply, --interactive, --dir-level or a manifest")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.planOut != "" {
+		if opts.confirmed || opts.planApply != "" || opts.dirLevel {
+			fmt.Fprintln(stdout, "Error: --plan-out only plans, so it can't be combined with --apply, --plan-apply or --dir-level")
+			printHelp(stdout)
+			return options{}, false
+		}
+		opts.apply.DryRun = true
+	}
+	if opts.confirmed && opts.apply.DryRun {
+		fmt.Fprintln(stdout, "Error: --apply and --dry-run can't be combined")
+		printHelp(stdout)
+		return options{}, false
+	}
+	// Nothing is modified by accident: whatever would change files is only
+	// reported until --apply says to go ahead
+	readOnly := opts.help || opts.version || opts.verifyLinks || opts.manifestOut != "" ||
+		opts.reportUnique || opts.diff || opts.sizeMismatches || opts.scan.InspectArchives
+	if !opts.confirmed && !opts.apply.DryRun && !readOnly {
+		opts.apply.DryRun = true
+		opts.implicitDryRun = true
+	}
+
+	if opts.noRecursive {
+		if opts.scan.MaxDepth > 1 {
+			fmt.Fprintln(stdout, "Error: --no-recursive can't be combined with a --max-depth above 0")
+			printHelp(stdout)
+			return options{}, false
+		}
+		opts.scan.MaxDepth = 1
+	}
+
+	if opts.scan.MaxSize > 0 && opts.scan.MinSize > opts.scan.MaxSize {
+		fmt.Fprintln(stdout, "Error: --min-size must not be larger than --max-size")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.statsBuckets != nil && !opts.stats {
+		fmt.Fprintln(stdout, "Error: --stats-buckets requires --stats")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.statsBuckets == nil {
+		opts.statsBuckets = defaultSizeBuckets
+	}
+
+	if opts.apply.LinkBase != "" && !opts.apply.RelativeLinks {
+		fmt.Fprintln(stdout, "Error: --link-base requires --relative-links")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.print0 {
+		if given["format"] {
+			fmt.Fprintln(stdout, "Error: --print0 can't be combined with --format")
+			printHelp(stdout)
+			return options{}, false
+		}
+		if opts.group || opts.top > 0 || opts.reportUnique || opts.diff || opts.sizeMismatches {
+			fmt.Fprintln(stdout, "Error: --print0 only lists duplicates, so it can't be combined with --group, --top, --report-unique, --diff or --same-name-different-size")
+			printHelp(stdout)
+			return options{}, false
+		}
+		opts.format = formatNUL
+	}
+	if opts.format == formatJSONL && (opts.group || opts.top > 0 || opts.reportUnique || opts.diff || opts.sizeMismatches) {
+		fmt.Fprintln(stdout, "Error: --format=jsonl only lists duplicates, so it can't be combined with --group, --top, --report-unique, --diff or --same-name-different-size")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.quiet {
+		if opts.interactive {
+			fmt.Fprintln(stdout, "Error: --quiet can't be combined with --interactive")
+			printHelp(stdout)
+			return options{}, false
+		}
+		// Only what was asked for explicitly is still shown
+		if !given["log-level"] {
+			opts.logLevel = slog.LevelError
+		}
+		if !given["progress"] {
+			opts.progress = false
+		}
+	}
+
+	if opts.group && opts.top > 0 {
+		fmt.Fprintln(stdout, "Error: --group and --top can't be combined")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.jobs < 1 {
+		fmt.Fprintln(stdout, "Error: --jobs must be at least 1")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.direction == dedup.DestWins && opts.keep != dedup.KeepFirst && opts.keep != dedup.KeepSource {
+		fmt.Fprintf(stdout, "Error: --direction=dest-wins can't be combined with --keep=%s\n", opts.keep)
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.fromFile == "-" && opts.interactive {
+		fmt.Fprintln(stdout, "Error: --from-file - can't be combined with --interactive, which also reads stdin")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.apply.Retries < 0 || opts.apply.RetryDelay < 0 {
+		fmt.Fprintln(stdout, "Error: --retries and --retry-delay must not be negative")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.timeout <= 0 {
+		fmt.Fprintln(stdout, "Error: --timeout must be positive")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	// The trees --dir-level replaces aren't kept anywhere, so nothing
+	// could undo them
+	if opts.dirLevel && opts.apply.Link != dedup.LinkSymlink {
+		fmt.Fprintf(stdout, "Error: --dir-level only replaces directories with symlinks, not --action=%s\n", opts.apply.Link)
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.dirLevel && (opts.apply.TrashDir != "" || opts.logPath != "" || opts.interactive || opts.direction == dedup.DestWins) {
+		fmt.Fprintln(stdout, "Error: --dir-level can't be combined with --trash, --log, --interactive or --direction=dest-wins")
+		printHelp(stdout)
+		return options{}, false
+	}
+	// A prefix match may be a different file, so only a byte-by-byte
+	// comparison makes it safe to replace
+	if opts.scan.PrefixHash > 0 && opts.confirmed && !opts.apply.Verify {
+		fmt.Fprintln(stdout, "Error: --prefix-hash only finds approximate duplicates; pass --verify so --apply compares whole files before replacing them")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.scan.PrefixHash > 0 && (opts.manifestOut != "" || opts.manifestIn != "") {
+		fmt.Fprintln(stdout, "Error: --prefix-hash can't be combined with --manifest-out or --manifest-in, which record whole-file hashes")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.dirLevel && opts.destInternal {
+		fmt.Fprintln(stdout, "Error: --dir-level can't be combined with --dedup-dest-internal")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.confirmCount < 0 || opts.confirmShare < 0 {
+		fmt.Fprintln(stdout, "Error: --confirm-threshold and --confirm-percent must not be negative")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	if opts.maxOpenFiles < 0 {
+		fmt.Fprintln(stdout, "Error: --max-open-files must not be negative")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	opts.scan.Jobs = opts.jobs
+	opts.apply.Jobs = opts.jobs
+	opts.match.Jobs = opts.jobs
+	// One limiter is shared so the bound holds across the whole run
+	opts.scan.OpenLimit = dedup.NewOpenLimiter(opts.maxOpenFiles)
+	opts.match.OpenLimit = opts.scan.OpenLimit
+	opts.apply.OpenLimit = opts.scan.OpenLimit
+
+	if opts.undoPath != "" {
+		if len(paths) > 0 || len(opts.sourcePaths) > 0 || len(opts.destPaths) > 0 {
+			fmt.Fprintln(stdout, "Error: --undo doesn't take any paths")
+			printHelp(stdout)
+			return options{}, false
+		}
+		if opts.planApply != "" {
+			fmt.Fprintln(stdout, "Error: --undo and --plan-apply can't be combined")
+			printHelp(stdout)
+			return options{}, false
+		}
+		return opts, true
+	}
+
+	if opts.planApply != "" {
+		if len(paths) > 0 || len(opts.sourcePaths) > 0 || len(opts.destPaths) > 0 {
+			fmt.Fprintln(stdout, "Error: --plan-apply doesn't take any paths")
+			printHelp(stdout)
+			return options{}, false
+		}
+		for _, name := range []string{"action", "link", "relative-links", "link-base", "dir-level"} {
+			if given[name] {
+				fmt.Fprintf(stdout, "Error: --plan-apply links files as the plan says, so it can't be combined with --%s\n", name)
+				printHelp(stdout)
+				return options{}, false
+			}
+		}
+		return opts, true
+	}
 
-	// Check if help flag is provided
-	for _, arg := range args {
-		if arg == "-h" || arg == "--help" {
-			printHelp()
-			return "", "", false
+	if opts.verifyLinks || opts.materialize {
+		if opts.verifyLinks && opts.materialize {
+			fmt.Fprintln(stdout, "Error: --verify-links and --materialize can't be combined")
+			printHelp(stdout)
+			return options{}, false
 		}
+		if len(paths) != 1 || len(opts.sourcePaths) > 0 || len(opts.destPaths) > 0 {
+			fmt.Fprintln(stdout, "Error: --verify-links and --materialize take a single path argument")
+			printHelp(stdout)
+			return options{}, false
+		}
+		opts.sourcePaths = paths
+		return opts, true
 	}
 
-	if len(args) != 2 {
-		fmt.Println("Error: Expected exactly two path arguments")
-		printHelp()
-		return "", "", false
+	if opts.manifestOut != "" || opts.manifestIn != "" {
+		if opts.manifestOut != "" && opts.manifestIn != "" {
+			fmt.Fprintln(stdout, "Error: --manifest-out and --manifest-in can't be combined")
+			printHelp(stdout)
+			return options{}, false
+		}
+		if len(paths) != 1 || len(opts.sourcePaths) > 0 || len(opts.destPaths) > 0 {
+			fmt.Fprintln(stdout, "Error: --manifest-out and --manifest-in take a single path argument")
+			printHelp(stdout)
+			return options{}, false
+		}
+		matches, err := expandGlob(paths[0])
+		if err == nil && len(matches) > 1 {
+			err = fmt.Errorf("%s matches %d paths, but only one is taken", paths[0], len(matches))
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printHelp(stdout)
+			return options{}, false
+		}
+		if opts.manifestOut != "" {
+			opts.sourcePaths = matches
+		} else {
+			opts.destPaths = matches
+		}
+		return opts, true
 	}
 
-	return args[0], args[1], true
+	if len(opts.sourcePaths) > 0 || len(opts.destPaths) > 0 {
+		if len(paths) > 0 {
+			fmt.Fprintln(stdout, "Error: Path arguments can't be combined with --source or --dest")
+			printHelp(stdout)
+			return options{}, false
+		}
+		if len(opts.sourcePaths) == 0 || len(opts.destPaths) == 0 {
+			fmt.Fprintln(stdout, "Error: --source and --dest must both be given")
+			printHelp(stdout)
+			return options{}, false
+		}
+		if opts.fromFile != "" && len(opts.destPaths) > 1 {
+			fmt.Fprintln(stdout, "Error: --from-file needs a single destination path")
+			printHelp(stdout)
+			return options{}, false
+		}
+		return opts, true
+	}
+
+	if len(paths) != 1 && len(paths) != 2 {
+		fmt.Fprintln(stdout, "Error: Expected one or two path arguments")
+		printHelp(stdout)
+		return options{}, false
+	}
+
+	// Each argument may be a glob, expanding to several trees on its side
+	for i, path := range paths {
+		matches, err := expandGlob(path)
+		if err == nil && len(paths) == 1 && len(matches) > 1 {
+			err = fmt.Errorf("%s matches %d paths, but a single tree takes one", path, len(matches))
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printHelp(stdout)
+			return options{}, false
+		}
+		if i == 0 {
+			opts.sourcePaths = matches
+		} else {
+			opts.destPaths = matches
+		}
+	}
+	if opts.fromFile != "" && len(opts.destPaths) > 1 {
+		fmt.Fprintln(stdout, "Error: --from-file needs a single destination path")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.keep.NeedsTrees() && len(opts.destPaths) == 0 {
+		fmt.Fprintf(stdout, "Error: --keep=%s needs a source and a destination path\n", opts.keep)
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.direction == dedup.DestWins && len(opts.destPaths) == 0 {
+		fmt.Fprintln(stdout, "Error: --direction=dest-wins needs a source and a destination path")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.dirLevel && len(opts.destPaths) == 0 {
+		fmt.Fprintln(stdout, "Error: --dir-level needs a source and a destination path")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.destInternal && len(opts.destPaths) == 0 {
+		fmt.Fprintln(stdout, "Error: --dedup-dest-internal needs a source and a destination path; a single path is always deduplicated within itself")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if (opts.reportUnique || opts.diff) && len(opts.destPaths) == 0 {
+		fmt.Fprintln(stdout, "Error: --report-unique and --diff need a source and a destination path")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.sizeMismatches && (opts.reportUnique || opts.diff) {
+		fmt.Fprintln(stdout, "Error: --same-name-different-size can't be combined with --report-unique or --diff")
+		printHelp(stdout)
+		return options{}, false
+	}
+	if opts.sizeMismatches && len(opts.destPaths) == 0 {
+		fmt.Fprintln(stdout, "Error: --same-name-different-size needs a source and a destination path")
+		printHelp(stdout)
+		return options{}, false
+	}
+	return opts, true
 }
 
-type fileMetadata struct {
-	size int64
-	path string // Full path to the file
+// duplicateJSON is the --format=json representation of a duplicate.
+type duplicateJSON struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash,omitempty"`
 }
 
-func (fm fileMetadata) equals(other fileMetadata) bool {
-	return fm.size == other.size
-	// Note: path is intentionally ignored in equality check
+// writeDuplicatesJSON writes duplicates to w as a JSON array.
+func writeDuplicatesJSON(w io.Writer, duplicates []dedup.Duplicate) error {
+	records := make([]duplicateJSON, 0, len(duplicates))
+	for _, dup := range duplicates {
+		records = append(records, duplicateJSON{
+			Source:      dup.Source,
+			Destination: dup.Destination,
+			Size:        dup.Size,
+			Hash:        dup.Hash,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(records); err != nil {
+		return fmt.Errorf("error writing JSON output: %w", err)
+	}
+	return nil
 }
 
-func getFiles(path string) (map[string]fileMetadata, error) {
-	fileMap := make(map[string]fileMetadata)
+// writeDuplicatesJSONL writes duplicates to w as JSON Lines, one object per
+// duplicate.
+func writeDuplicatesJSONL(w io.Writer, duplicates []dedup.Duplicate) error {
+	for _, dup := range duplicates {
+		if err := writeDuplicateJSONL(w, dup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	fileInfo, err := os.Stat(path)
+// writeDuplicateJSONL writes dup to w as one line of JSON. Each line is
+// written at once, so a reader never sees part of an object.
+func writeDuplicateJSONL(w io.Writer, dup dedup.Duplicate) error {
+	line, err := json.Marshal(duplicateJSON{
+		Source:      dup.Source,
+		Destination: dup.Destination,
+		Size:        dup.Size,
+		Hash:        dup.Hash,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error accessing path %s: %w", path, err)
+		return fmt.Errorf("error writing JSON Lines output: %w", err)
 	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing JSON Lines output: %w", err)
+	}
+	return nil
+}
 
-	if !fileInfo.IsDir() {
-		if fileInfo.Mode().IsRegular() {
-			fileName := filepath.Base(path)
-			fileMap[fileName] = fileMetadata{size: fileInfo.Size(), path: path}
+// streamsReport reports whether the duplicates found between two trees are
+// reported as they are found rather than once all are known. Only JSON Lines
+// can be streamed, and only when the pairs found are the ones replaced.
+func streamsReport(opts options) bool {
+	return opts.format == formatJSONL && len(opts.destPaths) > 0 &&
+		opts.direction != dedup.DestWins && !opts.destInternal &&
+		(opts.keep == dedup.KeepFirst || opts.keep == dedup.KeepSource)
+}
+
+// writeDuplicatesCSV writes duplicates to w as RFC 4180 CSV with a header row.
+func writeDuplicatesCSV(w io.Writer, duplicates []dedup.Duplicate) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"source", "destination", "size_bytes"}); err != nil {
+		return fmt.Errorf("error writing CSV output: %w", err)
+	}
+	for _, dup := range duplicates {
+		record := []string{dup.Source, dup.Destination, strconv.FormatInt(dup.Size, 10)}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
 		}
-		return fileMap, nil
 	}
 
-	// If it's a directory, process its contents
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, fmt.Errorf("error reading directory %s: %w", path, err)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing CSV output: %w", err)
 	}
+	return nil
+}
 
-	// Process each entry in the directory
-	for _, entry := range entries {
-		if entry.IsDir() {
-			inner, err := getFiles(filepath.Join(path, entry.Name()))
-			if err != nil {
-				fmt.Printf("Warning: Could not get files for %s: %v\n", entry.Name(), err)
-				continue
+// writeReport writes duplicates to w in a machine-readable format.
+func writeReport(w io.Writer, format outputFormat, duplicates []dedup.Duplicate) error {
+	switch format {
+	case formatJSON:
+		return writeDuplicatesJSON(w, duplicates)
+	case formatJSONL:
+		return writeDuplicatesJSONL(w, duplicates)
+	case formatCSV:
+		return writeDuplicatesCSV(w, duplicates)
+	case formatNUL:
+		return writeDuplicatesNUL(w, duplicates)
+	default:
+		return nil
+	}
+}
+
+// writeDuplicatesNUL writes the destination of each duplicate to w, each
+// followed by a NUL byte, since paths may contain newlines.
+func writeDuplicatesNUL(w io.Writer, duplicates []dedup.Duplicate) error {
+	bw := bufio.NewWriter(w)
+	for _, dup := range duplicates {
+		bw.WriteString(dup.Destination)
+		bw.WriteByte(0)
+	}
+	return bw.Flush()
+}
+
+// groupJSON is the --format=json representation of a group of duplicates.
+type groupJSON struct {
+	Hash        string   `json:"hash,omitempty"`
+	Size        int64    `json:"size"`
+	Reclaimable int64    `json:"reclaimable"`
+	Keep        []string `json:"keep"`
+	Replace     []string `json:"replace"`
+}
+
+// writeGroups writes groups of identical files to w in format. CSV rows hold
+// one path each, with its role in the group.
+func writeGroups(w io.Writer, format outputFormat, groups []dedup.DuplicateGroup) error {
+	switch format {
+	case formatJSON:
+		records := make([]groupJSON, 0, len(groups))
+		for _, group := range groups {
+			records = append(records, groupJSON{
+				Hash:        group.Hash,
+				Size:        group.Size,
+				Reclaimable: group.Reclaimable,
+				Keep:        group.Keep,
+				Replace:     group.Replace,
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("error writing JSON output: %w", err)
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"hash", "size_bytes", "role", "path"})
+		for _, group := range groups {
+			size := strconv.FormatInt(group.Size, 10)
+			for _, path := range group.Keep {
+				writer.Write([]string{group.Hash, size, "keep", path})
 			}
-			for innerFileName, innerMetadata := range inner {
-				fileMap[innerFileName] = innerMetadata
+			for _, path := range group.Replace {
+				writer.Write([]string{group.Hash, size, "replace", path})
 			}
-			continue
 		}
-		info, err := entry.Info()
-		if err != nil {
-			fmt.Printf("Warning: Could not get info for %s: %v\n", entry.Name(), err)
-			continue
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
 		}
+		return nil
+	default:
+		for _, group := range groups {
+			copies := len(group.Keep) + len(group.Replace)
+			fmt.Fprintf(w, "%d copies of %s, %s reclaimable:\n", copies, formatBytes(group.Size), formatBytes(group.Reclaimable))
+			for _, path := range group.Keep {
+				fmt.Fprintf(w, "  %s (kept)\n", path)
+			}
+			for _, path := range group.Replace {
+				fmt.Fprintf(w, "  %s\n", path)
+			}
+		}
+		return nil
+	}
+}
 
-		if info.Mode().IsRegular() {
-			fileMap[entry.Name()] = fileMetadata{size: info.Size(), path: filepath.Join(path, entry.Name())}
+// dirSavingsJSON is the --format=json representation of a directory in the
+// --top report.
+type dirSavingsJSON struct {
+	Dir         string `json:"dir"`
+	Files       int    `json:"files"`
+	Reclaimable int64  `json:"reclaimable"`
+}
+
+// writeTopDirs writes the directories with the most reclaimable bytes, at
+// most limit of them, to w in format.
+func writeTopDirs(w io.Writer, format outputFormat, dirs []dedup.DirSavings, limit int) error {
+	dirs = dirs[:min(limit, len(dirs))]
+	switch format {
+	case formatJSON:
+		records := make([]dirSavingsJSON, 0, len(dirs))
+		for _, dir := range dirs {
+			records = append(records, dirSavingsJSON{Dir: dir.Dir, Files: dir.Files, Reclaimable: dir.Reclaimable})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("error writing JSON output: %w", err)
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"dir", "files", "reclaimable_bytes"})
+		for _, dir := range dirs {
+			writer.Write([]string{dir.Dir, strconv.Itoa(dir.Files), strconv.FormatInt(dir.Reclaimable, 10)})
 		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
+		}
+		return nil
+	default:
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "Reclaimable\tFiles\tDirectory")
+		for _, dir := range dirs {
+			fmt.Fprintf(table, "%s\t%d\t%s\n", formatBytes(dir.Reclaimable), dir.Files, dir.Dir)
+		}
+		return table.Flush()
 	}
+}
 
-	return fileMap, nil
+// uniqueJSON is the --format=json representation of --report-unique.
+type uniqueJSON struct {
+	OnlySource []string `json:"only_in_source"`
+	OnlyDest   []string `json:"only_in_destination"`
 }
 
-type duplicate struct {
-	source      string
-	destination string
+// diffJSON is the --format=json representation of --diff.
+type diffJSON struct {
+	uniqueJSON
+	Modified  []string `json:"modified"`
+	Identical []string `json:"identical"`
 }
 
-func findDuplicates(sourceFiles, destFiles map[string]fileMetadata) []duplicate {
-	var duplicates []duplicate
+// writeDiff writes the relative paths found on only one side to w in format
+// and, if full is set, those found on both sides with different and with the
+// same contents. CSV rows name the category of each path.
+func writeDiff(w io.Writer, format outputFormat, diff dedup.TreeDiff, full bool) error {
+	type section struct {
+		title string
+		side  string
+		paths []string
+	}
+	sections := []section{
+		{"Only in source", "source", diff.OnlySource},
+		{"Only in destination", "destination", diff.OnlyDest},
+	}
+	if full {
+		sections = append(sections,
+			section{"Modified", "modified", diff.Modified},
+			section{"Identical", "identical", diff.Identical})
+	}
 
-	for sourceName, sourceMetadata := range sourceFiles {
-		if destMetadata, exists := destFiles[sourceName]; exists {
-			if sourceMetadata.equals(destMetadata) {
-				duplicates = append(duplicates, duplicate{
-					source:      sourceMetadata.path,
-					destination: destMetadata.path,
-				})
+	switch format {
+	case formatJSON:
+		var record any = uniqueJSON{OnlySource: diff.OnlySource, OnlyDest: diff.OnlyDest}
+		if full {
+			record = diffJSON{
+				uniqueJSON: uniqueJSON{OnlySource: diff.OnlySource, OnlyDest: diff.OnlyDest},
+				Modified:   diff.Modified,
+				Identical:  diff.Identical,
 			}
 		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("error writing JSON output: %w", err)
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"side", "path"})
+		for _, section := range sections {
+			for _, path := range section.paths {
+				writer.Write([]string{section.side, path})
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
+		}
+		return nil
+	default:
+		for _, section := range sections {
+			fmt.Fprintf(w, "%s (%d):\n", section.title, len(section.paths))
+			for _, path := range section.paths {
+				fmt.Fprintf(w, "  %s\n", path)
+			}
+		}
+		return nil
+	}
+}
+
+// sizeMismatchJSON is the --format=json representation of a file reported
+// by --same-name-different-size.
+type sizeMismatchJSON struct {
+	RelPath    string `json:"path"`
+	Source     string `json:"source"`
+	Dest       string `json:"destination"`
+	SourceSize int64  `json:"source_size"`
+	DestSize   int64  `json:"destination_size"`
+}
+
+// writeSizeMismatches writes the files paired with a source file of another
+// size to w in format.
+func writeSizeMismatches(w io.Writer, format outputFormat, mismatches []dedup.SizeMismatch) error {
+	switch format {
+	case formatJSON:
+		records := make([]sizeMismatchJSON, len(mismatches))
+		for i, m := range mismatches {
+			records[i] = sizeMismatchJSON(m)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("error writing JSON output: %w", err)
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"path", "source", "destination", "source_size", "destination_size"})
+		for _, m := range mismatches {
+			writer.Write([]string{m.RelPath, m.Source, m.Dest, strconv.FormatInt(m.SourceSize, 10), strconv.FormatInt(m.DestSize, 10)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
+		}
+		return nil
+	default:
+		fmt.Fprintf(w, "Same name, different size (%d):\n", len(mismatches))
+		for _, m := range mismatches {
+			fmt.Fprintf(w, "  %s: %s in source, %s in destination\n", m.RelPath, formatBytes(m.SourceSize), formatBytes(m.DestSize))
+		}
+		return nil
 	}
+}
 
-	return duplicates
+// formatBytes renders a byte count in binary units, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	value := float64(n)
+	if math.Abs(value) < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := -1
+	for math.Abs(value) >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[i])
 }
 
-func replaceWithSymlink(dup duplicate) error {
-	// Validate that both files exist before proceeding
-	sourceFilePath, destFilePath := dup.source, dup.destination
-	_, err := os.Stat(sourceFilePath)
+// printScanStats reports the files the scan options filtered out and the
+// directories that couldn't be read, logging each of those at debug level.
+func printScanStats(out output, opts dedup.ScanOptions, stats dedup.ScanStats) {
+	if stats.Empty > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d empty files; use --include-empty to compare them\n", stats.Empty)
+	}
+	if opts.MinSize > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d files smaller than %d bytes\n", stats.TooSmall, opts.MinSize)
+	}
+	if opts.MaxSize > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d files larger than %d bytes\n", stats.TooLarge, opts.MaxSize)
+	}
+	if len(opts.Exclude) > 0 || len(opts.ExcludeRules) > 0 || stats.Excluded > 0 {
+		patterns := "--exclude"
+		if len(opts.ExcludeRules) > 0 {
+			patterns += ", --exclude-from"
+		}
+		if opts.IgnoreFile != "" {
+			patterns += " or " + opts.IgnoreFile
+		}
+		fmt.Fprintf(out.messages, "Excluded %d entries matching %s\n", stats.Excluded, patterns)
+	}
+	if len(opts.Include) > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d files not matching --include\n", stats.NotIncluded)
+	}
+	if len(opts.Extensions) > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d files without an --ext extension\n", stats.OtherExtension)
+	}
+	if stats.BrokenSymlinks > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d broken symlinks\n", stats.BrokenSymlinks)
+	}
+	if n := stats.Special(); n > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d special files: %d named pipes, %d sockets, %d devices, %d other\n",
+			n, stats.NamedPipes, stats.Sockets, stats.Devices, stats.OtherSpecial)
+	}
+	for _, dir := range stats.Unreadable {
+		out.log.Debug("skipped unreadable directory", "path", dir.Path, "err", dir.Err)
+	}
+	// Listed in full so the scope of the scan is plain
+	for _, path := range stats.OtherFileSystem {
+		fmt.Fprintf(out.messages, "Skipped mount point %s\n", path)
+	}
+	if len(stats.OtherFileSystem) > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d directories on other filesystems\n", len(stats.OtherFileSystem))
+	}
+	if len(stats.Unreadable) > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d unreadable directories; use --log-level=debug for details\n", len(stats.Unreadable))
+	}
+}
+
+// scanBetween scans the source and destination paths, reporting what was
+// found on out.
+func scanBetween(ctx context.Context, opts options, out output) (map[string]*dedup.FileMetadata, map[string]*dedup.FileMetadata, error) {
+	for _, path := range opts.sourcePaths {
+		fmt.Fprintf(out.messages, "Source path: %s\n", path)
+	}
+	if opts.manifest != nil {
+		fmt.Fprintf(out.messages, "Source manifest: %s (%s)\n", opts.manifestIn, opts.manifest.Root)
+	}
+	for _, path := range opts.destPaths {
+		fmt.Fprintf(out.messages, "Destination path: %s\n", path)
+	}
+
+	// Each side is counted apart, so a slow one stands out
+	var sourceCounts, destCounts scanProgress
+	scanOpts := opts.scan
+	scanOpts.OnFile = sourceCounts.add
+	scanOpts.OnDestFile = destCounts.add
+	line := startProgress(opts.progress, out.errors, func() string {
+		return fmt.Sprintf("Scanned source: %s, dest: %s", sourceCounts.count(), destCounts.count())
+	})
+	done := opts.timings.start("scan")
+	var sourceFiles, destFiles map[string]*dedup.FileMetadata
+	var stats dedup.ScanStats
+	var err error
+	if opts.fromFile != "" {
+		sourceFiles, destFiles, stats, err = scanListed(ctx, opts, scanOpts)
+	} else {
+		sourceFiles, destFiles, stats, err = dedup.ScanAll(ctx, opts.sourcePaths, opts.destPaths, scanOpts)
+	}
+	done()
+	line.stop()
+	opts.timings.addScanned(&sourceCounts)
+	opts.timings.addScanned(&destCounts)
 	if err != nil {
-		return fmt.Errorf("source file %s does not exist: %w", sourceFilePath, err)
+		return nil, nil, err
+	}
+	if opts.manifest != nil {
+		sourceFiles = opts.manifest.Files()
+	} else if isFile(opts.sourcePaths) && isFile(opts.destPaths) {
+		sourceFiles = pairFiles(sourceFiles, destFiles)
 	}
 
-	_, err = os.Stat(destFilePath)
+	// Display file counts
+	fmt.Fprintf(out.messages, "Found %d files in source path\n", len(sourceFiles))
+	fmt.Fprintf(out.messages, "Found %d files in destination path\n", len(destFiles))
+	printScanStats(out, opts.scan, stats)
+	return sourceFiles, destFiles, nil
+}
+
+// findDuplicatesBetween scans the source and destination paths and pairs the
+// destination files that duplicate a source file. It also returns the number
+// of files found on the side whose files are replaced.
+func findDuplicatesBetween(ctx context.Context, opts options, out output) ([]dedup.Duplicate, int, error) {
+	sourceFiles, destFiles, err := scanBetween(ctx, opts, out)
 	if err != nil {
-		return fmt.Errorf("destination file %s does not exist: %w", destFilePath, err)
+		return nil, 0, err
 	}
 
-	err = os.Remove(destFilePath)
+	if opts.match.IgnoreCase {
+		for _, keys := range dedup.CaseCollisions(sourceFiles, opts.match.Mode) {
+			out.log.Warn("source files differ only in case; the first with matching contents is used", "paths", keys)
+		}
+	}
+
+	var found, linked atomic.Int64
+	var reportErr error
+	matchOpts := opts.match
+	matchOpts.OnDuplicate = func(dup dedup.Duplicate) {
+		found.Add(1)
+		if streamsReport(opts) && reportErr == nil {
+			reportErr = writeDuplicateJSONL(out.report, dup)
+		}
+	}
+	matchOpts.OnHardLinked = func(dup dedup.Duplicate) {
+		linked.Add(1)
+		out.log.Debug("skipped duplicate", "path", dup.Destination, "source", dup.Source, "reason", "already hard-linked")
+	}
+	line := startProgress(opts.progress, out.errors, func() string {
+		return fmt.Sprintf("Comparing files: found %d duplicates", found.Load())
+	})
+	done := opts.timings.start("hash and compare")
+	duplicates, err := dedup.FindDuplicates(ctx, sourceFiles, destFiles, matchOpts)
+	done()
+	line.stop()
 	if err != nil {
-		return fmt.Errorf("failed to remove destination file %s: %w", destFilePath, err)
+		return nil, 0, err
+	}
+	if reportErr != nil {
+		return nil, 0, reportErr
+	}
+	if n := linked.Load(); n > 0 {
+		fmt.Fprintf(out.messages, "Skipped %d files already hard-linked to their source\n", n)
+	}
+	replaced := len(destFiles)
+	if opts.direction == dedup.DestWins {
+		duplicates = dedup.Reverse(duplicates, sourceFiles)
+		replaced = len(sourceFiles)
+	} else {
+		duplicates = dedup.ChooseCanonical(duplicates, sourceFiles, destFiles, opts.keep)
+	}
+	if !opts.destInternal {
+		return duplicates, replaced, nil
 	}
 
-	err = os.Symlink(sourceFilePath, destFilePath)
+	between := len(duplicates)
+	done = opts.timings.start("compare within destination")
+	duplicates, err = dedup.FindDuplicatesWithin(ctx, destFiles, duplicates, opts.keep, out.warn)
+	done()
 	if err != nil {
-		return fmt.Errorf("failed to create symlink from %s to %s: %w", destFilePath, sourceFilePath, err)
+		return nil, 0, err
 	}
+	fmt.Fprintf(out.messages, "Found %d duplicates within the destination\n", len(duplicates)-between)
+	return duplicates, replaced, nil
+}
 
-	return nil
+// expandGlob returns the paths pattern matches if it is a glob, so patterns
+// work where no shell expands them, such as on Windows or when quoted. A
+// pattern naming an existing path is taken literally, and one matching
+// nothing is an error.
+func expandGlob(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	if _, err := os.Lstat(pattern); err == nil {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("pattern %q matches no paths", pattern)
+	}
+	return matches, nil
 }
 
-func getFilesParallel(sourcePath, destPath string) (map[string]fileMetadata, map[string]fileMetadata, error) {
-	var sourceFiles, destFiles map[string]fileMetadata
-	var sourceErr, destErr error
+// isFile reports whether paths is a single regular file rather than trees.
+func isFile(paths []string) bool {
+	if len(paths) != 1 {
+		return false
+	}
+	info, err := os.Stat(paths[0])
+	return err == nil && info.Mode().IsRegular()
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+// pairFiles keys the lone file in sourceFiles under the name of the lone
+// file in destFiles, so two files given as the source and destination are
+// compared with each other whatever their names. Scanning a file keys it by
+// its base name, which otherwise only pairs files named alike.
+func pairFiles(sourceFiles, destFiles map[string]*dedup.FileMetadata) map[string]*dedup.FileMetadata {
+	paired := make(map[string]*dedup.FileMetadata, 1)
+	for destKey := range destFiles {
+		for _, metadata := range sourceFiles {
+			// The metadata keeps its own RelPath for the trash and logs
+			paired[destKey] = metadata
+		}
+	}
+	if len(paired) == 0 {
+		return sourceFiles
+	}
+	return paired
+}
 
-	go func() {
-		defer wg.Done()
-		sourceFiles, sourceErr = getFiles(sourcePath)
-	}()
+// nestedTrees returns the first source and destination path of which one
+// contains the other, or is the same path, once both are made absolute and
+// their symlinks resolved.
+func nestedTrees(sourcePaths, destPaths []string) (source, dest string, ok bool) {
+	for _, source := range sourcePaths {
+		for _, dest := range destPaths {
+			s, d := resolvePath(source), resolvePath(dest)
+			if contains(s, d) || contains(d, s) {
+				return source, dest, true
+			}
+		}
+	}
+	return "", "", false
+}
 
-	go func() {
-		defer wg.Done()
-		destFiles, destErr = getFiles(destPath)
-	}()
+// resolvePath returns path made absolute with its symlinks resolved, or as
+// far as that succeeds.
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
 
-	wg.Wait()
+// contains reports whether path is dir or below it.
+func contains(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-	// Check for errors
-	if sourceErr != nil {
-		return nil, nil, fmt.Errorf("error processing source path: %w", sourceErr)
+// checkNestedTrees warns when a source and a destination path overlap,
+// since the files below the inner one are then scanned on both sides. With
+// --strict that is an error, and otherwise a user at a terminal is asked
+// whether to go on before --apply replaces anything. Without a terminal to
+// ask at, the run stops unless --yes was given. It returns the exit code to
+// stop with, if the run should stop.
+func checkNestedTrees(opts options, stdin io.Reader, out output) (int, bool) {
+	source, dest, nested := nestedTrees(opts.sourcePaths, opts.destPaths)
+	if !nested {
+		return exitOK, false
 	}
+	const risk = "files below the inner path are scanned on both sides, so a destination may be linked to another destination or to itself through a different path"
+	if opts.strict {
+		out.log.Error("source and destination overlap; "+risk, "source", source, "dest", dest)
+		return exitError, true
+	}
+	out.log.Warn("source and destination overlap; "+risk, "source", source, "dest", dest)
 
-	if destErr != nil {
-		return nil, nil, fmt.Errorf("error processing destination path: %w", destErr)
+	// Only a run that modifies files needs to stop; the rest just report
+	if !opts.confirmed || opts.apply.DryRun || opts.yes {
+		return exitOK, false
+	}
+	if !isTerminal(stdin) {
+		out.log.Error("refusing to replace files in overlapping trees without --yes", "source", source, "dest", dest)
+		return exitError, true
 	}
+	answer, err := newPrompter(stdin, out.errors).ask("Continue anyway? [y/N] ")
+	if err != nil {
+		out.log.Error("aborted", "err", err)
+		return exitError, true
+	}
+	if answer != "y" && answer != "yes" {
+		fmt.Fprintln(out.messages, "Nothing replaced")
+		return exitOK, true
+	}
+	return exitOK, false
+}
 
-	return sourceFiles, destFiles, nil
+// checkLargeChange asks before replacing more than --confirm-threshold files,
+// or more than --confirm-percent of the scanned files on the side replaced,
+// since that many usually means a wrong path. Without a terminal to ask at,
+// the run stops unless --yes was given. It returns the exit code to stop
+// with, if the run should stop.
+func checkLargeChange(opts options, replacing, scanned int, stdin io.Reader, out output) (int, bool) {
+	if opts.apply.DryRun || opts.yes {
+		return exitOK, false
+	}
+	overCount := opts.confirmCount > 0 && replacing > opts.confirmCount
+	overShare := opts.confirmShare > 0 && scanned > 0 && float64(replacing)*100 > float64(scanned)*opts.confirmShare
+	if !overCount && !overShare {
+		return exitOK, false
+	}
+
+	if !isTerminal(stdin) {
+		out.log.Error("refusing to replace this many files without --yes; check the paths, or raise --confirm-threshold or --confirm-percent", "replacing", replacing, "scanned", scanned)
+		return exitError, true
+	}
+	question := fmt.Sprintf("About to replace %d of %d files. Continue? [y/N] ", replacing, scanned)
+	if scanned == 0 {
+		question = fmt.Sprintf("About to replace %d files. Continue? [y/N] ", replacing)
+	}
+	answer, err := newPrompter(stdin, out.errors).ask(question)
+	if err != nil {
+		out.log.Error("aborted", "err", err)
+		return exitError, true
+	}
+	if answer != "y" && answer != "yes" {
+		fmt.Fprintln(out.messages, "Nothing replaced")
+		return exitOK, true
+	}
+	return exitOK, false
 }
 
-func replaceConcurrently(duplicates []duplicate) {
-	var wg sync.WaitGroup
-	wg.Add(len(duplicates))
+// scanTree scans the single path in opts.sourcePaths, reporting what was
+// found on out.
+func scanTree(ctx context.Context, opts options, out output) (map[string]*dedup.FileMetadata, error) {
+	root := opts.sourcePaths[0]
+	fmt.Fprintf(out.messages, "Path: %s\n", root)
 
-	for _, dup := range duplicates {
-		go func(dup duplicate) {
-			defer wg.Done()
-			err := replaceWithSymlink(dup)
+	var counts scanProgress
+	scanOpts := opts.scan
+	scanOpts.OnFile = counts.add
+	line := startProgress(opts.progress, out.errors, counts.String)
+	done := opts.timings.start("scan")
+	var files map[string]*dedup.FileMetadata
+	var stats dedup.ScanStats
+	var err error
+	if opts.fromFile != "" {
+		files, stats, err = dedup.ScanList(ctx, root, opts.listedPaths, scanOpts)
+	} else {
+		files, stats, err = dedup.Scan(ctx, root, scanOpts)
+	}
+	done()
+	line.stop()
+	opts.timings.addScanned(&counts)
+	if err != nil {
+		return nil, fmt.Errorf("error processing path: %w", err)
+	}
+
+	fmt.Fprintf(out.messages, "Found %d files\n", len(files))
+	printScanStats(out, opts.scan, stats)
+	return files, nil
+}
+
+// findDuplicatesInTree scans a single path and links every copy of a file to
+// the canonical copy chosen by opts.keep. It also returns the number of files
+// found.
+func findDuplicatesInTree(ctx context.Context, opts options, out output) ([]dedup.Duplicate, int, error) {
+	files, err := scanTree(ctx, opts, out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	done := opts.timings.start("hash and compare")
+	groups, err := dedup.GroupIdentical(ctx, files, out.warn)
+	done()
+	if err != nil {
+		return nil, 0, err
+	}
+	fmt.Fprintf(out.messages, "Found %d groups of identical files\n", len(groups))
+
+	return dedup.LinkToCanonical(groups, opts.keep), len(files), nil
+}
+
+// applyDuplicates replaces duplicates as configured in opts, reporting each
+// outcome on out, recording every replacement in log and every replacement
+// planned under a dry run in plan, if those are given. Failures to write the
+// log count as errors in the summary.
+func applyDuplicates(ctx context.Context, duplicates []dedup.Duplicate, opts options, log *dedup.ActionLog, plan *dedup.Plan, out output) dedup.Summary {
+	var mu sync.Mutex
+	var logErrs []error
+
+	var processed atomic.Int64
+	verb := "Replaced"
+	if opts.apply.DryRun {
+		verb = "Checked"
+	}
+	line := startProgress(opts.progress, out.errors, func() string {
+		return fmt.Sprintf("%s %d/%d duplicates", verb, processed.Load(), len(duplicates))
+	})
+	defer line.stop()
+
+	applyOpts := opts.apply
+	applyOpts.OnResult = func(result dedup.Result) {
+		defer processed.Add(1)
+		printResult(out, opts.apply.Link, result)
+		if result.Outcome == dedup.Planned && plan != nil {
+			if err := plan.Add(result.Duplicate); err != nil {
+				out.warn(err)
+			}
+		}
+		if result.Outcome != dedup.Replaced || log == nil {
+			return
+		}
+		if err := log.Record(result.Replacement); err != nil {
+			out.log.Error("could not record replacement", "path", result.Duplicate.Destination, "err", err)
+			mu.Lock()
+			logErrs = append(logErrs, err)
+			mu.Unlock()
+		}
+	}
+
+	done := opts.timings.start("replace")
+	summary := dedup.Apply(ctx, duplicates, applyOpts)
+	done()
+	summary.Errs = append(summary.Errs, logErrs...)
+	return summary
+}
+
+// replaceDirs replaces the destination directories that duplicates cover
+// completely by symlinks to their sources, and returns the duplicates left
+// to replace file by file, in their original order, along with the bytes
+// reclaimed. The files of a directory that can't be replaced are left to be
+// replaced one by one.
+func replaceDirs(ctx context.Context, duplicates []dedup.Duplicate, opts options, out output) ([]dedup.Duplicate, int64) {
+	dirs, _ := dedup.FindDuplicateDirs(duplicates, out.warn)
+	fmt.Fprintf(out.messages, "Found %d duplicated directories\n", len(dirs))
+
+	done := opts.timings.start("replace directories")
+	defer done()
+	replaced := make(map[string]bool) // Destinations of the files replaced with their directory
+	var reclaimed int64
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := dedup.ReplaceDir(dir, opts.apply)
+		if err != nil && r.Link == "" {
+			out.log.Warn("replacing files one by one", "path", dir.Destination, "err", err)
+			continue
+		}
+		if opts.apply.DryRun {
+			fmt.Fprintf(out.results, "Would replace directory %s with symlink to %s (%d files, %d bytes)\n", dir.Destination, dir.Source, len(dir.Files), dir.Size())
+			out.log.Debug("would replace directory", "path", dir.Destination, "source", dir.Source, "files", len(dir.Files), "size", dir.Size())
+		} else {
+			fmt.Fprintf(out.results, "Replaced directory %s with symlink to %s (%d files)\n", dir.Destination, dir.Source, len(dir.Files))
+			out.log.Info("replaced directory", "path", dir.Destination, "source", dir.Source, "files", len(dir.Files), "reclaimed", r.Reclaimed())
 			if err != nil {
-				fmt.Printf("Error replacing with symlink: %v\n", err)
-			} else {
-				fmt.Printf("Replaced %s with symlink to %s\n", dup.destination, dup.source)
+				out.warn(err)
 			}
-		}(dup)
+		}
+		for _, dup := range dir.Files {
+			replaced[dup.Destination] = true
+		}
+		reclaimed += r.Reclaimed()
 	}
 
-	wg.Wait()
+	rest := make([]dedup.Duplicate, 0, len(duplicates)-len(replaced))
+	for _, dup := range duplicates {
+		if !replaced[dup.Destination] {
+			rest = append(rest, dup)
+		}
+	}
+	return rest, reclaimed
+}
+
+// pruneEmptyDirs removes the directories left empty by replacing
+// duplicates, inside the trees given on the command line.
+func pruneEmptyDirs(duplicates []dedup.Duplicate, opts options, out output) {
+	paths := make([]string, len(duplicates))
+	for i, dup := range duplicates {
+		paths[i] = dup.Destination
+	}
+	roots := append(slices.Clone(opts.sourcePaths), opts.destPaths...)
+	removed := dedup.PruneEmptyDirs(roots, paths, out.warn)
+	for _, dir := range removed {
+		out.log.Info("removed empty directory", "path", dir)
+	}
+	fmt.Fprintf(out.messages, "Removed %d empty directories\n", len(removed))
+}
+
+// printResult reports the outcome of a single duplicate.
+func printResult(out output, link dedup.LinkType, result dedup.Result) {
+	dup := result.Duplicate
+	switch result.Outcome {
+	case dedup.Replaced:
+		if result.Replacement.Link != link {
+			out.log.Warn("symlinks not permitted, created a hard link instead", "path", dup.Destination, "source", dup.Source)
+			link = result.Replacement.Link
+		}
+		if link == dedup.LinkDelete {
+			fmt.Fprintf(out.results, "Deleted %s, a duplicate of %s\n", dup.Destination, dup.Source)
+		} else {
+			fmt.Fprintf(out.results, "Replaced %s with %s to %s\n", dup.Destination, link, dup.Source)
+		}
+		out.log.Info("replaced duplicate", "path", dup.Destination, "source", dup.Source, "link", link, "reclaimed", result.Replacement.Reclaimed())
+		if result.Err != nil {
+			out.warn(result.Err)
+		}
+	case dedup.Planned:
+		if link == dedup.LinkDelete {
+			fmt.Fprintf(out.results, "Would delete %s, a duplicate of %s (%d bytes)\n", dup.Destination, dup.Source, dup.Size)
+		} else {
+			fmt.Fprintf(out.results, "Would replace %s with %s to %s (%d bytes)\n", dup.Destination, link, dup.Source, dup.Size)
+		}
+		out.log.Debug("would replace duplicate", "path", dup.Destination, "source", dup.Source, "link", link, "size", dup.Size)
+	case dedup.SkippedDifferent:
+		fmt.Fprintf(out.messages, "Skipping %s: contents differ from %s\n", dup.Destination, dup.Source)
+		out.log.Debug("skipped duplicate", "path", dup.Destination, "source", dup.Source, "reason", "contents differ")
+	case dedup.SkippedLinked:
+		fmt.Fprintf(out.messages, "Skipping %s: already linked to %s\n", dup.Destination, dup.Source)
+		out.log.Debug("skipped duplicate", "path", dup.Destination, "source", dup.Source, "reason", "already linked")
+	case dedup.SkippedChanged:
+		fmt.Fprintf(out.messages, "Skipping %s: changed during run\n", dup.Destination)
+		out.log.Warn("changed during run, skipped", "path", dup.Destination, "source", dup.Source, "err", result.Err)
+	case dedup.Failed:
+		out.log.Error("could not replace duplicate", "path", dup.Destination, "source", dup.Source, "err", result.Err)
+	}
 }
 
 func main() {
-	sourcePath, destPath, valid := validateArgs()
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run is the whole command, reading answers to --interactive prompts from
+// stdin and printing to stdout and stderr. It returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, valid := validateArgs(args, stdout, stderr)
 	if !valid {
-		os.Exit(1)
+		return exitUsage
+	}
+	if opts.help {
+		printHelp(stdout)
+		return exitOK
+	}
+	if opts.version {
+		fmt.Fprintln(stdout, versionString())
+		return exitOK
+	}
+	// Stop cleanly on Ctrl-C, keeping any links created so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	out := output{report: stdout, errors: stderr, log: newLogger(stderr, opts.logFormat, opts.logLevel)}
+	if opts.output != "" {
+		file, err := os.Create(opts.output)
+		if err != nil {
+			out.log.Error("could not create output file", "path", opts.output, "err", err)
+			return exitError
+		}
+		defer file.Close()
+		out.report = file
+	}
+
+	// Machine-readable formats own the report, so progress moves to stderr
+	out.messages = out.report
+	if opts.format != formatText {
+		out.messages = out.errors
+	}
+	if opts.quiet {
+		out.messages = io.Discard
+		// A machine-readable report, or one written to a file, was asked for
+		if opts.format == formatText && opts.output == "" {
+			out.report = io.Discard
+		}
+	}
+	// In text, the line printed for each duplicate is the report
+	out.results = out.messages
+	if opts.format == formatText {
+		out.results = out.report
+	}
+	opts.scan.Warn = out.warn
+	opts.match.Warn = out.warn
+	if opts.stats {
+		opts.timings = &phaseTimings{}
+	}
+
+	if opts.fromFile != "" {
+		paths, err := loadPathList(opts.fromFile, opts.null, stdin)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		opts.listedPaths = paths
+	}
+
+	if opts.manifestOut != "" {
+		if err := writeManifest(ctx, opts, out); err != nil {
+			return aborted(ctx, out, err)
+		}
+		return exitOK
+	}
+	if opts.manifestIn != "" {
+		manifest, err := loadManifest(ctx, opts.manifestIn, opts.timeout)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		if opts.scan.Hash != "" && opts.scan.Hash != manifest.Algorithm {
+			out.warn(fmt.Errorf("manifest %s records %s hashes, so --hash=%s is ignored", opts.manifestIn, manifest.Algorithm, opts.scan.Hash))
+		}
+		opts.scan.Hash = manifest.Algorithm
+		opts.manifest = manifest
+		if code, stop := checkRemoteManifest(opts, manifest, out); stop {
+			return code
+		}
+	}
+
+	if opts.implicitDryRun {
+		fmt.Fprintln(out.messages, "Dry run by default; pass --apply to make changes.")
+	}
+
+	if opts.undoPath != "" {
+		restored, errs := undoLog(opts.undoPath, opts.apply.DryRun, out)
+		if opts.apply.DryRun {
+			fmt.Fprintf(out.messages, "Would restore %d files\n", restored)
+		} else {
+			fmt.Fprintf(out.messages, "Restored %d files\n", restored)
+		}
+		if len(errs) > 0 {
+			fmt.Fprintf(out.errors, "Failed to restore %d files\n", len(errs))
+			return exitFailed
+		}
+		return exitOK
+	}
+
+	if opts.planApply != "" {
+		return applyPlan(ctx, opts, stdin, out)
+	}
+
+	if opts.verifyLinks {
+		problems, err := verifyLinks(ctx, opts, out)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		if problems > 0 {
+			return exitFailed
+		}
+		return exitOK
+	}
+
+	if opts.materialize {
+		materialized, errs, err := materializeLinks(ctx, opts, out)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		if opts.apply.DryRun {
+			fmt.Fprintf(out.messages, "Would materialize %d symlinks\n", materialized)
+		} else {
+			fmt.Fprintf(out.messages, "Materialized %d symlinks\n", materialized)
+		}
+		if len(errs) > 0 {
+			fmt.Fprintf(out.errors, "Failed to materialize %d symlinks\n", len(errs))
+		}
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		if len(errs) > 0 {
+			return exitFailed
+		}
+		return exitOK
+	}
+
+	if !opts.reportUnique && !opts.diff && !opts.sizeMismatches {
+		if code, stop := checkNestedTrees(opts, stdin, out); stop {
+			return code
+		}
 	}
 
-	fmt.Printf("Source path: %s\n", sourcePath)
-	fmt.Printf("Destination path: %s\n", destPath)
+	var log *dedup.ActionLog
+	if opts.logPath != "" && !opts.apply.DryRun {
+		var err error
+		log, err = dedup.OpenActionLog(opts.logPath)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		defer log.Close()
+	}
+
+	if opts.reportUnique || opts.diff {
+		sourceFiles, destFiles, err := scanBetween(ctx, opts, out)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		var diff dedup.TreeDiff
+		if opts.diff {
+			done := opts.timings.start("hash and compare")
+			diff, err = dedup.DiffTrees(ctx, sourceFiles, destFiles, opts.match)
+			done()
+			if err != nil {
+				return aborted(ctx, out, err)
+			}
+		} else {
+			diff.OnlySource, diff.OnlyDest = dedup.UniqueFiles(sourceFiles, destFiles)
+		}
+		if err := writeDiff(out.report, opts.format, diff, opts.diff); err != nil {
+			return aborted(ctx, out, err)
+		}
+		opts.timings.print(out.messages)
+		return exitOK
+	}
 
-	sourceFiles, destFiles, err := getFilesParallel(sourcePath, destPath)
+	if opts.sizeMismatches {
+		sourceFiles, destFiles, err := scanBetween(ctx, opts, out)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		mismatches := dedup.SizeMismatches(sourceFiles, destFiles, opts.match)
+		if err := writeSizeMismatches(out.report, opts.format, mismatches); err != nil {
+			return aborted(ctx, out, err)
+		}
+		opts.timings.print(out.messages)
+		return exitOK
+	}
+
+	if opts.cachePath != "" {
+		cache, err := dedup.LoadHashCache(opts.cachePath)
+		if err != nil {
+			out.warn(fmt.Errorf("%w; starting with an empty cache", err))
+			cache = dedup.NewHashCache(opts.cachePath)
+		}
+		opts.scan.Cache = cache
+	}
+
+	var duplicates []dedup.Duplicate
+	var scanned int
+	var err error
+	if len(opts.destPaths) == 0 {
+		duplicates, scanned, err = findDuplicatesInTree(ctx, opts, out)
+	} else {
+		duplicates, scanned, err = findDuplicatesBetween(ctx, opts, out)
+	}
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		os.Exit(1)
+		return aborted(ctx, out, err)
 	}
 
-	// Display file counts
-	fmt.Printf("Found %d files in source path\n", len(sourceFiles))
-	fmt.Printf("Found %d files in destination path\n", len(destFiles))
+	fmt.Fprintf(out.messages, "Found %d duplicates\n", len(duplicates))
+	if opts.scan.PrefixHash > 0 {
+		fmt.Fprintf(out.messages, "Approximate: only the first %d bytes of each file were compared; review them, or --verify before replacing\n", opts.scan.PrefixHash)
+	}
+	opts.timings.addDuplicates(duplicates, opts.statsBuckets)
 
-	var duplicates = findDuplicates(sourceFiles, destFiles)
-	fmt.Printf("Found %d duplicates\n", len(duplicates))
+	if cache := opts.scan.Cache; cache != nil {
+		hits, misses := cache.Stats()
+		fmt.Fprintf(out.messages, "Reused %d cached hashes, computed %d\n", hits, misses)
+		if err := cache.Save(); err != nil {
+			out.warn(err)
+		}
+	}
 
-	replaceConcurrently(duplicates)
+	if opts.top > 0 {
+		err = writeTopDirs(out.report, opts.format, dedup.SavingsByDir(duplicates), opts.top)
+	} else if opts.group {
+		err = writeGroups(out.report, opts.format, dedup.GroupDuplicates(duplicates))
+	} else if !streamsReport(opts) {
+		err = writeReport(out.report, opts.format, duplicates)
+	}
+	if err != nil {
+		return aborted(ctx, out, err)
+	}
+
+	if opts.scan.InspectArchives {
+		if opts.format == formatText && opts.top == 0 && !opts.group {
+			for _, dup := range duplicates {
+				fmt.Fprintf(out.report, "%s duplicates %s (%d bytes)\n", dup.Destination, dup.Source, dup.Size)
+			}
+		}
+		opts.timings.print(out.messages)
+		return exitOK
+	}
+
+	if opts.interactive {
+		duplicates, err = confirmDuplicates(newPrompter(stdin, out.messages), duplicates)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+	} else if code, stop := checkLargeChange(opts, len(duplicates), scanned, stdin, out); stop {
+		return code
+	}
+
+	var dirsReclaimed int64
+	if opts.dirLevel {
+		duplicates, dirsReclaimed = replaceDirs(ctx, duplicates, opts, out)
+	}
+	var plan *dedup.Plan
+	if opts.planOut != "" {
+		plan = dedup.NewPlan(opts.apply)
+	}
+	summary := applyDuplicates(ctx, duplicates, opts, log, plan, out)
+	summary.Reclaimed += dirsReclaimed
+	if plan != nil {
+		if err := writePlan(opts.planOut, plan, out); err != nil {
+			return aborted(ctx, out, err)
+		}
+	}
+	if opts.pruneEmptyDirs && !opts.apply.DryRun {
+		pruneEmptyDirs(duplicates, opts, out)
+	}
+	return finishApply(ctx, opts, out, summary, len(duplicates))
+}
+
+// finishApply reports the summary of replacing total duplicates and returns
+// the exit code for it.
+func finishApply(ctx context.Context, opts options, out output, summary dedup.Summary, total int) int {
+	if opts.apply.DryRun {
+		fmt.Fprintf(out.messages, "Would reclaim %d bytes (%s)\n", summary.Reclaimed, formatBytes(summary.Reclaimed))
+	} else {
+		fmt.Fprintf(out.messages, "Reclaimed %d bytes (%s)\n", summary.Reclaimed, formatBytes(summary.Reclaimed))
+	}
+	opts.timings.print(out.messages)
+	failed := summary.Err() != nil
+	if failed {
+		fmt.Fprintf(out.errors, "Failed to replace %d of %d duplicates\n", len(summary.Errs), total)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(out.errors, "Cancelled after %d of %d replacements\n", summary.Replaced, total)
+		return exitCancelled
+	}
+	if failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// aborted logs the error that stopped the run and returns the exit code for
+// it, telling an interrupt apart from a failure.
+func aborted(ctx context.Context, out output, err error) int {
+	out.log.Error("aborted", "err", err)
+	if ctx.Err() != nil {
+		return exitCancelled
+	}
+	return exitError
 }
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// writeTree creates files under root, keyed by slash-separated path relative
+// to root, with the given contents.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for relPath, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTrees creates a source and a destination tree in a temporary
+// directory holding sourceFiles and destFiles, as writeTree does, and returns
+// their paths.
+func newTrees(t *testing.T, sourceFiles, destFiles map[string]string) (source, dest string) {
+	t.Helper()
+	dir := t.TempDir()
+	source, dest = filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeTree(t, source, sourceFiles)
+	writeTree(t, dest, destFiles)
+	return source, dest
+}
+
+// runCommand runs the command with args and stdin, returning its exit code
+// and what it printed to stdout and stderr.
+func runCommand(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// isSymlink reports whether path is a symlink.
+func isSymlink(t *testing.T, path string) bool {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// sameFile reports whether the paths are the same file, as hard links are.
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	aInfo, err := os.Lstat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Lstat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   func(source, dest string) []string
+		code   int
+		stdout []string // Text stdout must contain
+		linked bool     // Whether dest/a.txt must be a symlink afterwards
+	}{
+		{
+			name:   "help",
+			args:   func(source, dest string) []string { return []string{"--help"} },
+			code:   exitOK,
+			stdout: []string{"Usage:"},
+		},
+		{
+			name:   "usage error",
+			args:   func(source, dest string) []string { return []string{"--jobs", "0", source, dest} },
+			code:   exitUsage,
+			stdout: []string{"Error: --jobs"},
+		},
+		{
+			name:   "dry run",
+			args:   func(source, dest string) []string { return []string{source, dest} },
+			code:   exitOK,
+			stdout: []string{"Would replace ", filepath.Join("dest", "a.txt") + " with symlink", "Would reclaim"},
+		},
+		{
+			name:   "apply",
+			args:   func(source, dest string) []string { return []string{"--apply", source, dest} },
+			code:   exitOK,
+			stdout: []string{"Replaced ", filepath.Join("dest", "a.txt") + " with symlink", "Reclaimed"},
+			linked: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, dest := newTrees(t,
+				map[string]string{"a.txt": "duplicate", "b.txt": "original"},
+				map[string]string{"a.txt": "duplicate", "b.txt": "changed"})
+
+			code, stdout, stderr := runCommand(t, "", test.args(source, dest)...)
+			if code != test.code {
+				t.Errorf("exit code = %d, want %d; stderr:\n%s", code, test.code, stderr)
+			}
+			for _, want := range test.stdout {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("stdout doesn't contain %q:\n%s", want, stdout)
+				}
+			}
+			if linked := isSymlink(t, filepath.Join(dest, "a.txt")); linked != test.linked {
+				t.Errorf("dest/a.txt is a symlink = %v, want %v", linked, test.linked)
+			}
+			if isSymlink(t, filepath.Join(dest, "b.txt")) {
+				t.Error("dest/b.txt, which differs from its source, was replaced")
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"4k", 4 << 10},
+		{"4KB", 4 << 10},
+		{"4KiB", 4 << 10},
+		{"1M", 1 << 20},
+		{"2g", 2 << 30},
+		{"1T", 1 << 40},
+	}
+	for _, test := range tests {
+		if got, err := parseSize(test.value); err != nil || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "k", "-1", "1.5M", "1X", "9999999999T"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("parseSize(%q) succeeded", value)
+		}
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"a.txt": "duplicate", "b.txt": "original"},
+		map[string]string{"a.txt": "duplicate", "b.txt": "changed!"})
+
+	code, stdout, stderr := runCommand(t, "", "--format", "json", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	var records []duplicateJSON
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("stdout isn't a JSON array: %v\n%s", err, stdout)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1: %+v", len(records), records)
+	}
+	want := duplicateJSON{
+		Source:      filepath.Join(source, "a.txt"),
+		Destination: filepath.Join(dest, "a.txt"),
+		Size:        int64(len("duplicate")),
+	}
+	got := records[0]
+	if got.Hash == "" {
+		t.Error("hash is empty")
+	}
+	got.Hash = ""
+	if got != want {
+		t.Errorf("record = %+v, want %+v", got, want)
+	}
+}
+
+func TestJSONLReport(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "b.txt": "bb", "sub/c.txt": "ccc"}
+	source, dest := newTrees(t, files, files)
+
+	code, stdout, stderr := runCommand(t, "", "--format", "jsonl", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if !strings.HasSuffix(stdout, "\n") {
+		t.Errorf("the last line isn't terminated:\n%s", stdout)
+	}
+	// Every line decodes on its own; the order is the order found in
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != len(files) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(files), stdout)
+	}
+	for _, line := range lines {
+		var record duplicateJSON
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line isn't a JSON object: %v\n%s", err, line)
+		}
+		relPath, err := filepath.Rel(dest, record.Destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, ok := files[filepath.ToSlash(relPath)]
+		if !ok {
+			t.Errorf("unexpected destination %s", record.Destination)
+			continue
+		}
+		delete(files, filepath.ToSlash(relPath))
+		if want := filepath.Join(source, relPath); record.Source != want {
+			t.Errorf("source = %s, want %s", record.Source, want)
+		}
+		if record.Size != int64(len(contents)) || record.Hash == "" {
+			t.Errorf("record = %+v, want size %d and a hash", record, len(contents))
+		}
+	}
+
+	if code, _, _ := runCommand(t, "", "--format", "jsonl", "--group", source, dest); code != exitUsage {
+		t.Errorf("--format=jsonl with --group: exit code = %d, want %d", code, exitUsage)
+	}
+}
+
+func TestCSVReport(t *testing.T) {
+	duplicates := []dedup.Duplicate{
+		{Source: "src/a.txt", Destination: "dst/a.txt", Size: 1},
+		{Source: "src/b, c.txt", Destination: "dst/b, c.txt", Size: 22},
+		{Source: `src/"quoted".txt`, Destination: `dst/"quoted".txt`, Size: 333},
+	}
+	var buf bytes.Buffer
+	if err := writeDuplicatesCSV(&buf, duplicates); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("output isn't valid CSV: %v", err)
+	}
+	if len(rows) != len(duplicates)+1 {
+		t.Fatalf("got %d rows, want a header and %d duplicates", len(rows), len(duplicates))
+	}
+	if header := strings.Join(rows[0], ","); header != "source,destination,size_bytes" {
+		t.Errorf("header = %q", header)
+	}
+	for i, dup := range duplicates {
+		want := []string{dup.Source, dup.Destination, strconv.FormatInt(dup.Size, 10)}
+		if got := rows[i+1]; !slices.Equal(got, want) {
+			t.Errorf("row %d = %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestSameDirectoryTwice(t *testing.T) {
+	for _, direction := range []string{"source-wins", "dest-wins"} {
+		t.Run(direction, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+
+			code, stdout, stderr := runCommand(t, "", "--apply", "--yes", "--direction", direction, dir, dir)
+			if code != exitOK {
+				t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+			}
+			if !strings.Contains(stdout, "Found 0 duplicates") {
+				t.Errorf("stdout doesn't report 0 duplicates:\n%s", stdout)
+			}
+			for _, relPath := range []string{"a.txt", "b/c.txt"} {
+				path := filepath.Join(dir, filepath.FromSlash(relPath))
+				if isSymlink(t, path) {
+					t.Errorf("%s was replaced by a symlink to itself", relPath)
+				}
+			}
+		})
+	}
+}
+
+func TestRunPrintsToGivenWriters(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "same"}, map[string]string{"a.txt": "same"})
+
+	code, stdout, stderr := runCommand(t, "", "--apply", source, dest)
+	if code != exitOK || stderr != "" {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Found 1 duplicates") || !strings.Contains(stdout, "Replaced ") {
+		t.Errorf("stdout doesn't report the replacement:\n%s", stdout)
+	}
+
+	code, stdout, stderr = runCommand(t, "", filepath.Join(source, "missing"), dest)
+	if code == exitOK || strings.Contains(stdout, "error") || !strings.Contains(stderr, "error") {
+		t.Errorf("failing run exited %d, printed %q to stdout and %q to stderr, want the error on stderr", code, stdout, stderr)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{-2048, "-2.0 KiB"},
+	}
+	for _, test := range tests {
+		if got := formatBytes(test.n); got != test.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestMaxDepthFlag(t *testing.T) {
+	for depth, want := range map[string]int{"0": 1, "1": 2, "5": 6} {
+		opts, valid := validateArgs([]string{"--max-depth", depth, "a", "b"}, io.Discard, io.Discard)
+		if !valid || opts.scan.MaxDepth != want {
+			t.Errorf("--max-depth %s gave MaxDepth %d, valid %v, want %d", depth, opts.scan.MaxDepth, valid, want)
+		}
+	}
+	if opts, _ := validateArgs([]string{"a", "b"}, io.Discard, io.Discard); opts.scan.MaxDepth != 0 {
+		t.Errorf("default MaxDepth = %d, want 0, which is unlimited", opts.scan.MaxDepth)
+	}
+	if _, valid := validateArgs([]string{"--max-depth", "-1", "a", "b"}, io.Discard, io.Discard); valid {
+		t.Error("--max-depth -1 was accepted")
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args func(source, dest string) []string
+		code int
+	}{
+		{"success", func(source, dest string) []string { return []string{"--apply", source, dest} }, exitOK},
+		{"nothing to do", func(source, dest string) []string { return []string{source, source} }, exitOK},
+		{"usage error", func(source, dest string) []string { return []string{"--no-such-flag", source, dest} }, exitUsage},
+		{"scan error", func(source, dest string) []string { return []string{filepath.Join(source, "missing"), dest} }, exitError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, dest := newTrees(t, map[string]string{"a.txt": "a"}, map[string]string{"a.txt": "a"})
+			if code, _, stderr := runCommand(t, "", test.args(source, dest)...); code != test.code {
+				t.Errorf("exit code = %d, want %d; stderr:\n%s", code, test.code, stderr)
+			}
+		})
+	}
+}
+
+func TestFinishApplyExitCodes(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	failure := errors.New("replacement failed")
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		summary dedup.Summary
+		code    int
+	}{
+		{"replaced", context.Background(), dedup.Summary{Replaced: 2}, exitOK},
+		{"failed", context.Background(), dedup.Summary{Replaced: 1, Errs: []error{failure}}, exitFailed},
+		{"cancelled", cancelled, dedup.Summary{Replaced: 1}, exitCancelled},
+		{"cancelled after a failure", cancelled, dedup.Summary{Errs: []error{failure}}, exitCancelled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := output{messages: io.Discard, errors: io.Discard}
+			if code := finishApply(test.ctx, options{}, out, test.summary, 2); code != test.code {
+				t.Errorf("exit code = %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestDirection(t *testing.T) {
+	for _, direction := range []string{"source-wins", "dest-wins"} {
+		t.Run(direction, func(t *testing.T) {
+			source, dest := newTrees(t, map[string]string{"a.txt": "duplicate"}, map[string]string{"a.txt": "duplicate"})
+			kept, replaced := filepath.Join(source, "a.txt"), filepath.Join(dest, "a.txt")
+			if direction == "dest-wins" {
+				kept, replaced = replaced, kept
+			}
+
+			args := []string{"--apply", "--direction", direction, source, dest}
+			if code, _, stderr := runCommand(t, "", args...); code != exitOK {
+				t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+			}
+			if isSymlink(t, kept) {
+				t.Errorf("%s, which should be kept, was replaced", kept)
+			}
+			if target, err := os.Readlink(replaced); err != nil {
+				t.Errorf("%s wasn't replaced by a symlink: %v", replaced, err)
+			} else if target != kept {
+				t.Errorf("%s links to %s, want %s", replaced, target, kept)
+			}
+
+			// The replaced side is now a symlink, so a second run finds nothing
+			code, stdout, stderr := runCommand(t, "", args...)
+			if code != exitOK || !strings.Contains(stdout, "Found 0 duplicates") {
+				t.Errorf("second run exited %d and didn't report 0 duplicates:\n%s%s", code, stdout, stderr)
+			}
+		})
+	}
+}
+
+func TestFileAndDirectoryArguments(t *testing.T) {
+	tests := []struct {
+		name         string
+		source, dest string   // Relative to the test's directory
+		linked       []string // Paths that must be replaced
+		kept         []string // Paths that must not be
+	}{
+		{"file and file", "source/a.txt", "dest/renamed.txt", []string{"dest/renamed.txt"}, []string{"dest/a.txt", "dest/sub/a.txt"}},
+		{"file and directory", "source/a.txt", "dest", []string{"dest/a.txt"}, []string{"dest/renamed.txt", "dest/sub/a.txt"}},
+		{"directory and file", "source", "dest/a.txt", []string{"dest/a.txt"}, []string{"dest/renamed.txt", "dest/sub/a.txt"}},
+		{"directory and directory", "source", "dest", []string{"dest/a.txt", "dest/sub/a.txt"}, []string{"dest/renamed.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, map[string]string{
+				"source/a.txt":     "duplicate",
+				"source/sub/a.txt": "duplicate",
+				"dest/a.txt":       "duplicate",
+				"dest/renamed.txt": "duplicate",
+				"dest/sub/a.txt":   "duplicate",
+			})
+			path := func(relPath string) string { return filepath.Join(dir, filepath.FromSlash(relPath)) }
+
+			code, stdout, stderr := runCommand(t, "", "--apply", path(test.source), path(test.dest))
+			if code != exitOK {
+				t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+			}
+			for _, relPath := range test.linked {
+				if !isSymlink(t, path(relPath)) {
+					t.Errorf("%s wasn't replaced:\n%s", relPath, stdout)
+				}
+			}
+			for _, relPath := range test.kept {
+				if isSymlink(t, path(relPath)) {
+					t.Errorf("%s was replaced:\n%s", relPath, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	empties := map[string]string{"a.txt": "", "b.log": "", "sub/c": ""}
+	for _, includeEmpty := range []bool{false, true} {
+		t.Run("include empty "+strconv.FormatBool(includeEmpty), func(t *testing.T) {
+			source, dest := newTrees(t, empties, map[string]string{"x.txt": "", "y": "", "sub/z.log": ""})
+			args := []string{"--apply", "--match", "content", source, dest}
+			if includeEmpty {
+				args = append([]string{"--include-empty"}, args...)
+			}
+
+			code, stdout, stderr := runCommand(t, "", args...)
+			if code != exitOK {
+				t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+			}
+			if skipped := strings.Contains(stdout, "Skipped 6 empty files"); skipped == includeEmpty {
+				t.Errorf("reported skipping the empty files = %v, want %v:\n%s", skipped, !includeEmpty, stdout)
+			}
+			for _, relPath := range []string{"x.txt", "y", "sub/z.log"} {
+				if linked := isSymlink(t, filepath.Join(dest, filepath.FromSlash(relPath))); linked != includeEmpty {
+					t.Errorf("%s is a symlink = %v, want %v", relPath, linked, includeEmpty)
+				}
+			}
+		})
+	}
+}
+
+func TestTopDirs(t *testing.T) {
+	files := map[string]string{"photos/a.jpg": "aaaa", "photos/b.jpg": "bbbb", "docs/a.txt": "a", "misc/a": "aa"}
+	source, dest := newTrees(t, files, files)
+
+	code, stdout, stderr := runCommand(t, "", "--top", "2", "--format", "json", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	var records []dirSavingsJSON
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("stdout isn't a JSON array: %v\n%s", err, stdout)
+	}
+	want := []dirSavingsJSON{
+		{Dir: filepath.Join(dest, "photos"), Files: 2, Reclaimable: 8},
+		{Dir: filepath.Join(dest, "misc"), Files: 1, Reclaimable: 2},
+	}
+	if !slices.Equal(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+}
+
+func TestPrint0(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "with space.txt": "b"}
+	if runtime.GOOS != "windows" {
+		files["new\nline.txt"] = "c"
+	}
+	source, dest := newTrees(t, files, files)
+
+	code, stdout, stderr := runCommand(t, "", "--print0", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if !strings.HasSuffix(stdout, "\x00") {
+		t.Fatalf("output doesn't end in NUL: %q", stdout)
+	}
+	got := strings.Split(strings.TrimSuffix(stdout, "\x00"), "\x00")
+	slices.Sort(got)
+	var want []string
+	for relPath := range files {
+		want = append(want, filepath.Join(dest, relPath))
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("paths = %q, want %q", got, want)
+	}
+	for relPath := range files {
+		if isSymlink(t, filepath.Join(dest, relPath)) {
+			t.Errorf("%q was replaced without --apply", relPath)
+		}
+	}
+}
+
+func TestNestedTrees(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"source/sub/a.txt": "a", "source2/a.txt": "a", "dest/a.txt": "a"})
+	path := func(relPath string) string { return filepath.Join(dir, filepath.FromSlash(relPath)) }
+	linked := path("link")
+	if err := os.Symlink(path("source/sub"), linked); err != nil {
+		t.Skipf("symlinks aren't supported: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		source, dest string
+		nested       bool
+	}{
+		{"siblings", path("source"), path("dest"), false},
+		{"common prefix", path("source"), path("source2"), false},
+		{"destination inside source", path("source"), path("source/sub"), true},
+		{"source inside destination", path("source/sub"), path("source"), true},
+		{"same path", path("source"), path("source"), true},
+		{"unclean path", path("source"), filepath.Join(path("dest"), "..", "source", "sub"), true},
+		{"through a symlink", path("source"), linked, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, nested := nestedTrees([]string{test.source}, []string{test.dest}); nested != test.nested {
+				t.Errorf("nested = %v, want %v", nested, test.nested)
+			}
+		})
+	}
+
+	code, _, stderr := runCommand(t, "", "--strict", path("source"), path("source/sub"))
+	if code != exitError || !strings.Contains(stderr, "overlap") {
+		t.Errorf("--strict with nested trees exited %d, want %d with an error:\n%s", code, exitError, stderr)
+	}
+	// stdin isn't a terminal, so nobody can confirm and --apply stops
+	for _, args := range [][]string{{"--apply"}, {"--apply", "--quiet"}} {
+		args = append(args, path("source"), path("source/sub"))
+		if code, _, stderr := runCommand(t, "y\n", args...); code != exitError || !strings.Contains(stderr, "--yes") {
+			t.Errorf("%q with nested trees and no terminal exited %d, want %d with an error:\n%s", args, code, exitError, stderr)
+		}
+	}
+	if code, _, stderr := runCommand(t, "", "--apply", "--yes", path("source"), path("source/sub")); code != exitOK {
+		t.Errorf("--yes with nested trees exited %d, want %d:\n%s", code, exitOK, stderr)
+	}
+}
+
+func TestSizeMismatchReport(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "1", "b.txt": "same"}, map[string]string{"a.txt": "111", "b.txt": "same"})
+
+	code, stdout, stderr := runCommand(t, "", "--same-name-different-size", "--format", "json", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	var records []sizeMismatchJSON
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("stdout isn't a JSON array: %v\n%s", err, stdout)
+	}
+	want := []sizeMismatchJSON{{RelPath: "a.txt", Source: filepath.Join(source, "a.txt"), Dest: filepath.Join(dest, "a.txt"), SourceSize: 1, DestSize: 3}}
+	if !slices.Equal(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"backup1/a": "a", "backup2/a": "a", "other/a": "a", "odd[1]/a": "a"})
+	path := func(relPath string) string { return filepath.Join(dir, relPath) }
+
+	tests := []struct {
+		pattern string
+		want    []string // Nil if the pattern must be an error
+	}{
+		{path("backup*"), []string{path("backup1"), path("backup2")}},
+		{path("backup?"), []string{path("backup1"), path("backup2")}},
+		{path("other"), []string{path("other")}},
+		{path("missing"), []string{path("missing")}}, // Not a pattern, so it's left to the scan
+		{path("odd[1]"), []string{path("odd[1]")}},
+		{path("nothing*"), nil},
+		{path("bad["), nil},
+	}
+	for _, test := range tests {
+		got, err := expandGlob(test.pattern)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("expandGlob(%q) = %q, want an error", test.pattern, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, test.want) {
+			t.Errorf("expandGlob(%q) = %q, %v, want %q", test.pattern, got, err, test.want)
+		}
+	}
+
+	opts, valid := validateArgs([]string{path("backup*"), path("other")}, io.Discard, io.Discard)
+	if want := []string{path("backup1"), path("backup2")}; !valid || !slices.Equal(opts.sourcePaths, want) {
+		t.Errorf("source paths = %q, valid %v, want %q", opts.sourcePaths, valid, want)
+	}
+	var stdout bytes.Buffer
+	if _, valid := validateArgs([]string{path("nothing*"), path("other")}, &stdout, io.Discard); valid || !strings.Contains(stdout.String(), "matches no paths") {
+		t.Errorf("a pattern matching nothing was accepted, or not explained:\n%s", stdout.String())
+	}
+}
+
+func TestNoCrossMounts(t *testing.T) {
+	for _, flag := range []string{"--one-file-system", "--no-cross-mounts"} {
+		if opts, valid := validateArgs([]string{flag, "a", "b"}, io.Discard, io.Discard); !valid || !opts.scan.OneFileSystem {
+			t.Errorf("%s didn't keep the scan on one filesystem", flag)
+		}
+	}
+	// Crossing mounts is the default
+	if opts, _ := validateArgs([]string{"a", "b"}, io.Discard, io.Discard); opts.scan.OneFileSystem {
+		t.Error("the scan stays on one filesystem by default")
+	}
+
+	var messages bytes.Buffer
+	out := output{messages: &messages, log: newLogger(io.Discard, logText, slog.LevelError)}
+	mounts := []string{filepath.Join("data", "mnt"), filepath.Join("data", "proc")}
+	printScanStats(out, dedup.ScanOptions{OneFileSystem: true}, dedup.ScanStats{OtherFileSystem: mounts})
+	for _, want := range []string{"Skipped mount point " + mounts[0], "Skipped mount point " + mounts[1], "Skipped 2 directories on other filesystems"} {
+		if !strings.Contains(messages.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, messages.String())
+		}
+	}
+}
+
+func TestNothingModifiedWithoutApply(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string // Before the paths
+		tree bool     // Whether the run is within the source tree alone
+	}{
+		{"symlink", nil, false},
+		{"hardlink", []string{"--link", "hardlink"}, false},
+		{"delete", []string{"--action", "delete"}, false},
+		{"dest wins", []string{"--direction", "dest-wins"}, false},
+		{"prune empty directories", []string{"--action", "delete", "--prune-empty-dirs"}, false},
+		{"single tree", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{"a.txt": "duplicate", "sub/b.txt": "other"}
+			source, dest := newTrees(t, files, files)
+			args := append(slices.Clone(test.args), source, dest)
+			if test.tree {
+				writeTree(t, source, map[string]string{"copy/a.txt": "duplicate"})
+				args = append(slices.Clone(test.args), source)
+			}
+
+			code, stdout, stderr := runCommand(t, "", args...)
+			if code != exitOK {
+				t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+			}
+			if !strings.Contains(stdout, "Dry run by default; pass --apply to make changes.") {
+				t.Errorf("stdout doesn't explain the dry run:\n%s", stdout)
+			}
+			if !strings.Contains(stdout, "Would ") {
+				t.Errorf("stdout doesn't say what would change:\n%s", stdout)
+			}
+			for _, root := range []string{source, dest} {
+				for relPath, contents := range files {
+					path := filepath.Join(root, filepath.FromSlash(relPath))
+					if isSymlink(t, path) {
+						t.Errorf("%s was replaced", path)
+					} else if got, err := os.ReadFile(path); err != nil || string(got) != contents {
+						t.Errorf("%s holds %q (%v), want %q", path, got, err, contents)
+					}
+				}
+			}
+			if test.tree && isSymlink(t, filepath.Join(source, "copy", "a.txt")) {
+				t.Error("the copy within the tree was replaced")
+			}
+		})
+	}
+
+	var stdout bytes.Buffer
+	if _, valid := validateArgs([]string{"--apply", "--dry-run", "a", "b"}, &stdout, io.Discard); valid {
+		t.Error("--apply and --dry-run were accepted together")
+	}
+}
+
+func TestNoRecursive(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "big.txt": "bigger", "skip.tmp": "t", "sub/b.txt": "b", "sub/deeper/c.txt": "c"}
+	source, dest := newTrees(t, files, files)
+
+	code, _, stderr := runCommand(t, "", "--no-recursive", "--exclude", "*.tmp", "--max-size", "3", "--apply", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	for relPath := range files {
+		want := relPath == "a.txt"
+		if linked := isSymlink(t, filepath.Join(dest, filepath.FromSlash(relPath))); linked != want {
+			t.Errorf("%s is a symlink = %v, want %v", relPath, linked, want)
+		}
+	}
+
+	if _, valid := validateArgs([]string{"--no-recursive", "--max-depth", "0", "a", "b"}, io.Discard, io.Discard); !valid {
+		t.Error("--no-recursive was refused with --max-depth 0, which means the same")
+	}
+	if _, valid := validateArgs([]string{"--no-recursive", "--max-depth", "2", "a", "b"}, io.Discard, io.Discard); valid {
+		t.Error("--no-recursive was accepted with --max-depth 2")
+	}
+}
+
+func TestExcludeFrom(t *testing.T) {
+	files := map[string]string{"a.o": "a", "b.log": "b", "c.tmp": "c", "d.txt": "d", "build/e.txt": "e"}
+	source, dest := newTrees(t, files, files)
+	writeTree(t, dest, map[string]string{".dedupignore": "*.tmp\n"})
+	patterns := filepath.Join(t.TempDir(), "patterns.txt")
+	writeTree(t, filepath.Dir(patterns), map[string]string{"patterns.txt": "# objects\n*.o\nbuild/\n"})
+
+	// The file's patterns merge with --exclude and the .dedupignore files
+	code, _, stderr := runCommand(t, "", "--exclude-from", patterns, "--exclude", "*.log", "--apply", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	for relPath := range files {
+		want := relPath == "d.txt"
+		if linked := isSymlink(t, filepath.Join(dest, filepath.FromSlash(relPath))); linked != want {
+			t.Errorf("%s is a symlink = %v, want %v", relPath, linked, want)
+		}
+	}
+
+	var stdout bytes.Buffer
+	if _, valid := validateArgs([]string{"--exclude-from", filepath.Join(t.TempDir(), "missing.txt"), "a", "b"}, &stdout, io.Discard); valid {
+		t.Error("a missing --exclude-from file was accepted")
+	}
+}
+
+func TestDedupDestInternal(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"a.txt": "same"},
+		map[string]string{"a.txt": "same", "copy.txt": "same", "x.txt": "other", "y.txt": "other"})
+
+	code, _, stderr := runCommand(t, "", "--dedup-dest-internal", "--apply", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "copy.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(source, "a.txt"); target != want {
+		t.Errorf("copy.txt links to %s, want %s", target, want)
+	}
+	if !isSymlink(t, filepath.Join(dest, "y.txt")) || isSymlink(t, filepath.Join(dest, "x.txt")) {
+		t.Error("y.txt should be linked to x.txt, which is kept")
+	}
+
+	// Without the flag the destination's own duplicates are left alone
+	source, dest = newTrees(t, map[string]string{"a.txt": "same"}, map[string]string{"x.txt": "other", "y.txt": "other"})
+	if code, _, stderr := runCommand(t, "", "--apply", source, dest); code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if isSymlink(t, filepath.Join(dest, "x.txt")) || isSymlink(t, filepath.Join(dest, "y.txt")) {
+		t.Error("the destination's duplicates were linked without --dedup-dest-internal")
+	}
+}
+
+func TestConfirmThreshold(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"}
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		linked bool
+	}{
+		{"over the threshold", []string{"--confirm-threshold", "2", "--apply"}, exitError, false},
+		{"over the percentage", []string{"--confirm-threshold", "0", "--confirm-percent", "50", "--apply"}, exitError, false},
+		{"confirmed with --yes", []string{"--confirm-threshold", "2", "--yes", "--apply"}, exitOK, true},
+		{"at the threshold", []string{"--confirm-threshold", "3", "--apply"}, exitOK, true},
+		{"dry run", []string{"--confirm-threshold", "2"}, exitOK, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, dest := newTrees(t, files, files)
+			// The test's stdin is no terminal, so there is nobody to ask
+			code, _, stderr := runCommand(t, "y\n", append(test.args, source, dest)...)
+			if code != test.code {
+				t.Fatalf("exit code = %d, want %d; stderr:\n%s", code, test.code, stderr)
+			}
+			if test.code == exitError && !strings.Contains(stderr, "--yes") {
+				t.Errorf("stderr doesn't mention --yes:\n%s", stderr)
+			}
+			for relPath := range files {
+				if linked := isSymlink(t, filepath.Join(dest, relPath)); linked != test.linked {
+					t.Errorf("%s is a symlink = %v, want %v", relPath, linked, test.linked)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixHash(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"same.bin": "header: same tail", "diff.bin": "header: one tail"},
+		map[string]string{"same.bin": "header: same tail", "diff.bin": "header: two tail"})
+
+	code, stdout, stderr := runCommand(t, "", "--prefix-hash", "8", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "diff.bin") || !strings.Contains(stdout+stderr, "Approximate") {
+		t.Errorf("the approximate match isn't reported as one:\nstdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+
+	if code, _, _ := runCommand(t, "", "--prefix-hash", "8", "--apply", source, dest); code != exitUsage {
+		t.Errorf("--prefix-hash --apply without --verify: exit code = %d, want %d", code, exitUsage)
+	}
+
+	// --verify compares the whole files, so only the real duplicate goes
+	if code, _, stderr := runCommand(t, "", "--prefix-hash", "8", "--verify", "--apply", source, dest); code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if !isSymlink(t, filepath.Join(dest, "same.bin")) || isSymlink(t, filepath.Join(dest, "diff.bin")) {
+		t.Error("only same.bin should have been replaced")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// writeManifest scans the single path in opts and writes the hashes of its
+// files to opts.manifestOut.
+func writeManifest(ctx context.Context, opts options, out output) error {
+	files, err := scanTree(ctx, opts, out)
+	if err != nil {
+		return err
+	}
+	manifest, err := dedup.NewManifest(ctx, opts.sourcePaths[0], files, out.warn)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(opts.manifestOut)
+	if err != nil {
+		return fmt.Errorf("error creating manifest %s: %w", opts.manifestOut, err)
+	}
+	_, err = manifest.WriteTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out.messages, "Wrote %d files to manifest %s\n", len(manifest.Entries), opts.manifestOut)
+	return nil
+}
+
+// isURL reports whether the manifest path is an http:// or https:// URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// checkRemoteManifest stops a run that would link files to a downloaded
+// manifest's tree when that tree isn't on this machine, since every
+// replacement would fail only once its destination had been examined.
+// Runs that only report are let through with a warning. It returns the exit
+// code to stop with, if the run should stop.
+func checkRemoteManifest(opts options, manifest *dedup.Manifest, out output) (int, bool) {
+	if !isURL(opts.manifestIn) {
+		return exitOK, false
+	}
+	if _, err := os.Stat(manifest.Root); err == nil {
+		return exitOK, false
+	}
+	if !opts.apply.DryRun || opts.dirLevel || opts.interactive {
+		out.log.Error("the tree the manifest describes isn't on this machine, so its files can't be linked to; drop --apply, --dir-level and --interactive to only report the duplicates", "manifest", opts.manifestIn, "root", manifest.Root)
+		return exitUsage, true
+	}
+	out.log.Warn("the tree the manifest describes isn't on this machine, so the duplicates are only reported", "manifest", opts.manifestIn, "root", manifest.Root)
+	return exitOK, false
+}
+
+// loadManifest reads the manifest at path, downloading it within timeout if
+// path is an http:// or https:// URL.
+func loadManifest(ctx context.Context, path string, timeout time.Duration) (*dedup.Manifest, error) {
+	var r io.ReadCloser
+	var err error
+	if isURL(path) {
+		r, err = fetchManifest(ctx, path, timeout)
+	} else {
+		r, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest %s: %w", path, err)
+	}
+	defer r.Close()
+	manifest, err := dedup.ReadManifest(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// fetchManifest requests the manifest at url and returns the body of the
+// response, which must be JSON. The whole download, body included, must
+// finish within timeout.
+func fetchManifest(ctx context.Context, url string, timeout time.Duration) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var problem error
+	if resp.StatusCode != http.StatusOK {
+		problem = fmt.Errorf("server responded %s", resp.Status)
+	} else if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		problem = fmt.Errorf("expected JSON, got content type %q", resp.Header.Get("Content-Type"))
+	}
+	if problem != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, problem
+	}
+	return cancelOnClose{resp.Body, cancel}, nil
+}
+
+// cancelOnClose releases the context of a download once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
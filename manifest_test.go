@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveManifest writes a manifest of a tree holding files and serves it
+// with contentType, returning the server and the tree's root.
+func serveManifest(t *testing.T, files map[string]string, contentType string) (*httptest.Server, string) {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	writeTree(t, source, files)
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if code, _, stderr := runCommand(t, "", "--manifest-out", path, source); code != exitOK {
+		t.Fatalf("writing the manifest exited %d; stderr:\n%s", code, stderr)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if r.URL.Path != "/manifest.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(contents)
+	}))
+	t.Cleanup(server.Close)
+	return server, source
+}
+
+func TestRemoteManifest(t *testing.T) {
+	files := map[string]string{"a.txt": "duplicate", "b.txt": "original"}
+	server, source := serveManifest(t, files, "application/json; charset=utf-8")
+	dest := filepath.Join(t.TempDir(), "dest")
+	writeTree(t, dest, map[string]string{"a.txt": "duplicate", "b.txt": "changed"})
+
+	code, stdout, stderr := runCommand(t, "", "--manifest-in", server.URL+"/manifest.json", "--format", "json", dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	var records []duplicateJSON
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("stdout isn't a JSON array: %v\n%s", err, stdout)
+	}
+	var got []string
+	for _, record := range records {
+		got = append(got, record.Destination+" <- "+record.Source)
+	}
+	if want := []string{filepath.Join(dest, "a.txt") + " <- " + filepath.Join(source, "a.txt")}; !slices.Equal(got, want) {
+		t.Errorf("duplicates = %q, want %q", got, want)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	server, _ := serveManifest(t, map[string]string{"a.txt": "a"}, "text/html")
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"wrong content type", "/manifest.json", "expected JSON"},
+		{"not found", "/missing.json", "404"},
+		{"timeout", "/slow", "deadline exceeded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadManifest(context.Background(), server.URL+test.path, 50*time.Millisecond)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// materializeLinks replaces the symlinks within the single path in opts with
+// copies of their targets, or only reports them under --dry-run. It returns
+// how many links were materialized and the errors of those that couldn't be.
+func materializeLinks(ctx context.Context, opts options, out output) (int, []error, error) {
+	root := opts.sourcePaths[0]
+	fmt.Fprintf(out.messages, "Path: %s\n", root)
+	links, err := dedup.FindInternalLinks(ctx, root, out.warn)
+	if err != nil {
+		return 0, nil, err
+	}
+	fmt.Fprintf(out.messages, "Found %d symlinks within the path\n", len(links))
+
+	var materialized int
+	var errs []error
+	for _, link := range links {
+		if ctx.Err() != nil {
+			break
+		}
+		if opts.apply.DryRun {
+			fmt.Fprintf(out.messages, "Would materialize %s from %s\n", link.Path, link.Target)
+			materialized++
+			continue
+		}
+		if err := dedup.Materialize(link); err != nil {
+			out.log.Error("could not materialize symlink", "path", link.Path, "source", link.Target, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(out.messages, "Materialized %s from %s\n", link.Path, link.Target)
+		out.log.Info("materialized symlink", "path", link.Path, "source", link.Target)
+		materialized++
+	}
+	return materialized, errs, nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// defaultMaxOpenFiles is not supported on this platform; 0 means no limit.
+func defaultMaxOpenFiles() int {
+	return 0
+}
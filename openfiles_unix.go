@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// defaultMaxOpenFiles returns half the process's soft limit on open files,
+// leaving the rest for the log, cache and output files and the standard
+// streams. It returns 0, meaning no limit, if the limit can't be read.
+func defaultMaxOpenFiles() int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	// An unlimited soft limit reads as the largest value
+	return int(min(limit.Cur/2, 1<<20))
+}
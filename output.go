@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+)
+
+// output holds the writers the command prints to, so it can be pointed at
+// something other than the process's stdout and stderr. The human-readable
+// report and messages are kept apart from the structured log, so the log can
+// be collected on its own.
+type output struct {
+	report   io.Writer    // The duplicates in the chosen --format
+	results  io.Writer    // The line for each duplicate replaced: the text report, or else a message
+	messages io.Writer    // Progress and the outcome of each step
+	errors   io.Writer    // Failure summaries and the progress line
+	log      *slog.Logger // Warnings, errors and every replacement
+}
+
+// logFormat selects how records in the structured log are encoded.
+type logFormat string
+
+const (
+	logText logFormat = "text"
+	logJSON logFormat = "json"
+)
+
+func parseLogFormat(value string) (logFormat, error) {
+	switch format := logFormat(value); format {
+	case logText, logJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q (expected text or json)", value)
+	}
+}
+
+func parseLogLevel(value string) (slog.Level, error) {
+	switch value {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", value)
+	}
+}
+
+// newLogger returns a logger writing records of at least level to w.
+func newLogger(w io.Writer, format logFormat, level slog.Level) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if format == logJSON {
+		return slog.New(slog.NewJSONHandler(w, handlerOpts))
+	}
+	return slog.New(slog.NewTextHandler(w, handlerOpts))
+}
+
+// warn logs a problem the command recovered from, with the path involved
+// when the error carries one.
+func (out output) warn(err error) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		out.log.Warn("recovered from error", "path", pathErr.Path, "err", err)
+		return
+	}
+	out.log.Warn("recovered from error", "err", err)
+}
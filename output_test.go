@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logRecords decodes the JSON log records in log, one per line.
+func logRecords(t *testing.T, log string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("log line isn't JSON: %v\n%s", err, scanner.Text())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestStructuredLog(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "same"}, map[string]string{"a.txt": "same"})
+
+	code, stdout, stderr := runCommand(t, "", "--apply", "--log-format", "json", "--log-level", "info", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	if strings.Contains(stdout, `"level"`) {
+		t.Errorf("log records were written to stdout:\n%s", stdout)
+	}
+	records := logRecords(t, stderr)
+	if len(records) != 1 {
+		t.Fatalf("got %d log records, want 1:\n%s", len(records), stderr)
+	}
+	record := records[0]
+	if record["level"] != "INFO" || record["msg"] != "replaced duplicate" || record["path"] != filepath.Join(dest, "a.txt") {
+		t.Errorf("record = %v, want an INFO record of the replacement of dest/a.txt", record)
+	}
+}
+
+func TestWarnRecordsPath(t *testing.T) {
+	var buf bytes.Buffer
+	out := output{log: newLogger(&buf, logJSON, slog.LevelWarn)}
+	out.warn(fmt.Errorf("skipping: %w", &fs.PathError{Op: "open", Path: "/locked", Err: fs.ErrPermission}))
+	out.warn(fmt.Errorf("no path here"))
+
+	records := logRecords(t, buf.String())
+	if len(records) != 2 {
+		t.Fatalf("got %d log records, want 2:\n%s", len(records), buf.String())
+	}
+	if records[0]["level"] != "WARN" || records[0]["path"] != "/locked" || records[0]["err"] == nil {
+		t.Errorf("first record = %v, want a WARN record with path and err", records[0])
+	}
+	if _, hasPath := records[1]["path"]; hasPath {
+		t.Errorf("second record = %v, want no path", records[1])
+	}
+
+	// Records below the level are dropped
+	quiet := output{log: newLogger(io.Discard, logText, slog.LevelError)}
+	if quiet.log.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("a logger at error level writes warnings")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "a"}, map[string]string{"a.txt": "different"})
+
+	code, stdout, stderr := runCommand(t, "", "--quiet", "--apply", source, dest)
+	if code != exitOK || stdout != "" || stderr != "" {
+		t.Errorf("quiet run exited %d and printed:\n%s%s", code, stdout, stderr)
+	}
+
+	writeTree(t, dest, map[string]string{"b.txt": "b"})
+	writeTree(t, source, map[string]string{"b.txt": "b"})
+	code, stdout, stderr = runCommand(t, "", "-q", "--format", "json", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	var records []duplicateJSON
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil || len(records) != 1 {
+		t.Errorf("quiet JSON run printed %d records (%v), want just the report:\n%s", len(records), err, stdout)
+	}
+
+	// A text report sent to --output is still written, without the messages
+	report := filepath.Join(t.TempDir(), "report.txt")
+	code, stdout, stderr = runCommand(t, "", "-q", "--output", report, source, dest)
+	if code != exitOK || stdout != "" || stderr != "" {
+		t.Errorf("quiet run with --output exited %d and printed:\n%s%s", code, stdout, stderr)
+	}
+	contents, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Would replace " + filepath.Join(dest, "b.txt"); !strings.HasPrefix(string(contents), want) || strings.Contains(string(contents), "Found") {
+		t.Errorf("report file holds %q, want only the line starting %q", contents, want)
+	}
+
+	code, stdout, stderr = runCommand(t, "", "-q", filepath.Join(source, "missing"), dest)
+	if code != exitError || stdout != "" || !strings.Contains(stderr, "missing") {
+		t.Errorf("quiet failing run exited %d, printed %q to stdout and %q to stderr, want only the error", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,631 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// contentsEqual streams both files in chunks of bufSize bytes, throttled by
+// limit, and reports whether their contents are identical, stopping at the
+// first mismatch.
+func contentsEqual(a, b string, bufSize int, limit *ReadLimiter) (bool, error) {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false, fmt.Errorf("error opening file %s: %w", a, err)
+	}
+	defer fileA.Close()
+
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false, fmt.Errorf("error opening file %s: %w", b, err)
+	}
+	defer fileB.Close()
+
+	readerA, readerB := limit.reader(fileA), limit.reader(fileB)
+	bufA := make([]byte, bufferSize(bufSize))
+	bufB := make([]byte, bufferSize(bufSize))
+	for {
+		nA, errA := io.ReadFull(readerA, bufA)
+		if errA != nil && !errors.Is(errA, io.EOF) && !errors.Is(errA, io.ErrUnexpectedEOF) {
+			return false, fmt.Errorf("error reading file %s: %w", a, errA)
+		}
+		nB, errB := io.ReadFull(readerB, bufB)
+		if errB != nil && !errors.Is(errB, io.EOF) && !errors.Is(errB, io.ErrUnexpectedEOF) {
+			return false, fmt.Errorf("error reading file %s: %w", b, errB)
+		}
+
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		// A short read means both files reached EOF at the same offset
+		if errA != nil {
+			return true, nil
+		}
+	}
+}
+
+// ErrAlreadyLinked reports that a destination is already a symlink or a hard
+// link to its source.
+var ErrAlreadyLinked = errors.New("already linked")
+
+// ErrChanged reports that a file of a duplicate changed after it was scanned,
+// so the contents compared may no longer be what is on disk.
+var ErrChanged = errors.New("changed during run")
+
+// checkDuplicateExists validates that both files of dup exist before either
+// is modified. A destination that is already a symlink is never replaced:
+// ErrAlreadyLinked is returned if it resolves to the source, and an error
+// otherwise. ErrAlreadyLinked is also returned for a destination that is a
+// hard link to the source. ErrChanged is returned if either file no longer
+// matches what the scan saw. On success the destination's file info is
+// returned.
+func checkDuplicateExists(dup Duplicate) (os.FileInfo, error) {
+	sourceInfo, err := os.Stat(dup.Source)
+	// A source that became a dangling symlink since the scan must not become
+	// a link target, since the link would be broken too
+	if errors.Is(err, os.ErrNotExist) && isSymlink(dup.Source) {
+		return nil, fmt.Errorf("source file %s is a broken symlink", dup.Source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("source file %s does not exist: %w", dup.Source, err)
+	}
+
+	destInfo, err := os.Lstat(dup.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("destination file %s does not exist: %w", dup.Destination, err)
+	}
+
+	if destInfo.Mode()&os.ModeSymlink != 0 {
+		resolved, err := os.Stat(dup.Destination)
+		if err == nil && os.SameFile(resolved, sourceInfo) {
+			return nil, ErrAlreadyLinked
+		}
+		return nil, fmt.Errorf("destination file %s is a symlink to another file", dup.Destination)
+	}
+	if os.SameFile(destInfo, sourceInfo) {
+		return nil, ErrAlreadyLinked
+	}
+
+	if err := checkUnchanged(dup.Source, sourceInfo, dup.Size, dup.SourceModTime); err != nil {
+		return nil, err
+	}
+	if err := checkUnchanged(dup.Destination, destInfo, dup.Size, dup.DestModTime); err != nil {
+		return nil, err
+	}
+	return destInfo, nil
+}
+
+// checkUnchanged returns ErrChanged if the file at path, described by info,
+// no longer has the size and modification time the scan saw. A zero modTime
+// means the scan's view is unknown, and nothing is checked.
+func checkUnchanged(path string, info os.FileInfo, size int64, modTime time.Time) error {
+	if modTime.IsZero() {
+		return nil
+	}
+	if info.Size() != size || !info.ModTime().Equal(modTime) {
+		return fmt.Errorf("%w: %s was modified after it was scanned", ErrChanged, path)
+	}
+	return nil
+}
+
+// Replacement records a destination that was replaced by a link, along with
+// the metadata it had beforehand so it can be restored.
+type Replacement struct {
+	Duplicate
+	Link    LinkType
+	Target  string      // Path stored in the link
+	Mode    os.FileMode // Permissions of the replaced destination
+	ModTime time.Time   // Modification time of the replaced destination
+	Trash   string      // Where the destination was moved, if a trash directory was given
+
+	Xattrs map[string][]byte // Extended attributes of the replaced destination, if any
+}
+
+// Reclaimed returns the bytes freed by the replacement. A symlink still
+// stores its target path, while a hard link shares the source's storage and
+// a deleted destination takes none.
+func (r Replacement) Reclaimed() int64 {
+	if r.Link == LinkSymlink {
+		// A target longer than a small file reclaims nothing, not less
+		return max(r.Size-int64(len(r.Target)), 0)
+	}
+	return r.Size
+}
+
+func newReplacement(dup Duplicate, link LinkType, target string, destInfo os.FileInfo) Replacement {
+	return Replacement{
+		Duplicate: dup,
+		Link:      link,
+		Target:    target,
+		Mode:      destInfo.Mode(),
+		ModTime:   destInfo.ModTime(),
+	}
+}
+
+// symlinkTarget returns the path stored in the symlink that replaces the
+// destination of dup. Relative targets are computed from the destination's
+// directory so the link survives relocating both trees together. If base is
+// given, both ends of a relative link must be inside it, so base can be
+// moved as a whole without breaking the link.
+func symlinkTarget(dup Duplicate, relative bool, base string) (string, error) {
+	if !relative {
+		return dup.Source, nil
+	}
+
+	absSource, err := filepath.Abs(dup.Source)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", dup.Source, err)
+	}
+	absDest, err := filepath.Abs(dup.Destination)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", dup.Destination, err)
+	}
+
+	if base != "" {
+		absBase, err := filepath.Abs(base)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %w", base, err)
+		}
+		for _, path := range []string{absSource, absDest} {
+			if !isWithin(absBase, path) {
+				return "", fmt.Errorf("can't link %s to %s: %s is outside the link base %s", dup.Destination, dup.Source, path, base)
+			}
+		}
+	}
+
+	target, err := filepath.Rel(filepath.Dir(absDest), absSource)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute relative link from %s to %s: %w", dup.Destination, dup.Source, err)
+	}
+	return target, nil
+}
+
+// createTemp calls create with unused paths next to path until one doesn't
+// already exist, and returns the path it succeeded with.
+func createTemp(path string, create func(tempPath string) error) (string, error) {
+	dir := filepath.Dir(path)
+	for {
+		tempPath := filepath.Join(dir, fmt.Sprintf(".dedup-link-%016x", rand.Uint64()))
+		err := create(tempPath)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return tempPath, err
+	}
+}
+
+// replaceAtomically creates a link with create at a temporary path next to
+// the destination of dup and renames it over the destination, so the
+// destination always holds either the original file or the link, even if the
+// process dies in between. If trashDir is given, the original is first kept
+// there, and its path is returned.
+func replaceAtomically(dup Duplicate, trashDir string, create func(tempPath string) error) (string, error) {
+	var trashPath string
+	if trashDir != "" {
+		var err error
+		trashPath, err = keepInTrash(dup, trashDir)
+		if err != nil {
+			return "", err
+		}
+	}
+	// Until the rename the original is still in place, so a copy in the
+	// trash is all there is to undo
+	discardTrash := func() {
+		if trashPath != "" {
+			os.Remove(trashPath)
+		}
+	}
+
+	tempPath, err := createTemp(dup.Destination, create)
+	if err != nil {
+		discardTrash()
+		return "", err
+	}
+	if err := os.Rename(tempPath, dup.Destination); err != nil {
+		os.Remove(tempPath)
+		discardTrash()
+		return "", fmt.Errorf("failed to replace %s: %w", dup.Destination, err)
+	}
+	return trashPath, nil
+}
+
+func replaceWithSymlink(dup Duplicate, relative bool, base, trashDir string) (Replacement, error) {
+	sourceFilePath, destFilePath := dup.Source, dup.Destination
+	destInfo, err := checkDuplicateExists(dup)
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	target, err := symlinkTarget(dup, relative, base)
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	trashPath, err := replaceAtomically(dup, trashDir, func(tempPath string) error {
+		if err := os.Symlink(target, tempPath); err != nil {
+			return fmt.Errorf("failed to create symlink from %s to %s: %w", destFilePath, sourceFilePath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	r := newReplacement(dup, LinkSymlink, target, destInfo)
+	r.Trash = trashPath
+	return r, nil
+}
+
+func replaceWithHardlink(dup Duplicate, trashDir string) (Replacement, error) {
+	sourceFilePath, destFilePath := dup.Source, dup.Destination
+	destInfo, err := checkDuplicateExists(dup)
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	trashPath, err := replaceAtomically(dup, trashDir, func(tempPath string) error {
+		err := os.Link(sourceFilePath, tempPath)
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("failed to create hard link from %s to %s: hard links can't span filesystems, use symlinks instead", destFilePath, sourceFilePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create hard link from %s to %s: %w", destFilePath, sourceFilePath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	r := newReplacement(dup, LinkHardlink, sourceFilePath, destInfo)
+	r.Trash = trashPath
+	return r, nil
+}
+
+// deleteDuplicate removes the destination of dup, moving it into trashDir
+// instead if one is given.
+func deleteDuplicate(dup Duplicate, trashDir string) (Replacement, error) {
+	destInfo, err := checkDuplicateExists(dup)
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	r := newReplacement(dup, LinkDelete, "", destInfo)
+	if trashDir == "" {
+		if err := os.Remove(dup.Destination); err != nil {
+			return Replacement{}, fmt.Errorf("failed to delete %s: %w", dup.Destination, err)
+		}
+		return r, nil
+	}
+
+	r.Trash, err = reserveTrashPath(trashDir, dup.RelPath)
+	if err != nil {
+		return Replacement{}, err
+	}
+	if err := moveFile(dup.Destination, r.Trash); err != nil {
+		os.Remove(r.Trash)
+		return Replacement{}, fmt.Errorf("failed to move %s to trash: %w", dup.Destination, err)
+	}
+	return r, nil
+}
+
+// planReplacement returns the replacement that replace would make for dup
+// without modifying anything.
+func planReplacement(dup Duplicate, opts ApplyOptions) (Replacement, error) {
+	destInfo, err := checkDuplicateExists(dup)
+	if err != nil {
+		return Replacement{}, err
+	}
+
+	target := dup.Source
+	switch opts.Link {
+	case LinkDelete:
+		target = ""
+	case LinkSymlink:
+		target, err = symlinkTarget(dup, opts.RelativeLinks, opts.LinkBase)
+		if err != nil {
+			return Replacement{}, err
+		}
+	}
+	return newReplacement(dup, opts.Link, target, destInfo), nil
+}
+
+// replace swaps the destination of dup for the link configured in opts, or
+// deletes it under LinkDelete.
+func replace(dup Duplicate, opts ApplyOptions) (Replacement, error) {
+	// Links can't carry the destination's extended attributes, so they are
+	// recorded for undo; a missing destination is reported by the replace
+	xattrs, err := readXattrs(dup.Destination)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Replacement{}, err
+	}
+	r, err := replaceWith(dup, opts)
+	if err == nil {
+		r.Xattrs = xattrs
+	}
+	return r, err
+}
+
+// replaceWith dispatches replace to the function for opts.Link.
+func replaceWith(dup Duplicate, opts ApplyOptions) (Replacement, error) {
+	switch opts.Link {
+	case LinkHardlink:
+		return replaceWithHardlink(dup, opts.TrashDir)
+	case LinkDelete:
+		return deleteDuplicate(dup, opts.TrashDir)
+	default:
+		r, err := replaceWithSymlink(dup, opts.RelativeLinks, opts.LinkBase, opts.TrashDir)
+		if err != nil && opts.HardlinkFallback && symlinkNotPermitted(err) {
+			return replaceWithHardlink(dup, opts.TrashDir)
+		}
+		return r, err
+	}
+}
+
+// preserveTimes gives a symlink the modification time of the file it
+// replaced. Hard links share the source's inode, so their times can't be
+// changed without also changing the source.
+func preserveTimes(r Replacement) error {
+	if r.Link != LinkSymlink {
+		return nil
+	}
+	if err := lchtimes(r.Destination, r.ModTime, r.ModTime); err != nil {
+		return fmt.Errorf("failed to preserve times on %s: %w", r.Destination, err)
+	}
+	return nil
+}
+
+// ApplyOptions controls how Apply replaces duplicates.
+type ApplyOptions struct {
+	Link          LinkType
+	RelativeLinks bool   // Store symlink targets relative to the link's directory
+	LinkBase      string // With RelativeLinks, a directory both ends of every link must be in
+	PreserveTimes bool   // Give symlinks the modification time of the file they replace
+	Verify        bool   // Byte-compare each duplicate before replacing it
+	DryRun        bool   // Report what would be replaced without touching the filesystem
+	TrashDir      string // Directory replaced destinations are moved into instead of deleted
+	Jobs          int    // Number of concurrent replacements
+	BufferSize    int    // Bytes read at a time when verifying; 0 means DefaultBufferSize
+	// ReadLimit, if set, throttles the reads of Verify. It may be shared
+	// with ScanOptions.ReadLimit to cap the reads of the whole run.
+	ReadLimit *ReadLimiter
+	// OpenLimit, if set, bounds the files open at once while verifying and
+	// trashing. It may be shared with MatchOptions.OpenLimit to bound the
+	// open files of the whole run.
+	OpenLimit *OpenLimiter
+
+	// Retries is how many more times a replacement that failed with a
+	// transient error, such as EBUSY on a network filesystem, is attempted.
+	// RetryDelay is the wait before the first retry, doubled for each after.
+	Retries    int
+	RetryDelay time.Duration
+
+	// Rehash hashes both files of every duplicate that records a Hash
+	// again before replacing it, and skips it as SkippedChanged unless both
+	// still have that hash, for duplicates found long before they are
+	// applied, as in a Plan.
+	Rehash bool
+
+	// HardlinkFallback replaces a duplicate with a hard link when the
+	// platform refuses to create a symlink for lack of privilege, as Windows
+	// does without Developer Mode. The Replacement records the hard link.
+	HardlinkFallback bool
+	// ShouldReplace, if set, is asked about every duplicate before it is
+	// verified or replaced, and those it returns false for are skipped as
+	// Declined. It is called concurrently from the replacement workers.
+	ShouldReplace func(Duplicate) bool
+	// OnResult receives the outcome of every duplicate processed, in the
+	// order the duplicates were given, one call at a time.
+	OnResult func(Result)
+}
+
+// Outcome says what Apply did with a duplicate.
+type Outcome int
+
+const (
+	Replaced         Outcome = iota // The destination was replaced by a link
+	Planned                         // The destination would be replaced under DryRun
+	SkippedDifferent                // Verify found the contents differ
+	SkippedLinked                   // The destination already links to the source
+	Failed                          // The destination couldn't be replaced
+	Declined                        // ApplyOptions.ShouldReplace returned false
+	SkippedChanged                  // A file changed between the scan and its replacement
+)
+
+// Result reports the outcome of one duplicate processed by Apply.
+type Result struct {
+	Duplicate
+	Outcome     Outcome
+	Replacement Replacement // The replacement made or planned, if any
+	// Err is why a Failed duplicate wasn't replaced, or a problem that
+	// didn't prevent the replacement, such as its times not being preserved.
+	Err error
+}
+
+// processDuplicate verifies and replaces a single duplicate. Under DryRun it
+// only plans the replacement. Skipped duplicates are not errors. Files are
+// only opened once open allows it.
+func processDuplicate(dup Duplicate, opts ApplyOptions, open *OpenLimiter) Result {
+	result := Result{Duplicate: dup}
+
+	if opts.ShouldReplace != nil && !opts.ShouldReplace(dup) {
+		result.Outcome = Declined
+		return result
+	}
+
+	if opts.Rehash && dup.Hash != "" {
+		open.acquire(1)
+		err := checkHashes(dup, opts)
+		open.release(1)
+		if errors.Is(err, ErrChanged) {
+			result.Outcome, result.Err = SkippedChanged, err
+			return result
+		}
+		if err != nil {
+			result.Outcome, result.Err = Failed, err
+			return result
+		}
+	}
+
+	if opts.Verify {
+		open.acquire(2)
+		equal, err := contentsEqual(dup.Source, dup.Destination, opts.BufferSize, opts.ReadLimit)
+		open.release(2)
+		if err != nil {
+			result.Outcome, result.Err = Failed, fmt.Errorf("error verifying %s: %w", dup.Destination, err)
+			return result
+		}
+		if !equal {
+			result.Outcome = SkippedDifferent
+			return result
+		}
+	}
+
+	var r Replacement
+	var err error
+	if opts.DryRun {
+		r, err = planReplacement(dup, opts)
+	} else {
+		// A failed replacement leaves the destination in place, so it can
+		// be attempted again
+		err = retry(opts.Retries, opts.RetryDelay, func() error {
+			var err error
+			if opts.TrashDir != "" {
+				// Keeping the destination may copy it, with both files open
+				open.acquire(2)
+				r, err = replace(dup, opts)
+				open.release(2)
+			} else {
+				r, err = replace(dup, opts)
+			}
+			return err
+		})
+	}
+	if errors.Is(err, ErrAlreadyLinked) {
+		result.Outcome = SkippedLinked
+		return result
+	}
+	if errors.Is(err, ErrChanged) {
+		result.Outcome, result.Err = SkippedChanged, err
+		return result
+	}
+	if err != nil {
+		result.Outcome, result.Err = Failed, err
+		return result
+	}
+	result.Replacement = r
+
+	if opts.DryRun {
+		result.Outcome = Planned
+		return result
+	}
+	result.Outcome = Replaced
+	if opts.PreserveTimes {
+		result.Err = preserveTimes(r)
+	}
+	return result
+}
+
+// checkHashes returns an error wrapping ErrChanged unless both files of dup
+// still hash to dup.Hash.
+func checkHashes(dup Duplicate, opts ApplyOptions) error {
+	for _, path := range []string{dup.Source, dup.Destination} {
+		hash, err := hashFile(path, dup.Algorithm, opts.BufferSize, opts.ReadLimit, 0)
+		if err != nil {
+			return err
+		}
+		if hash != dup.Hash {
+			return fmt.Errorf("%w: %s no longer has the contents it was matched by", ErrChanged, path)
+		}
+	}
+	return nil
+}
+
+// Summary totals the outcome of Apply.
+type Summary struct {
+	Replaced  int   // Destinations replaced, or that would be under DryRun
+	Reclaimed int64 // Bytes freed by those replacements
+	Errs      []error
+}
+
+// Err joins the errors of every failed replacement, or returns nil if none
+// failed.
+func (s Summary) Err() error {
+	return errors.Join(s.Errs...)
+}
+
+// Apply processes duplicates on a pool of opts.Jobs workers and returns how
+// many were replaced, the space reclaimed, and the errors of every
+// replacement that failed. Results are reported in the order of duplicates
+// whatever order the workers finish in, so the output is the same from run
+// to run. Once ctx is cancelled no new replacements start, while those
+// already in flight are allowed to finish.
+func Apply(ctx context.Context, duplicates []Duplicate, opts ApplyOptions) Summary {
+	var mu sync.Mutex // Guards summary, pending and next
+	var summary Summary
+	// Results that finished before those of earlier duplicates
+	pending := make(map[int]Result)
+	next := 0
+
+	type job struct {
+		index int
+		dup   Duplicate
+	}
+	jobs := max(opts.Jobs, 1)
+	work := make(chan job)
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+
+	for i := 0; i < jobs; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				result := processDuplicate(j.dup, opts, opts.OpenLimit)
+				mu.Lock()
+				pending[j.index] = result
+				for {
+					result, ready := pending[next]
+					if !ready {
+						break
+					}
+					delete(pending, next)
+					next++
+					if opts.OnResult != nil {
+						opts.OnResult(result)
+					}
+					switch result.Outcome {
+					case Replaced, Planned:
+						summary.Replaced++
+						summary.Reclaimed += result.Replacement.Reclaimed()
+					case Failed:
+						summary.Errs = append(summary.Errs, result.Err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i, dup := range duplicates {
+		select {
+		case work <- job{index: i, dup: dup}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+
+	wg.Wait()
+	return summary
+}
@@ -0,0 +1,635 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// applyBetween replaces the duplicates found between source and dest under
+// relpath matching with opts, failing the test if any replacement fails.
+func applyBetween(t *testing.T, source, dest string, opts ApplyOptions) Summary {
+	t.Helper()
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	summary := Apply(context.Background(), duplicates, opts)
+	if err := summary.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+// readFile returns the contents of the file at path, following symlinks.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestContentsEqual(t *testing.T) {
+	chunk := strings.Repeat("x", DefaultBufferSize)
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", "same contents", "same contents", true},
+		{"empty", "", "", true},
+		{"differ in the last byte", chunk + "a", chunk + "b", false},
+		{"one a prefix of the other", chunk, chunk + "more", false},
+		{"identical over several chunks", chunk + chunk + "end", chunk + chunk + "end", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"a": test.a, "b": test.b})
+			// A tiny buffer must give the same answer as the default
+			for _, bufSize := range []int{0, 3} {
+				equal, err := contentsEqual(filepath.Join(dir, "a"), filepath.Join(dir, "b"), bufSize, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if equal != test.want {
+					t.Errorf("contentsEqual with buffer %d = %v, want %v", bufSize, equal, test.want)
+				}
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a": "a"})
+	if _, err := contentsEqual(filepath.Join(dir, "a"), filepath.Join(dir, "missing"), 0, nil); err == nil {
+		t.Error("comparing against a missing file succeeded")
+	}
+}
+
+func TestApplyDryRun(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		dir := t.TempDir()
+		source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+		files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+		writeFiles(t, source, files)
+		writeFiles(t, dest, files)
+
+		summary := applyBetween(t, source, dest, ApplyOptions{Link: LinkSymlink, DryRun: dryRun})
+		if summary.Replaced != len(files) {
+			t.Errorf("dry run %v: replaced %d files, want %d", dryRun, summary.Replaced, len(files))
+		}
+		for relPath := range files {
+			if linked := isSymlink(filepath.Join(dest, relPath)); linked == dryRun {
+				t.Errorf("dry run %v: %s is a symlink = %v", dryRun, relPath, linked)
+			}
+		}
+	}
+}
+
+func TestReplaceLinkTypes(t *testing.T) {
+	for _, link := range []LinkType{LinkSymlink, LinkHardlink} {
+		t.Run(string(link), func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"source.txt": "same", "dest.txt": "same"})
+			dup := Duplicate{Source: filepath.Join(dir, "source.txt"), Destination: filepath.Join(dir, "dest.txt")}
+			if _, err := replace(dup, ApplyOptions{Link: link}); err != nil {
+				t.Fatal(err)
+			}
+			if linked := isSymlink(dup.Destination); linked != (link == LinkSymlink) {
+				t.Errorf("destination is a symlink = %v", linked)
+			}
+			if link == LinkHardlink {
+				sourceInfo, err := os.Stat(dup.Source)
+				if err != nil {
+					t.Fatal(err)
+				}
+				destInfo, err := os.Lstat(dup.Destination)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !os.SameFile(sourceInfo, destInfo) {
+					t.Error("destination isn't a hard link to the source")
+				}
+			}
+			if got := readFile(t, dup.Destination); got != "same" {
+				t.Errorf("destination reads %q, want %q", got, "same")
+			}
+		})
+	}
+}
+
+func TestRelativeLinkSurvivesRename(t *testing.T) {
+	dir := t.TempDir()
+	parent := filepath.Join(dir, "parent")
+	writeFiles(t, filepath.Join(parent, "source"), map[string]string{"photos/a.jpg": "photo"})
+	writeFiles(t, filepath.Join(parent, "dest"), map[string]string{"photos/a.jpg": "photo"})
+
+	summary := applyBetween(t, filepath.Join(parent, "source"), filepath.Join(parent, "dest"), ApplyOptions{Link: LinkSymlink, RelativeLinks: true})
+	if summary.Replaced != 1 {
+		t.Fatalf("replaced %d files, want 1", summary.Replaced)
+	}
+	link := filepath.Join(parent, "dest", "photos", "a.jpg")
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("..", "..", "source", "photos", "a.jpg"); target != want {
+		t.Errorf("link target = %q, want %q", target, want)
+	}
+
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(parent, moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(moved, "dest", "photos", "a.jpg")); got != "photo" {
+		t.Errorf("moved link reads %q, want %q", got, "photo")
+	}
+}
+
+func TestLinkBase(t *testing.T) {
+	dir := t.TempDir()
+	parent := filepath.Join(dir, "parent")
+	source, dest := filepath.Join(parent, "a", "source"), filepath.Join(parent, "b", "dest")
+	writeFiles(t, source, map[string]string{"photo.jpg": "photo", "other.jpg": "other"})
+	writeFiles(t, dest, map[string]string{"photo.jpg": "photo", "other.jpg": "other"})
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	if len(duplicates) != 2 {
+		t.Fatalf("found %d duplicates, want 2", len(duplicates))
+	}
+
+	// A base holding only the destination is refused, leaving it untouched
+	summary := Apply(context.Background(), duplicates[:1], ApplyOptions{Link: LinkSymlink, RelativeLinks: true, LinkBase: filepath.Join(parent, "b")})
+	if len(summary.Errs) != 1 || summary.Replaced != 0 {
+		t.Fatalf("replaced %d files with errors %v, want the link base refused", summary.Replaced, summary.Errs)
+	}
+	if isSymlink(duplicates[0].Destination) {
+		t.Errorf("%s was replaced despite the link base", duplicates[0].Destination)
+	}
+
+	summary = Apply(context.Background(), duplicates, ApplyOptions{Link: LinkSymlink, RelativeLinks: true, LinkBase: parent})
+	if err := summary.Err(); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(parent, moved); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"photo.jpg", "other.jpg"} {
+		if got, want := readFile(t, filepath.Join(moved, "b", "dest", name)), strings.TrimSuffix(name, ".jpg"); got != want {
+			t.Errorf("moved link %s reads %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestApplyBoundsConcurrency(t *testing.T) {
+	const jobs = 3
+	duplicates := make([]Duplicate, 50)
+	for i := range duplicates {
+		duplicates[i] = Duplicate{Source: "source" + strconv.Itoa(i), Destination: "dest" + strconv.Itoa(i)}
+	}
+
+	var running, peak atomic.Int32
+	opts := ApplyOptions{Jobs: jobs, ShouldReplace: func(Duplicate) bool {
+		n := running.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		return false
+	}}
+	Apply(context.Background(), duplicates, opts)
+
+	if got := peak.Load(); got > jobs {
+		t.Errorf("%d replacements ran at once, want at most %d", got, jobs)
+	}
+}
+
+func TestSecondRunIsNoOp(t *testing.T) {
+	for _, link := range []LinkType{LinkSymlink, LinkHardlink} {
+		t.Run(string(link), func(t *testing.T) {
+			dir := t.TempDir()
+			source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+			writeFiles(t, source, map[string]string{"a.txt": "same", "b/c.txt": "also same"})
+			writeFiles(t, dest, map[string]string{"a.txt": "same", "b/c.txt": "also same"})
+
+			duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+			if summary := Apply(context.Background(), duplicates, ApplyOptions{Link: link}); summary.Replaced != 2 {
+				t.Fatalf("first run replaced %d files, want 2", summary.Replaced)
+			}
+			linked, err := os.Lstat(filepath.Join(dest, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var alreadyLinked int
+			again := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath, OnHardLinked: func(Duplicate) { alreadyLinked++ }})
+			if len(again) != 0 {
+				t.Errorf("second scan found %d duplicates, want 0", len(again))
+			}
+			if link == LinkHardlink && alreadyLinked != 2 {
+				t.Errorf("second scan reported %d files already hard-linked, want 2", alreadyLinked)
+			}
+			// Replaying the first run's duplicates finds every one already linked
+			var outcomes []Outcome
+			summary := Apply(context.Background(), duplicates, ApplyOptions{Link: link, OnResult: func(r Result) {
+				outcomes = append(outcomes, r.Outcome)
+			}})
+			if summary.Replaced != 0 || summary.Err() != nil {
+				t.Errorf("second run replaced %d files with error %v, want none", summary.Replaced, summary.Err())
+			}
+			for i, outcome := range outcomes {
+				if outcome != SkippedLinked {
+					t.Errorf("outcome %d = %v, want SkippedLinked", i, outcome)
+				}
+			}
+			if after, err := os.Lstat(filepath.Join(dest, "a.txt")); err != nil || !os.SameFile(linked, after) {
+				t.Errorf("second run relinked dest/a.txt (%v)", err)
+			}
+		})
+	}
+}
+
+func TestReplacementRecordsMetadata(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same"})
+	destPath := filepath.Join(dest, "a.txt")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chmod(destPath, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(destPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	var replacement Replacement
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	Apply(context.Background(), duplicates, ApplyOptions{Link: LinkSymlink, PreserveTimes: true, OnResult: func(r Result) {
+		replacement = r.Replacement
+	}})
+
+	if replacement.Mode.Perm() != 0o600 {
+		t.Errorf("recorded mode = %v, want %v", replacement.Mode.Perm(), os.FileMode(0o600))
+	}
+	if !replacement.ModTime.Equal(modTime) {
+		t.Errorf("recorded modification time = %v, want %v", replacement.ModTime, modTime)
+	}
+	info, err := os.Lstat(destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("destination wasn't replaced by a symlink")
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("symlink modification time = %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestReclaimed(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement Replacement
+		want        int64
+	}{
+		{"symlink", Replacement{Duplicate: Duplicate{Size: 100}, Link: LinkSymlink, Target: "../a.txt"}, 92},
+		{"symlink longer than file", Replacement{Duplicate: Duplicate{Size: 3}, Link: LinkSymlink, Target: "../a.txt"}, 0},
+		{"hardlink", Replacement{Duplicate: Duplicate{Size: 100}, Link: LinkHardlink, Target: "a.txt"}, 100},
+		{"delete", Replacement{Duplicate: Duplicate{Size: 100}, Link: LinkDelete}, 100},
+	}
+	for _, test := range tests {
+		if got := test.replacement.Reclaimed(); got != test.want {
+			t.Errorf("%s: Reclaimed() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplySurfacesFailures(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "one", "b.txt": "two"})
+	writeFiles(t, dest, map[string]string{"a.txt": "one", "b.txt": "two"})
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	// The source of one duplicate disappears before it is replaced
+	if err := os.Remove(filepath.Join(source, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []Result
+	summary := Apply(context.Background(), duplicates, ApplyOptions{OnResult: func(r Result) {
+		if r.Outcome == Failed {
+			failed = append(failed, r)
+		}
+	}})
+	if summary.Replaced != 1 {
+		t.Errorf("replaced %d files, want 1", summary.Replaced)
+	}
+	if len(summary.Errs) != 1 || summary.Err() == nil {
+		t.Fatalf("got errors %v, want one", summary.Errs)
+	}
+	if len(failed) != 1 || failed[0].Err == nil || failed[0].Destination != filepath.Join(dest, "b.txt") {
+		t.Errorf("failed results = %+v, want one for b.txt with its error", failed)
+	}
+	if got := readFile(t, filepath.Join(dest, "b.txt")); got != "two" {
+		t.Errorf("failed destination holds %q, want it untouched", got)
+	}
+}
+
+// leftoverTemps returns the temporary link names left in dir.
+func leftoverTemps(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, ".dedup-link-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestReplaceAtomically(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"source.txt": "same", "dest.txt": "same"})
+	dup := Duplicate{Source: filepath.Join(dir, "source.txt"), Destination: filepath.Join(dir, "dest.txt"), RelPath: "dest.txt"}
+
+	// Until the rename, the destination is still the original file
+	_, err := replaceAtomically(dup, "", func(tempPath string) error {
+		if err := os.Symlink(dup.Source, tempPath); err != nil {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+		if isSymlink(dup.Destination) || readFile(t, dup.Destination) != "same" {
+			t.Error("destination was changed before the link was renamed over it")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSymlink(dup.Destination) {
+		t.Error("destination wasn't replaced by the link")
+	}
+	if temps := leftoverTemps(t, dir); len(temps) != 0 {
+		t.Errorf("temporary links left behind: %q", temps)
+	}
+}
+
+func TestReplaceAtomicallyFailureKeepsOriginal(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"source.txt": "same", "dest.txt": "same", "full/child": "x"})
+	trash := filepath.Join(dir, "trash")
+
+	// The link can't be created
+	dup := Duplicate{Source: filepath.Join(dir, "source.txt"), Destination: filepath.Join(dir, "dest.txt"), RelPath: "dest.txt"}
+	if _, err := replaceAtomically(dup, trash, func(string) error { return os.ErrPermission }); err == nil {
+		t.Fatal("replaceAtomically succeeded though the link couldn't be created")
+	}
+	if isSymlink(dup.Destination) || readFile(t, dup.Destination) != "same" {
+		t.Error("destination was lost when the link couldn't be created")
+	}
+	if _, err := os.Stat(filepath.Join(trash, "dest.txt")); !os.IsNotExist(err) {
+		t.Errorf("the trash still holds a copy of the untouched destination: %v", err)
+	}
+
+	// The link can't be renamed over the destination, a non-empty directory
+	dup = Duplicate{Source: filepath.Join(dir, "source.txt"), Destination: filepath.Join(dir, "full"), RelPath: "full"}
+	_, err := replaceAtomically(dup, "", func(tempPath string) error { return os.Symlink(dup.Source, tempPath) })
+	if err == nil {
+		t.Fatal("replaceAtomically renamed a link over a non-empty directory")
+	}
+	if got := readFile(t, filepath.Join(dir, "full", "child")); got != "x" {
+		t.Errorf("destination directory lost its contents: %q", got)
+	}
+	if temps := leftoverTemps(t, dir); len(temps) != 0 {
+		t.Errorf("temporary links left behind: %q", temps)
+	}
+}
+
+func TestApplyActions(t *testing.T) {
+	tests := []struct {
+		name  string
+		link  LinkType
+		trash bool
+		check func(t *testing.T, source, dest, trash string)
+	}{
+		{"symlink", LinkSymlink, false, func(t *testing.T, source, dest, trash string) {
+			if target, err := os.Readlink(dest); err != nil || target != source {
+				t.Errorf("destination links to %q (%v), want %q", target, err, source)
+			}
+		}},
+		{"hardlink", LinkHardlink, false, func(t *testing.T, source, dest, trash string) {
+			sourceInfo, err := os.Lstat(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destInfo, err := os.Lstat(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(sourceInfo, destInfo) {
+				t.Error("destination isn't a hard link to the source")
+			}
+		}},
+		{"delete", LinkDelete, false, func(t *testing.T, source, dest, trash string) {
+			if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+				t.Errorf("destination is still there: %v", err)
+			}
+		}},
+		{"delete to trash", LinkDelete, true, func(t *testing.T, source, dest, trash string) {
+			if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+				t.Errorf("destination is still there: %v", err)
+			}
+			if got := readFile(t, filepath.Join(trash, "a.txt")); got != "same" {
+				t.Errorf("trashed file holds %q, want %q", got, "same")
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source, dest, trash := filepath.Join(dir, "source"), filepath.Join(dir, "dest"), filepath.Join(dir, "trash")
+			writeFiles(t, source, map[string]string{"a.txt": "same"})
+			writeFiles(t, dest, map[string]string{"a.txt": "same"})
+			opts := ApplyOptions{Link: test.link}
+			if test.trash {
+				opts.TrashDir = trash
+			}
+
+			if summary := applyBetween(t, source, dest, opts); summary.Replaced != 1 {
+				t.Fatalf("replaced %d files, want 1", summary.Replaced)
+			}
+			test.check(t, filepath.Join(source, "a.txt"), filepath.Join(dest, "a.txt"), trash)
+			if got := readFile(t, filepath.Join(source, "a.txt")); got != "same" {
+				t.Errorf("source holds %q, want it untouched", got)
+			}
+		})
+	}
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a": "a", "b": "b", "c": "c", "sub/d": "d", "sub/e": "e"})
+	writeFiles(t, dest, map[string]string{"a": "a", "b": "b", "sub/d": "d", "sub/e": "changed", "f": "f", "sub/g": "g"})
+
+	var sourceScanned, destScanned, found, asked atomic.Int64
+	sourceFiles, destFiles, _, err := ScanAll(ctx, []string{source}, []string{dest}, ScanOptions{
+		Jobs:       4,
+		OnFile:     func(*FileMetadata) { sourceScanned.Add(1) },
+		OnDestFile: func(*FileMetadata) { destScanned.Add(1) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sourceScanned.Load() != 5 || destScanned.Load() != 6 {
+		t.Errorf("OnFile called %d times and OnDestFile %d, want 5 and 6", sourceScanned.Load(), destScanned.Load())
+	}
+
+	duplicates, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{
+		Mode:        MatchRelPath,
+		Jobs:        4,
+		OnDuplicate: func(Duplicate) { found.Add(1) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Load() != 3 {
+		t.Errorf("OnDuplicate called %d times, want 3", found.Load())
+	}
+
+	outcomes := make(map[Outcome]int)
+	summary := Apply(ctx, duplicates, ApplyOptions{
+		Link: LinkSymlink,
+		Jobs: 4,
+		ShouldReplace: func(dup Duplicate) bool {
+			asked.Add(1)
+			return filepath.Base(dup.Destination) != "b"
+		},
+		OnResult: func(result Result) { outcomes[result.Outcome]++ },
+	})
+	if err := summary.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if asked.Load() != 3 {
+		t.Errorf("ShouldReplace called %d times, want 3", asked.Load())
+	}
+	if want := map[Outcome]int{Replaced: 2, Declined: 1}; !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("OnResult outcomes = %v, want %v", outcomes, want)
+	}
+	if summary.Replaced != 2 {
+		t.Errorf("replaced %d files, want 2", summary.Replaced)
+	}
+}
+
+func TestApplySkipsChangedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(t *testing.T, source, dest string)
+	}{
+		{"source grew", func(t *testing.T, source, dest string) {
+			writeFiles(t, filepath.Dir(source), map[string]string{"a.txt": "same, then more"})
+		}},
+		{"destination grew", func(t *testing.T, source, dest string) {
+			writeFiles(t, filepath.Dir(dest), map[string]string{"a.txt": "same, then more"})
+		}},
+		{"destination rewritten in place", func(t *testing.T, source, dest string) {
+			writeFiles(t, filepath.Dir(dest), map[string]string{"a.txt": "Same"})
+			setModTime(t, dest, time.Now().Add(time.Hour))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+			writeFiles(t, source, map[string]string{"a.txt": "same"})
+			writeFiles(t, dest, map[string]string{"a.txt": "same"})
+			duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+			if len(duplicates) != 1 {
+				t.Fatalf("found %d duplicates, want 1", len(duplicates))
+			}
+			test.mutate(t, duplicates[0].Source, duplicates[0].Destination)
+			want := readFile(t, duplicates[0].Destination)
+
+			var results []Result
+			summary := Apply(context.Background(), duplicates, ApplyOptions{
+				Link:     LinkSymlink,
+				OnResult: func(result Result) { results = append(results, result) },
+			})
+			if summary.Replaced != 0 || len(results) != 1 || results[0].Outcome != SkippedChanged {
+				t.Fatalf("replaced %d files with results %+v, want the duplicate skipped as changed", summary.Replaced, results)
+			}
+			if !errors.Is(results[0].Err, ErrChanged) {
+				t.Errorf("result error = %v, want ErrChanged", results[0].Err)
+			}
+			if isSymlink(duplicates[0].Destination) || readFile(t, duplicates[0].Destination) != want {
+				t.Error("the changed destination was replaced")
+			}
+		})
+	}
+}
+
+func TestApplyRefusesBrokenSource(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"target.txt": "same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same"})
+	symlink(t, filepath.Join(source, "target.txt"), filepath.Join(source, "a.txt"))
+	ctx := context.Background()
+	sourceFiles, destFiles, _, err := ScanAll(ctx, []string{source}, []string{dest}, ScanOptions{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil || len(duplicates) != 1 {
+		t.Fatalf("found %d duplicates (%v), want the symlinked source paired", len(duplicates), err)
+	}
+	// The source's target goes away after the scan
+	if err := os.Remove(filepath.Join(source, "target.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := Apply(ctx, duplicates, ApplyOptions{Link: LinkSymlink})
+	if summary.Replaced != 0 || len(summary.Errs) != 1 || !strings.Contains(summary.Errs[0].Error(), "broken symlink") {
+		t.Errorf("replaced %d files with errors %v, want the broken source refused", summary.Replaced, summary.Errs)
+	}
+	if isSymlink(filepath.Join(dest, "a.txt")) || readFile(t, filepath.Join(dest, "a.txt")) != "same" {
+		t.Error("the destination was replaced by a link to a broken symlink")
+	}
+}
+
+func TestApplyCancelled(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+	writeFiles(t, source, files)
+	writeFiles(t, dest, files)
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := Scan(ctx, source, ScanOptions{Jobs: 1}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Scan err = %v, want %v", err, context.Canceled)
+	}
+	if _, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath}); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindDuplicates err = %v, want %v", err, context.Canceled)
+	}
+	summary := Apply(ctx, duplicates, ApplyOptions{Link: LinkSymlink})
+	if summary.Replaced != 0 || len(summary.Errs) != 0 {
+		t.Errorf("replaced %d files with errors %v after cancelling", summary.Replaced, summary.Errs)
+	}
+	for relPath := range files {
+		if isSymlink(filepath.Join(dest, relPath)) {
+			t.Errorf("%s was replaced after cancelling", relPath)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package dedup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveSeparator joins the path of an archive and the name of one of its
+// members in the virtual paths ScanOptions.InspectArchives gives members, as
+// in "photos.zip!/2019/beach.jpg".
+const ArchiveSeparator = "!"
+
+// isArchive reports whether the name of the file at path is that of an
+// archive InspectArchives lists the members of.
+func isArchive(path string) bool {
+	name := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// memberPath returns the virtual path of the member called name in the
+// archive at archive. Names are cleaned so no member can climb out of its
+// archive with "..".
+func memberPath(archive, name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return archive + ArchiveSeparator + string(filepath.Separator) + filepath.FromSlash(name)
+}
+
+// InArchive reports whether fm is a member of an archive rather than a file
+// on disk, in which case Path is virtual and the file can't be replaced.
+func (fm *FileMetadata) InArchive() bool {
+	return fm.archive != ""
+}
+
+// hashMember hashes the contents of an archive member through fm.open.
+func (fm *FileMetadata) hashMember() (string, error) {
+	r, err := fm.open()
+	if err != nil {
+		return "", fmt.Errorf("error opening file %s: %w", fm.Path, err)
+	}
+	defer r.Close()
+	return fm.hashReader(r)
+}
+
+// hashReader hashes r, which holds the contents of fm, as fm is configured to.
+func (fm *FileMetadata) hashReader(r io.Reader) (string, error) {
+	return hashReader(r, fm.Path, fm.algorithm, fm.bufferSize, fm.readLimit, fm.prefix)
+}
+
+// addArchiveMembers records the regular files inside the archive at path,
+// found under key, that pass the size options. An archive that can't be
+// read is passed to Warn and otherwise skipped.
+func (w *walker) addArchiveMembers(files map[string]*FileMetadata, stats *ScanStats, key, path string) {
+	w.opts.OpenLimit.acquire(1)
+	defer w.opts.OpenLimit.release(1)
+
+	var err error
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err = w.addZipMembers(files, stats, key, path)
+	} else {
+		err = w.addTarMembers(files, stats, key, path)
+	}
+	if err != nil {
+		warn(w.opts.Warn, fmt.Errorf("could not list archive %s: %w", path, err))
+	}
+}
+
+// newMember describes the member called name of the archive at archive,
+// found under key.
+func (w *walker) newMember(key, archive, name string, size int64, modTime time.Time) *FileMetadata {
+	return &FileMetadata{
+		Size:       size,
+		Path:       memberPath(archive, name),
+		RelPath:    memberPath(key, name),
+		ModTime:    modTime,
+		algorithm:  w.opts.Hash,
+		bufferSize: w.opts.BufferSize,
+		readLimit:  w.opts.ReadLimit,
+		prefix:     w.opts.PrefixHash,
+		archive:    archive,
+	}
+}
+
+// addZipMembers records the members of a zip archive. Their contents are
+// only read if they need to be hashed, by reopening the archive.
+func (w *walker) addZipMembers(files map[string]*FileMetadata, stats *ScanStats, key, path string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for i, file := range archive.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		size := int64(file.UncompressedSize64)
+		if !w.keepSize(stats, size) {
+			continue
+		}
+		metadata := w.newMember(key, path, file.Name, size, file.Modified)
+		metadata.open = func() (io.ReadCloser, error) {
+			return openZipMember(path, i)
+		}
+		w.keep(files, metadata.RelPath, metadata)
+	}
+	return nil
+}
+
+// openZipMember opens the i-th member of the zip archive at path. Closing it
+// also closes the archive.
+func openZipMember(path string, i int) (io.ReadCloser, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	if i >= len(archive.File) {
+		archive.Close()
+		return nil, errors.New("archive changed since it was scanned")
+	}
+	member, err := archive.File[i].Open()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{member, closeBoth{member, archive}}, nil
+}
+
+// closeBoth closes two closers, returning the first error.
+type closeBoth [2]io.Closer
+
+func (c closeBoth) Close() error {
+	err := c[0].Close()
+	if err2 := c[1].Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// addTarMembers records the members of a tar archive, gzip-compressed if its
+// name says so. A tar archive can only be read from the start, so every
+// member kept is hashed now rather than when it is compared.
+func (w *walker) addTarMembers(files map[string]*FileMetadata, stats *ScanStats, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if name := strings.ToLower(path); strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !w.keepSize(stats, header.Size) {
+			continue
+		}
+		metadata := w.newMember(key, path, header.Name, header.Size, header.ModTime)
+		if metadata.hash, err = metadata.hashReader(archive); err != nil {
+			return err
+		}
+		w.keep(files, metadata.RelPath, metadata)
+	}
+}
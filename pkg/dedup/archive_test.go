@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeZip creates a zip archive at path holding members, keyed by name.
+func writeZip(t *testing.T, path string, members map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for name, contents := range members {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanInspectArchives(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeZip(t, filepath.Join(source, "photos.zip"), map[string]string{
+		"2019/beach.jpg": "beach",
+		"notes.txt":      "notes",
+		"../escape.txt":  "escape",
+		"2019/":          "",
+	})
+	writeFiles(t, dest, map[string]string{"holiday/beach.jpg": "beach", "notes.txt": "other notes"})
+
+	if got := scanFiles(t, source, ScanOptions{}); !reflect.DeepEqual(got, []string{"photos.zip"}) {
+		t.Errorf("without InspectArchives found %q, want only the archive", got)
+	}
+	sourceFiles, _, err := Scan(context.Background(), source, ScanOptions{InspectArchives: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"photos.zip", "photos.zip!/2019/beach.jpg", "photos.zip!/escape.txt", "photos.zip!/notes.txt"}
+	if got := relPaths(sourceFiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("with InspectArchives found %q, want %q", got, want)
+	}
+	for _, metadata := range sourceFiles {
+		if inArchive := metadata.RelPath != "photos.zip"; metadata.InArchive() != inArchive {
+			t.Errorf("%s: InArchive() = %v, want %v", metadata.RelPath, metadata.InArchive(), inArchive)
+		}
+	}
+
+	_, destFiles, _, err := ScanAll(context.Background(), nil, []string{dest}, ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchContent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDup := filepath.Join(dest, "holiday", "beach.jpg") + " <- " + memberPath(filepath.Join(source, "photos.zip"), "2019/beach.jpg")
+	if len(duplicates) != 1 || duplicates[0].Destination+" <- "+duplicates[0].Source != wantDup {
+		t.Errorf("duplicates = %+v, want %s", duplicates, wantDup)
+	}
+}
@@ -0,0 +1,103 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fixtureFileSize is the size of every file written by writeFixture.
+const fixtureFileSize = 4096
+
+// writeFixture creates source and destination trees under a temporary
+// directory, each holding files files of fixtureFileSize bytes spread over
+// directories of 100. The first duplicated share of the destination files
+// have the same contents as the source file at their path; the rest differ
+// in their last byte only, so telling them apart takes a full hash.
+func writeFixture(tb testing.TB, files int, duplicated float64) (source, dest string) {
+	tb.Helper()
+	dir := tb.TempDir()
+	source, dest = filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	rng := rand.New(rand.NewPCG(1, 2))
+	contents := make([]byte, fixtureFileSize)
+	for i := range files {
+		relPath := filepath.Join(fmt.Sprintf("dir%03d", i/100), fmt.Sprintf("file%05d", i))
+		for j := range contents {
+			contents[j] = byte(rng.Uint32())
+		}
+		writeFixtureFile(tb, filepath.Join(source, relPath), contents)
+		if float64(i) >= duplicated*float64(files) {
+			contents[len(contents)-1]++
+		}
+		writeFixtureFile(tb, filepath.Join(dest, relPath), contents)
+	}
+	return source, dest
+}
+
+func writeFixtureFile(tb testing.TB, path string, contents []byte) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func BenchmarkGetFiles(b *testing.B) {
+	source, _ := writeFixture(b, 1000, 0.5)
+	b.ResetTimer()
+	for range b.N {
+		if _, _, err := Scan(context.Background(), source, ScanOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindDuplicates(b *testing.B) {
+	ctx := context.Background()
+	source, dest := writeFixture(b, 1000, 0.5)
+	b.ResetTimer()
+	for range b.N {
+		// Hashes are kept on the files, so every round needs a fresh scan
+		b.StopTimer()
+		sourceFiles, destFiles, _, err := ScanAll(ctx, []string{source}, []string{dest}, ScanOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		duplicates, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(duplicates) != 500 {
+			b.Fatalf("found %d duplicates, want 500", len(duplicates))
+		}
+	}
+}
+
+func BenchmarkHashFile(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "file")
+	contents := make([]byte, 1<<20)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range contents {
+		contents[i] = byte(rng.Uint32())
+	}
+	writeFixtureFile(b, path, contents)
+
+	for _, algorithm := range []HashAlgorithm{HashXXH64, HashSHA256, HashMD5} {
+		b.Run(string(algorithm), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(contents)))
+			for range b.N {
+				if _, err := HashFile(path, algorithm, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package dedup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheEntry is the hash of a file as it was when the hash was computed.
+type cacheEntry struct {
+	Size      int64         `json:"size"`
+	ModTime   time.Time     `json:"mod_time"`
+	Algorithm HashAlgorithm `json:"algorithm"`
+	Hash      string        `json:"hash"`
+}
+
+// HashCache remembers file hashes between runs, keyed by absolute path. An
+// entry is only reused while the file's size and modification time are
+// unchanged and the same hash algorithm is asked for. It is safe for
+// concurrent use.
+type HashCache struct {
+	path string
+
+	mu      sync.Mutex // Guards entries, hits and misses
+	entries map[string]cacheEntry
+	hits    int
+	misses  int
+}
+
+// NewHashCache returns an empty cache that Save writes to path.
+func NewHashCache(path string) *HashCache {
+	return &HashCache{path: path, entries: make(map[string]cacheEntry)}
+}
+
+// LoadHashCache reads the cache stored at path. A missing file gives an
+// empty cache, since the first run has nothing to reuse.
+func LoadHashCache(path string) (*HashCache, error) {
+	cache := NewHashCache(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("error parsing cache %s: %w", path, err)
+	}
+	return cache, nil
+}
+
+// lookup returns the cached hash of the file at path if it was computed with
+// algorithm when the file had the given size and modification time.
+func (c *HashCache) lookup(path string, size int64, modTime time.Time, algorithm HashAlgorithm) (string, bool) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.entries[key]
+	if !exists || entry.Size != size || !entry.ModTime.Equal(modTime) || entry.Algorithm != algorithm {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	return entry.Hash, true
+}
+
+func (c *HashCache) store(path string, size int64, modTime time.Time, algorithm HashAlgorithm, hash string) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{Size: size, ModTime: modTime, Algorithm: algorithm, Hash: hash}
+}
+
+// Stats returns how many hashes were reused from the cache and how many had
+// to be computed.
+func (c *HashCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Save writes the cache back to its path, first dropping the entries of
+// files that were deleted or changed since they were hashed. The file is
+// replaced by a rename, so an interrupted save keeps the previous cache.
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		info, err := os.Stat(key)
+		if err != nil || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+			delete(c.entries, key)
+		}
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("error encoding cache: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(c.path), ".dedup-cache-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for cache %s: %w", c.path, err)
+	}
+	tempPath := temp.Name()
+	// Clean up the temporary file unless it was renamed into place
+	defer os.Remove(tempPath)
+
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing cache %s: %w", c.path, err)
+	}
+
+	if err := os.Rename(tempPath, c.path); err != nil {
+		return fmt.Errorf("error replacing cache %s: %w", c.path, err)
+	}
+	return nil
+}
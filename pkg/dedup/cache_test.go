@@ -0,0 +1,61 @@
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// findCached finds the duplicates between source and dest as findBetween
+// does, reusing and updating the hashes in the cache at cachePath, and
+// returns the number of duplicates and the cache's hits and misses.
+func findCached(t *testing.T, source, dest, cachePath string) (found, hits, misses int) {
+	t.Helper()
+	cache, err := LoadHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sourceFiles, destFiles, _, err := ScanAll(ctx, []string{source}, []string{dest}, ScanOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	hits, misses = cache.Stats()
+	return len(duplicates), hits, misses
+}
+
+func TestHashCache(t *testing.T) {
+	dir := t.TempDir()
+	source, dest, cachePath := filepath.Join(dir, "source"), filepath.Join(dir, "dest"), filepath.Join(dir, "cache.json")
+	writeFiles(t, source, map[string]string{"a.txt": "same", "b.txt": "different"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same", "b.txt": "DIFFERENT"})
+
+	if found, hits, misses := findCached(t, source, dest, cachePath); found != 1 || hits != 0 || misses != 4 {
+		t.Errorf("first run found %d duplicates with %d hits and %d misses, want 1, 0 and 4", found, hits, misses)
+	}
+	if found, hits, misses := findCached(t, source, dest, cachePath); found != 1 || hits != 4 || misses != 0 {
+		t.Errorf("second run found %d duplicates with %d hits and %d misses, want 1, 4 and 0", found, hits, misses)
+	}
+
+	// A changed file is hashed again, and only that file
+	path := filepath.Join(dest, "b.txt")
+	if err := os.WriteFile(path, []byte("different"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if found, hits, misses := findCached(t, source, dest, cachePath); found != 2 || hits != 3 || misses != 1 {
+		t.Errorf("after a change found %d duplicates with %d hits and %d misses, want 2, 3 and 1", found, hits, misses)
+	}
+}
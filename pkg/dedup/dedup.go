@@ -0,0 +1,369 @@
+// Package dedup finds files that are duplicated between directory trees, or
+// within a single tree, and replaces the copies with links to one kept file.
+//
+// A typical caller scans the trees, pairs their duplicates and applies the
+// replacements:
+//
+//	sources, dests, _, err := dedup.ScanAll(ctx, []string{"photos"}, []string{"backup"}, dedup.ScanOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	duplicates, err := dedup.FindDuplicates(ctx, sources, dests, dedup.MatchOptions{Mode: dedup.MatchRelPath})
+//	if err != nil {
+//		return err
+//	}
+//	summary := dedup.Apply(ctx, duplicates, dedup.ApplyOptions{Link: dedup.LinkSymlink})
+//
+// Run does the same in one call and returns a RunResult counting what each
+// phase did.
+//
+// Nothing in this package prints. Problems that don't stop an operation are
+// passed to the Warn callback of its options. Callers that drive a progress
+// display or their own prompts can set ScanOptions.OnFile,
+// MatchOptions.OnDuplicate, ApplyOptions.ShouldReplace and
+// ApplyOptions.OnResult, which receive every file kept, every duplicate
+// found, every duplicate about to be replaced and the outcome of each.
+package dedup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MatchMode decides which source and destination files are compared.
+type MatchMode string
+
+const (
+	MatchRelPath MatchMode = "relpath" // Same path relative to each root
+	MatchName    MatchMode = "name"    // Same base name anywhere in the tree
+	MatchContent MatchMode = "content" // Any file with the same contents
+
+	// MatchSizeMTime pairs files at the same relative path and trusts equal
+	// sizes and modification times instead of reading the contents.
+	MatchSizeMTime MatchMode = "size+mtime"
+)
+
+func ParseMatchMode(value string) (MatchMode, error) {
+	switch mode := MatchMode(value); mode {
+	case MatchRelPath, MatchName, MatchContent, MatchSizeMTime:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown match mode %q (expected relpath, name, content or size+mtime)", value)
+	}
+}
+
+// key returns the value two files must share to be compared under mode. With
+// ignoreCase, names that differ only in case share a key, and with normalize,
+// names that are equal once converted to NFC do.
+func (mode MatchMode) key(relPath string, ignoreCase, normalize bool) string {
+	var key string
+	switch mode {
+	case MatchName:
+		key = filepath.Base(relPath)
+	case MatchContent:
+		return ""
+	default:
+		key = relPath
+	}
+	if normalize {
+		key = norm.NFC.String(key)
+	}
+	if ignoreCase {
+		key = foldCase(key)
+	}
+	return key
+}
+
+// foldCase maps every rune of s to the smallest rune it is case-equivalent
+// to, so two strings fold to the same value exactly when strings.EqualFold
+// considers them equal.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		smallest := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			smallest = min(smallest, f)
+		}
+		return smallest
+	}, s)
+}
+
+// LinkType is the kind of link that replaces a duplicate destination, or
+// LinkDelete to remove the destination without leaving a link.
+type LinkType string
+
+const (
+	LinkSymlink  LinkType = "symlink"
+	LinkHardlink LinkType = "hardlink"
+	LinkDelete   LinkType = "delete" // The source elsewhere is the only copy left
+)
+
+func ParseLinkType(value string) (LinkType, error) {
+	switch link := LinkType(value); link {
+	case LinkSymlink, LinkHardlink, LinkDelete:
+		return link, nil
+	default:
+		return "", fmt.Errorf("unknown action %q (expected symlink, hardlink or delete)", value)
+	}
+}
+
+// KeepPolicy chooses the canonical copy that the other copies link to.
+type KeepPolicy string
+
+const (
+	KeepFirst        KeepPolicy = "first"  // First in path order, or the source between trees
+	KeepSource       KeepPolicy = "source" // The source; only between trees
+	KeepDest         KeepPolicy = "dest"   // The first destination in path order; only between trees
+	KeepOldest       KeepPolicy = "oldest"
+	KeepNewest       KeepPolicy = "newest"
+	KeepShortestPath KeepPolicy = "shortest-path"
+	KeepLongestPath  KeepPolicy = "longest-path"
+)
+
+func ParseKeepPolicy(value string) (KeepPolicy, error) {
+	switch policy := KeepPolicy(value); policy {
+	case KeepFirst, KeepSource, KeepDest, KeepOldest, KeepNewest, KeepShortestPath, KeepLongestPath:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown keep policy %q (expected first, source, dest, oldest, newest, shortest-path or longest-path)", value)
+	}
+}
+
+// NeedsTrees reports whether policy only applies between a source and a
+// destination tree.
+func (policy KeepPolicy) NeedsTrees() bool {
+	return policy == KeepSource || policy == KeepDest
+}
+
+// Direction chooses which side of each duplicate found between trees is
+// replaced by a link to the other.
+type Direction string
+
+const (
+	SourceWins Direction = "source-wins" // Destinations are linked to their sources
+	DestWins   Direction = "dest-wins"   // Sources are linked to their destinations
+)
+
+func ParseDirection(value string) (Direction, error) {
+	switch direction := Direction(value); direction {
+	case SourceWins, DestWins:
+		return direction, nil
+	default:
+		return "", fmt.Errorf("unknown direction %q (expected source-wins or dest-wins)", value)
+	}
+}
+
+// prefers reports whether a should be kept over b. Ties are broken by path so
+// the choice never depends on scan order.
+func (policy KeepPolicy) prefers(a, b *FileMetadata) bool {
+	switch policy {
+	case KeepOldest:
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.Before(b.ModTime)
+		}
+	case KeepNewest:
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.After(b.ModTime)
+		}
+	case KeepShortestPath:
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) < len(b.Path)
+		}
+	case KeepLongestPath:
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+	}
+	return a.Path < b.Path
+}
+
+// FileMetadata describes a regular file found by a scan.
+type FileMetadata struct {
+	Size    int64
+	Path    string // Full path to the file
+	RelPath string // Path relative to the scanned root
+	ModTime time.Time
+
+	hash       string        // Hash of the contents, populated lazily by ContentHash
+	algorithm  HashAlgorithm // Algorithm hash is computed with
+	bufferSize int           // Bytes read at a time while hashing
+	dev        uint64        // Device holding the file, if hasID
+	ino        uint64        // Inode of the file on dev, if hasID
+	hasID      bool          // Whether the platform reported dev and ino
+	cache      *HashCache    // Where hashes are reused from and stored, if set
+	readLimit  *ReadLimiter  // Throttles reading the file to hash it, if set
+	prefix     int64         // Bytes hash covers if positive, rather than the whole file
+
+	// Archive holding the file, if it is a member found by InspectArchives,
+	// and, unless its hash was computed during the scan, how to read it
+	archive string
+	open    func() (io.ReadCloser, error)
+}
+
+// NewFileMetadata describes the file at path, found at relPath under the
+// scanned root, from its file info.
+func NewFileMetadata(relPath, path string, info os.FileInfo) *FileMetadata {
+	dev, ino, hasID := fileID(info)
+	return &FileMetadata{
+		Size:    info.Size(),
+		Path:    path,
+		RelPath: relPath,
+		ModTime: info.ModTime(),
+		dev:     dev,
+		ino:     ino,
+		hasID:   hasID,
+	}
+}
+
+// SameFile reports whether fm and other refer to the same file on disk, such
+// as when the source and destination trees overlap.
+func (fm *FileMetadata) SameFile(other *FileMetadata) bool {
+	if fm.hasID && other.hasID {
+		return fm.dev == other.dev && fm.ino == other.ino
+	}
+
+	absPath, err := filepath.Abs(fm.Path)
+	if err != nil {
+		return false
+	}
+	otherAbsPath, err := filepath.Abs(other.Path)
+	if err != nil {
+		return false
+	}
+	return absPath == otherAbsPath
+}
+
+// hardLinked reports whether fm and other are different names for the same
+// file, as hard links are. Two names only count as different if the
+// platform can tell the files apart by device and inode.
+func (fm *FileMetadata) hardLinked(other *FileMetadata) bool {
+	if !fm.hasID || !other.hasID || !fm.SameFile(other) {
+		return false
+	}
+	absPath, err := filepath.Abs(fm.Path)
+	if err != nil {
+		return false
+	}
+	otherAbsPath, err := filepath.Abs(other.Path)
+	if err != nil {
+		return false
+	}
+	return absPath != otherAbsPath
+}
+
+// ContentHash returns the hash of the file contents, reading the file only
+// the first time it is needed and only if the cache has no current hash.
+// Under ScanOptions.PrefixHash only the start of the file is hashed, and the
+// cache is neither read nor written, since it holds whole-file hashes.
+func (fm *FileMetadata) ContentHash() (string, error) {
+	if fm.hash != "" {
+		return fm.hash, nil
+	}
+	cache := fm.cache
+	if fm.prefix > 0 {
+		cache = nil
+	}
+	if cache != nil {
+		if hash, ok := cache.lookup(fm.Path, fm.Size, fm.ModTime, fm.algorithm); ok {
+			fm.hash = hash
+			return fm.hash, nil
+		}
+	}
+
+	var hash string
+	var err error
+	if fm.open != nil {
+		hash, err = fm.hashMember()
+	} else {
+		hash, err = hashFile(fm.Path, fm.algorithm, fm.bufferSize, fm.readLimit, fm.prefix)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fm.hash = hash
+	if cache != nil {
+		cache.store(fm.Path, fm.Size, fm.ModTime, fm.algorithm, fm.hash)
+	}
+	return fm.hash, nil
+}
+
+// exactHash returns the hash of fm if it is known and covers the whole file,
+// so it can be recorded with a duplicate, and "" otherwise.
+func (fm *FileMetadata) exactHash() string {
+	if fm.prefix > 0 && fm.Size > fm.prefix {
+		return ""
+	}
+	return fm.hash
+}
+
+// Equals reports whether fm and other have the same contents.
+func (fm *FileMetadata) Equals(other *FileMetadata) (bool, error) {
+	// Size is a cheap prefilter; only hash files that could be equal
+	if fm.Size != other.Size {
+		return false, nil
+	}
+	// Note: path is intentionally ignored in equality check
+
+	hash, err := fm.ContentHash()
+	if err != nil {
+		return false, err
+	}
+	otherHash, err := other.ContentHash()
+	if err != nil {
+		return false, err
+	}
+
+	return hash == otherHash, nil
+}
+
+// matches reports whether fm and other are duplicates under mode: the same
+// size and modification time for MatchSizeMTime, and the same contents
+// otherwise.
+func (fm *FileMetadata) matches(other *FileMetadata, mode MatchMode) (bool, error) {
+	if mode == MatchSizeMTime {
+		return fm.Size == other.Size && fm.ModTime.Equal(other.ModTime), nil
+	}
+	return fm.Equals(other)
+}
+
+// Duplicate pairs a destination file with the source file it duplicates.
+type Duplicate struct {
+	Source      string
+	Destination string
+	RelPath     string        // Destination path relative to its scanned root
+	Size        int64         // Bytes shared by both files
+	Hash        string        // Content hash, if one was computed
+	Algorithm   HashAlgorithm // Algorithm Hash was computed with
+
+	// Modification times the scan saw, so Apply can skip a pair if either
+	// file's size or time changed since. Zero if unknown, in which case that
+	// file isn't checked.
+	SourceModTime time.Time
+	DestModTime   time.Time
+}
+
+// sortByDestination orders duplicates by destination path, breaking ties by
+// source, so results don't depend on map iteration order.
+func sortByDestination(duplicates []Duplicate) {
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Destination != duplicates[j].Destination {
+			return duplicates[i].Destination < duplicates[j].Destination
+		}
+		return duplicates[i].Source < duplicates[j].Source
+	})
+}
+
+// warn passes err to fn if the caller asked for warnings.
+func warn(fn func(error), err error) {
+	if fn != nil {
+		fn(err)
+	}
+}
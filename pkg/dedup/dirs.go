@@ -0,0 +1,281 @@
+package dedup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DirDuplicate pairs a destination directory with the source directory whose
+// whole tree it duplicates: the same subdirectories and, at every relative
+// path, a file duplicating the source's.
+type DirDuplicate struct {
+	Source      string
+	Destination string
+	RelPath     string      // Destination path relative to its scanned root
+	Files       []Duplicate // The duplicates of the files in the tree, by destination
+}
+
+// Size returns the bytes held by the files of the destination tree.
+func (d DirDuplicate) Size() int64 {
+	var size int64
+	for _, dup := range d.Files {
+		size += dup.Size
+	}
+	return size
+}
+
+// dirCandidate collects the duplicates found below a destination directory.
+type dirCandidate struct {
+	source  string // Source directory every file must be duplicated from
+	relPath string
+	files   []Duplicate
+	valid   bool // Whether every file so far is duplicated from source
+}
+
+// FindDuplicateDirs finds the destination subdirectories whose trees
+// duplicates cover completely, and returns the topmost of them along with the
+// duplicates outside them. A directory only qualifies if its tree on disk
+// holds nothing but subdirectories and regular files, the source directory
+// holds exactly the same entries, and every file is a duplicate of the file
+// at the same place in the source. The scanned roots themselves are never
+// returned. Trees that can't be read are passed to warnFn and left to be
+// replaced file by file.
+func FindDuplicateDirs(duplicates []Duplicate, warnFn func(error)) ([]DirDuplicate, []Duplicate) {
+	candidates := make(map[string]*dirCandidate)
+	sources := make(map[string]string, len(duplicates)) // Destination file to source file
+	for _, dup := range duplicates {
+		sources[dup.Destination] = dup.Source
+		for relDir := filepath.Dir(dup.RelPath); relDir != "."; relDir = filepath.Dir(relDir) {
+			within, err := filepath.Rel(relDir, dup.RelPath)
+			if err != nil {
+				break
+			}
+			suffix := string(filepath.Separator) + within
+			destDir, ok := strings.CutSuffix(dup.Destination, suffix)
+			if !ok {
+				break
+			}
+			// Files named differently on each side can't be a whole tree
+			sourceDir, ok := strings.CutSuffix(dup.Source, suffix)
+
+			candidate, seen := candidates[destDir]
+			if !seen {
+				candidate = &dirCandidate{source: sourceDir, relPath: relDir, valid: ok}
+				candidates[destDir] = candidate
+			}
+			candidate.valid = candidate.valid && ok && candidate.source == sourceDir
+			candidate.files = append(candidate.files, dup)
+		}
+	}
+
+	dirs := make([]string, 0, len(candidates))
+	for dir, candidate := range candidates {
+		if candidate.valid {
+			dirs = append(dirs, dir)
+		}
+	}
+	// A parent sorts before its children, so the topmost match is taken.
+	// Its children needn't follow it directly, since "a b" sorts between
+	// "a" and "a/x", so every ancestor is checked.
+	sort.Strings(dirs)
+
+	var found []DirDuplicate
+	taken := make(map[string]bool) // Destinations of found
+	for _, dir := range dirs {
+		if hasAncestorIn(taken, dir) {
+			continue
+		}
+		candidate := candidates[dir]
+		same, err := sameTree(candidate.source, dir, sources)
+		if err != nil {
+			warn(warnFn, err)
+			continue
+		}
+		if !same {
+			continue
+		}
+		files := candidate.files
+		sortByDestination(files)
+		found = append(found, DirDuplicate{
+			Source:      candidate.source,
+			Destination: dir,
+			RelPath:     candidate.relPath,
+			Files:       files,
+		})
+		taken[dir] = true
+	}
+
+	if len(found) == 0 {
+		return nil, duplicates
+	}
+	var rest []Duplicate
+	for _, dup := range duplicates {
+		if !hasAncestorIn(taken, dup.Destination) {
+			rest = append(rest, dup)
+		}
+	}
+	return found, rest
+}
+
+// hasAncestorIn reports whether any directory above path is in dirs.
+func hasAncestorIn(dirs map[string]bool, path string) bool {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// sameTree reports whether the trees at sourceDir and destDir hold the same
+// subdirectories and regular files and nothing else, with every destination
+// file duplicating the source file at the same relative path according to
+// sources. Trees that overlap never match.
+func sameTree(sourceDir, destDir string, sources map[string]string) (bool, error) {
+	absSource, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve %s: %w", sourceDir, err)
+	}
+	absDest, err := filepath.Abs(destDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve %s: %w", destDir, err)
+	}
+	if isWithin(absSource, absDest) || isWithin(absDest, absSource) {
+		return false, nil
+	}
+
+	destEntries, err := treeEntries(destDir)
+	if err != nil {
+		return false, err
+	}
+	sourceEntries, err := treeEntries(sourceDir)
+	if err != nil {
+		return false, err
+	}
+	if destEntries == nil || sourceEntries == nil || len(destEntries) != len(sourceEntries) {
+		return false, nil
+	}
+	for rel, isDir := range destEntries {
+		sourceIsDir, ok := sourceEntries[rel]
+		if !ok || sourceIsDir != isDir {
+			return false, nil
+		}
+		if !isDir && sources[filepath.Join(destDir, rel)] != filepath.Join(sourceDir, rel) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// treeEntries lists every entry below root by its path relative to root,
+// recording whether it is a directory. It returns nil if the tree holds
+// anything but directories and regular files, such as a symlink.
+func treeEntries(root string) (map[string]bool, error) {
+	entries := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			entries = nil
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries[rel] = entry.IsDir()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory tree %s: %w", root, err)
+	}
+	return entries, nil
+}
+
+// ReplaceDir replaces the destination directory of dir, with everything in
+// it, by a symlink to the source directory. The trees are compared again
+// first, and an error wrapping ErrChanged is returned if they no longer
+// match or any file changed since the scan; with opts.Verify every file is
+// also compared byte by byte. Only opts.Link of LinkSymlink is supported,
+// and opts.TrashDir is not: the destination tree is removed. Under DryRun
+// nothing is modified. The returned Replacement describes the directory,
+// with the combined size of its files; it is also returned, with an error,
+// if the link was made but the old tree couldn't be removed.
+func ReplaceDir(dir DirDuplicate, opts ApplyOptions) (Replacement, error) {
+	if opts.Link != LinkSymlink {
+		return Replacement{}, fmt.Errorf("directories can only be replaced by symlinks, not %s", opts.Link)
+	}
+	if opts.TrashDir != "" {
+		return Replacement{}, fmt.Errorf("directories can't be kept in the trash")
+	}
+
+	sources := make(map[string]string, len(dir.Files))
+	for _, dup := range dir.Files {
+		sources[dup.Destination] = dup.Source
+		if _, err := checkDuplicateExists(dup); err != nil {
+			return Replacement{}, fmt.Errorf("%w: %s: %w", ErrChanged, dir.Destination, err)
+		}
+		if opts.Verify {
+			equal, err := contentsEqual(dup.Source, dup.Destination, opts.BufferSize, opts.ReadLimit)
+			if err != nil {
+				return Replacement{}, fmt.Errorf("error verifying %s: %w", dup.Destination, err)
+			}
+			if !equal {
+				return Replacement{}, fmt.Errorf("%w: contents of %s differ from %s", ErrChanged, dup.Destination, dup.Source)
+			}
+		}
+	}
+	same, err := sameTree(dir.Source, dir.Destination, sources)
+	if err != nil {
+		return Replacement{}, err
+	}
+	if !same {
+		return Replacement{}, fmt.Errorf("%w: %s no longer matches %s", ErrChanged, dir.Destination, dir.Source)
+	}
+
+	asFile := Duplicate{Source: dir.Source, Destination: dir.Destination, RelPath: dir.RelPath, Size: dir.Size()}
+	target, err := symlinkTarget(asFile, opts.RelativeLinks, opts.LinkBase)
+	if err != nil {
+		return Replacement{}, err
+	}
+	destInfo, err := os.Lstat(dir.Destination)
+	if err != nil {
+		return Replacement{}, err
+	}
+	r := newReplacement(asFile, LinkSymlink, target, destInfo)
+	if opts.DryRun {
+		return r, nil
+	}
+
+	// The tree is moved aside rather than removed until the link is in
+	// place, so a failure puts it back untouched
+	aside, err := createTemp(dir.Destination, func(tempPath string) error {
+		if _, err := os.Lstat(tempPath); err == nil {
+			return fs.ErrExist
+		}
+		return os.Rename(dir.Destination, tempPath)
+	})
+	if err != nil {
+		return Replacement{}, fmt.Errorf("failed to move %s aside: %w", dir.Destination, err)
+	}
+	if err := os.Symlink(target, dir.Destination); err != nil {
+		if restoreErr := os.Rename(aside, dir.Destination); restoreErr != nil {
+			return Replacement{}, fmt.Errorf("failed to create symlink from %s to %s: %w; the original tree is at %s", dir.Destination, dir.Source, err, aside)
+		}
+		return Replacement{}, fmt.Errorf("failed to create symlink from %s to %s: %w", dir.Destination, dir.Source, err)
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		return r, fmt.Errorf("replaced %s, but failed to remove the original tree at %s: %w", dir.Destination, aside, err)
+	}
+	return r, nil
+}
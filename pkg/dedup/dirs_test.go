@@ -0,0 +1,102 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindDuplicateDirs(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{
+		"photos/a.jpg": "a", "photos/b.jpg": "b", "photos/sub/c.jpg": "c",
+		"docs/x.txt": "x", "docs/y.txt": "y",
+		"mixed/m.txt": "m",
+	})
+	writeFiles(t, dest, map[string]string{
+		"photos/a.jpg": "a", "photos/b.jpg": "b", "photos/sub/c.jpg": "c",
+		"docs/x.txt": "x", "docs/y.txt": "changed",
+		"mixed/m.txt": "m", "mixed/extra.txt": "only in the destination",
+	})
+
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	dirs, rest := FindDuplicateDirs(duplicates, func(err error) { t.Error(err) })
+	if len(dirs) != 1 || dirs[0].Source != filepath.Join(source, "photos") || dirs[0].Destination != filepath.Join(dest, "photos") {
+		t.Fatalf("duplicate directories = %+v, want only photos", dirs)
+	}
+	if len(dirs[0].Files) != 3 || dirs[0].Size() != 3 {
+		t.Errorf("photos holds %d files of %d bytes, want 3 of 3", len(dirs[0].Files), dirs[0].Size())
+	}
+	// Partly duplicated directories are left to be replaced file by file
+	if got, want := pairedPaths(t, dir, rest), []string{"dest/docs/x.txt <- source/docs/x.txt", "dest/mixed/m.txt <- source/mixed/m.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remaining duplicates = %q, want %q", got, want)
+	}
+
+	if _, err := ReplaceDir(dirs[0], ApplyOptions{Link: LinkSymlink, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if isSymlink(dirs[0].Destination) {
+		t.Fatal("a dry run replaced the directory")
+	}
+	r, err := ReplaceDir(dirs[0], ApplyOptions{Link: LinkSymlink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(dirs[0].Destination); err != nil || target != dirs[0].Source {
+		t.Errorf("dest/photos links to %q (%v), want %q", target, err, dirs[0].Source)
+	}
+	if r.Size != 3 {
+		t.Errorf("replacement size = %d, want 3", r.Size)
+	}
+	if got := readFile(t, filepath.Join(dest, "photos", "sub", "c.jpg")); got != "c" {
+		t.Errorf("dest/photos/sub/c.jpg reads %q through the link, want %q", got, "c")
+	}
+	if entries, err := os.ReadDir(dest); err != nil || len(entries) != 3 {
+		t.Errorf("dest holds %d entries (%v), want the moved-aside tree removed", len(entries), err)
+	}
+}
+
+func TestFindDuplicateDirsSiblingSortsBetween(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	// "a b" sorts between "a" and "a/x", since ' ' sorts before '/'
+	files := map[string]string{"a/f": "f", "a/x/g": "g", "a/y/f": "f2", "a b/h": "h"}
+	writeFiles(t, source, files)
+	writeFiles(t, dest, files)
+
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	dirs, rest := FindDuplicateDirs(duplicates, func(err error) { t.Error(err) })
+	var got []string
+	for _, found := range dirs {
+		got = append(got, found.RelPath)
+	}
+	if want := []string{"a", "a b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicate directories = %q, want %q", got, want)
+	}
+	if len(rest) != 0 {
+		t.Errorf("remaining duplicates = %q, want none", pairedPaths(t, dir, rest))
+	}
+}
+
+func TestReplaceDirChangedTree(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"photos/a.jpg": "a"})
+	writeFiles(t, dest, map[string]string{"photos/a.jpg": "a"})
+	dirs, _ := FindDuplicateDirs(findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath}), nil)
+	if len(dirs) != 1 {
+		t.Fatalf("found %d duplicate directories, want 1", len(dirs))
+	}
+
+	// A file added after the scan would be lost with the tree
+	writeFiles(t, filepath.Join(dest, "photos"), map[string]string{"new.jpg": "new"})
+	if _, err := ReplaceDir(dirs[0], ApplyOptions{Link: LinkSymlink}); !errors.Is(err, ErrChanged) {
+		t.Errorf("err = %v, want ErrChanged", err)
+	}
+	if isSymlink(dirs[0].Destination) || readFile(t, filepath.Join(dest, "photos", "new.jpg")) != "new" {
+		t.Error("the changed directory was replaced")
+	}
+}
@@ -0,0 +1,39 @@
+package dedup_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+func Example() {
+	dir, err := os.MkdirTemp("", "dedup-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tree := range []string{"photos", "backup"} {
+		os.MkdirAll(filepath.Join(dir, tree), 0o755)
+		os.WriteFile(filepath.Join(dir, tree, "beach.jpg"), []byte("waves"), 0o644)
+	}
+
+	ctx := context.Background()
+	sources, dests, _, err := dedup.ScanAll(ctx, []string{filepath.Join(dir, "photos")}, []string{filepath.Join(dir, "backup")}, dedup.ScanOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	duplicates, err := dedup.FindDuplicates(ctx, sources, dests, dedup.MatchOptions{Mode: dedup.MatchRelPath})
+	if err != nil {
+		log.Fatal(err)
+	}
+	summary := dedup.Apply(ctx, duplicates, dedup.ApplyOptions{Link: dedup.LinkHardlink})
+	if err := summary.Err(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Replaced %d files, reclaiming %d bytes\n", summary.Replaced, summary.Reclaimed)
+	// Output: Replaced 1 files, reclaiming 5 bytes
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dedup
+
+import "os"
+
+// fileID is not supported on this platform; callers fall back to comparing paths.
+func fileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
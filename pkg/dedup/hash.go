@@ -0,0 +1,93 @@
+package dedup
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashAlgorithm selects the hash used to compare file contents.
+type HashAlgorithm string
+
+const (
+	// HashXXH64 is a fast non-cryptographic hash and the default. Accidental
+	// collisions are unlikely but possible, so pair it with verification
+	// where a false match would be costly.
+	HashXXH64  HashAlgorithm = "xxh64"
+	HashSHA256 HashAlgorithm = "sha256"
+	HashMD5    HashAlgorithm = "md5"
+)
+
+func ParseHashAlgorithm(value string) (HashAlgorithm, error) {
+	switch algorithm := HashAlgorithm(value); algorithm {
+	case HashXXH64, HashSHA256, HashMD5:
+		return algorithm, nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q (expected xxh64, sha256 or md5)", value)
+	}
+}
+
+// newHash returns a hasher for algorithm, treating an empty algorithm as the
+// default.
+func (algorithm HashAlgorithm) newHash() hash.Hash {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New()
+	case HashMD5:
+		return md5.New()
+	default:
+		return xxhash.New()
+	}
+}
+
+// DefaultBufferSize is the number of bytes read from a file at a time when
+// hashing or verifying it, unless the options ask for another size.
+const DefaultBufferSize = 64 * 1024
+
+// bufferSize returns size, or DefaultBufferSize if size isn't positive.
+func bufferSize(size int) int {
+	if size <= 0 {
+		return DefaultBufferSize
+	}
+	return size
+}
+
+// HashFile returns the hex-encoded hash of the contents of the file at path
+// using algorithm. The file is streamed through a buffer of bufSize bytes, so
+// memory use doesn't grow with the file.
+func HashFile(path string, algorithm HashAlgorithm, bufSize int) (string, error) {
+	return hashFile(path, algorithm, bufSize, nil, 0)
+}
+
+// hashFile is HashFile with its reads throttled by limit, hashing only the
+// first prefix bytes of the file if prefix is positive.
+func hashFile(path string, algorithm HashAlgorithm, bufSize int, limit *ReadLimiter, prefix int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file %s: %w", path, err)
+	}
+	defer file.Close()
+	return hashReader(file, path, algorithm, bufSize, limit, prefix)
+}
+
+// hashReader hashes everything read from r, or its first prefix bytes if
+// prefix is positive, where r holds the contents of the file at path, as
+// hashFile does.
+func hashReader(r io.Reader, path string, algorithm HashAlgorithm, bufSize int, limit *ReadLimiter, prefix int64) (string, error) {
+	if prefix > 0 {
+		r = io.LimitReader(r, prefix)
+	}
+	hasher := algorithm.newHash()
+	buf := make([]byte, bufferSize(bufSize))
+	// Hide the file's WriteTo so the copy goes through buf
+	if _, err := io.CopyBuffer(hasher, struct{ io.Reader }{limit.reader(r)}, buf); err != nil {
+		return "", fmt.Errorf("error hashing file %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
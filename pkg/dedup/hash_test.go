@@ -0,0 +1,63 @@
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestHashFileStreamsLargeFile(t *testing.T) {
+	const size = 256 << 20
+	path := filepath.Join(t.TempDir(), "sparse")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncating past the end leaves a hole, so this takes no disk space
+	if err := file.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := HashFile(path, HashXXH64, 0); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("hashing a %d byte file allocated %d bytes, want at most 1 MiB", size, allocated)
+	}
+}
+
+func TestHashFileAlgorithms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		algorithm HashAlgorithm
+		want      string
+	}{
+		{HashXXH64, "26c7827d889f6da3"},
+		{HashSHA256, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{HashMD5, "5d41402abc4b2a76b9719d911017c592"},
+		{"", "26c7827d889f6da3"},
+	}
+	for _, test := range tests {
+		// A tiny buffer must give the same hash as the default
+		for _, bufSize := range []int{0, 2} {
+			got, err := HashFile(path, test.algorithm, bufSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("HashFile(%q, %d) = %s, want %s", test.algorithm, bufSize, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dedup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreRule is one pattern of an ignore file such as .dedupignore.
+type IgnoreRule struct {
+	Pattern string // Glob in the syntax of ScanOptions.Exclude
+	Negate  bool   // Re-include paths matched by earlier rules
+}
+
+// IgnoreRules are the rules of an ignore file in order. As in .gitignore,
+// the last rule matching a path decides whether it is ignored, and a file
+// can't be re-included once a directory above it is ignored.
+type IgnoreRules []IgnoreRule
+
+// ParseIgnoreRules reads ignore rules from r, one pattern per line. Blank
+// lines and lines starting with # are skipped, a leading ! negates the
+// pattern, and a leading backslash escapes a literal # or !. A trailing
+// slash is dropped, so the pattern matches files and directories alike.
+func ParseIgnoreRules(r io.Reader) (IgnoreRules, error) {
+	var rules IgnoreRules
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var rule IgnoreRule
+		if strings.HasPrefix(text, "!") {
+			rule.Negate = true
+			text = text[1:]
+		} else if strings.HasPrefix(text, `\#`) || strings.HasPrefix(text, `\!`) {
+			text = text[1:]
+		}
+		rule.Pattern = strings.TrimSuffix(text, "/")
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("line %d: empty pattern", line)
+		}
+		if err := ValidatePattern(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Ignores reports whether relPath is ignored by the rules.
+func (rules IgnoreRules) Ignores(relPath string) bool {
+	ignored := false
+	for _, rule := range rules {
+		if matchesAnyPattern(relPath, []string{rule.Pattern}) {
+			ignored = !rule.Negate
+		}
+	}
+	return ignored
+}
+
+// loadIgnoreRules reads the ignore file named name at root. A missing file
+// has no rules.
+func loadIgnoreRules(root, name string) (IgnoreRules, error) {
+	if name == "" {
+		return nil, nil
+	}
+	rules, err := ReadIgnoreFile(filepath.Join(root, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return rules, err
+}
+
+// ReadIgnoreFile reads the rules of the ignore file at path, in the syntax
+// ParseIgnoreRules accepts.
+func ReadIgnoreFile(path string) (IgnoreRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ignore file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	rules, err := ParseIgnoreRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore file %s: %w", path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,110 @@
+package dedup
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnoreRules(t *testing.T) {
+	input := strings.Join([]string{
+		"# build output",
+		"*.o",
+		"",
+		"build/",
+		"!build/keep.o",
+		" \t",
+		`\#literal`,
+		`\!bang`,
+		"trailing   ",
+	}, "\n")
+	rules, err := ParseIgnoreRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IgnoreRules{
+		{Pattern: "*.o"},
+		{Pattern: "build"},
+		{Pattern: "build/keep.o", Negate: true},
+		{Pattern: "#literal"},
+		{Pattern: "!bang"},
+		{Pattern: "trailing"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ParseIgnoreRules = %+v, want %+v", rules, want)
+	}
+
+	for _, bad := range []string{"!\n", "/\n", "[\n"} {
+		if _, err := ParseIgnoreRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseIgnoreRules(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIgnoreRulesIgnores(t *testing.T) {
+	rules := IgnoreRules{
+		{Pattern: "*.log"},
+		{Pattern: "important.log", Negate: true},
+		{Pattern: "cache"},
+	}
+	tests := []struct {
+		relPath string
+		want    bool
+	}{
+		{"debug.log", true},
+		{"sub/debug.log", true},
+		{"important.log", false},
+		{"sub/important.log", false},
+		{"cache", true},
+		{"notes.txt", false},
+	}
+	for _, test := range tests {
+		if got := rules.Ignores(filepath.FromSlash(test.relPath)); got != test.want {
+			t.Errorf("Ignores(%q) = %v, want %v", test.relPath, got, test.want)
+		}
+	}
+}
+
+func TestScanIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".dedupignore":   "*.tmp\ncache/\n!keep.tmp\n",
+		"a.txt":          "a",
+		"b.tmp":          "b",
+		"keep.tmp":       "k",
+		"cache/c.txt":    "c",
+		"cache/keep.tmp": "k",
+		"sub/d.tmp":      "d",
+	})
+
+	opts := ScanOptions{IgnoreFile: ".dedupignore", Exclude: []string{"a.txt"}}
+	// Nothing under an ignored directory comes back, as in .gitignore
+	if got, want := scanFiles(t, root, opts), []string{"keep.tmp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "patterns.txt")
+	writeFiles(t, dir, map[string]string{"patterns.txt": "# build output\n*.o\n\nbuild/\n!keep.o\n"})
+
+	rules, err := ReadIgnoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("read %d rules, want 3: %+v", len(rules), rules)
+	}
+
+	root := filepath.Join(dir, "root")
+	writeFiles(t, root, map[string]string{"a.o": "a", "keep.o": "k", "b.c": "b", "build/c.c": "c"})
+	if got, want := scanFiles(t, root, ScanOptions{ExcludeRules: rules}), []string{"b.c", "keep.o"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+
+	if _, err := ReadIgnoreFile(filepath.Join(dir, "missing.txt")); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("err = %v, want one naming the missing file", err)
+	}
+}
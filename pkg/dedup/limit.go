@@ -0,0 +1,45 @@
+package dedup
+
+import "sync"
+
+// OpenLimiter bounds how many files are open at once across every goroutine
+// sharing it, so high concurrency can't exhaust the process's file
+// descriptors. A nil OpenLimiter doesn't limit anything.
+type OpenLimiter struct {
+	mu    sync.Mutex // Serializes acquire, so two callers never each hold part of what they need
+	slots chan struct{}
+	peak  int // Most slots held at once, guarded by mu
+}
+
+// NewOpenLimiter returns a limiter allowing limit open files, or nil if
+// limit isn't positive. At least two are always allowed, since comparing a
+// pair of files needs both open.
+func NewOpenLimiter(limit int) *OpenLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &OpenLimiter{slots: make(chan struct{}, max(limit, 2))}
+}
+
+// acquire blocks until n more files may be opened.
+func (l *OpenLimiter) acquire(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < n; i++ {
+		l.slots <- struct{}{}
+	}
+	l.peak = max(l.peak, len(l.slots))
+}
+
+// release returns n slots taken by acquire once their files are closed.
+func (l *OpenLimiter) release(n int) {
+	if l == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-l.slots
+	}
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpenLimiter(t *testing.T) {
+	const limit = 3
+	open := NewOpenLimiter(limit)
+	var held, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 20 {
+		// Pairs of files are taken together, as comparisons do
+		n := 1 + i%2
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			open.acquire(n)
+			now := held.Add(int64(n))
+			for old := peak.Load(); now > old && !peak.CompareAndSwap(old, now); old = peak.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			held.Add(-int64(n))
+			open.release(n)
+		}()
+	}
+	wg.Wait()
+	if got := peak.Load(); got > limit {
+		t.Errorf("%d files were open at once, want at most %d", got, limit)
+	}
+	if got := peak.Load(); got < 2 {
+		t.Errorf("at most %d files were open at once; the limiter allowed no concurrency", got)
+	}
+}
+
+func TestNewOpenLimiter(t *testing.T) {
+	if NewOpenLimiter(0) != nil || NewOpenLimiter(-1) != nil {
+		t.Error("a limit of 0 or less limits something")
+	}
+	// A pair must always fit, or comparing it would block forever
+	if got := cap(NewOpenLimiter(1).slots); got != 2 {
+		t.Errorf("a limit of 1 allows %d files, want 2", got)
+	}
+	var unlimited *OpenLimiter
+	unlimited.acquire(5)
+	unlimited.release(5)
+}
+
+func TestOpenLimitSharedAcrossPhases(t *testing.T) {
+	const limit = 3
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := range 40 {
+		// Every file has the same size, so each one is hashed
+		files[fmt.Sprintf("f%02d.txt", i)] = fmt.Sprintf("%04d", i%10)
+	}
+	trees := make([][2]string, 2)
+	for i := range trees {
+		trees[i] = [2]string{filepath.Join(dir, fmt.Sprint("source", i)), filepath.Join(dir, fmt.Sprint("dest", i))}
+		writeFiles(t, trees[i][0], files)
+		writeFiles(t, trees[i][1], files)
+	}
+	sourceFiles, destFiles := scanBoth(t, trees[0][0], trees[0][1])
+	duplicates := findBetween(t, trees[1][0], trees[1][1], MatchOptions{Mode: MatchContent})
+
+	// Match one pair of trees while verifying the other's duplicates
+	open := NewOpenLimiter(limit)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchContent, Jobs: 8, OpenLimit: open}); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if summary := Apply(context.Background(), duplicates, ApplyOptions{Verify: true, DryRun: true, Jobs: 8, OpenLimit: open}); summary.Err() != nil {
+			t.Error(summary.Err())
+		}
+	}()
+	wg.Wait()
+
+	if open.peak > limit || open.peak < 2 {
+		t.Errorf("%d files were open at once across matching and verifying, want 2 to %d", open.peak, limit)
+	}
+	if held := len(open.slots); held != 0 {
+		t.Errorf("%d files are still counted as open after both phases", held)
+	}
+}
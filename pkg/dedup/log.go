@@ -0,0 +1,178 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogEntry is one line of the action log, describing a destination that was
+// replaced by a link. The original is moved back from the trash if it was
+// kept there; otherwise the source, which holds the same contents, is copied
+// and given the original's mode, modification time and extended attributes.
+type LogEntry struct {
+	Time        time.Time   `json:"time"`
+	Destination string      `json:"destination"`
+	Source      string      `json:"source"`
+	Link        LinkType    `json:"link"`
+	Target      string      `json:"target"` // Path stored in the link
+	Size        int64       `json:"size"`
+	Mode        os.FileMode `json:"mode"`
+	ModTime     time.Time   `json:"mod_time"`
+	Trash       string      `json:"trash,omitempty"` // Where the original was moved, if kept
+
+	// Extended attributes of the replaced file, such as Finder tags or
+	// SELinux labels, on platforms that support them
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+
+	// Hash is the content hash of the replaced file computed with
+	// Algorithm, if it was hashed.
+	Hash      string        `json:"hash,omitempty"`
+	Algorithm HashAlgorithm `json:"algorithm,omitempty"`
+}
+
+// ActionLog appends a JSON line per replacement. It is safe for concurrent use.
+type ActionLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func OpenActionLog(path string) (*ActionLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file %s: %w", path, err)
+	}
+	return &ActionLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (l *ActionLog) Record(r Replacement) error {
+	entry := LogEntry{
+		Time:        time.Now(),
+		Destination: r.Destination,
+		Source:      r.Source,
+		Link:        r.Link,
+		Target:      r.Target,
+		Size:        r.Size,
+		Mode:        r.Mode,
+		ModTime:     r.ModTime,
+		Trash:       r.Trash,
+		Xattrs:      r.Xattrs,
+		Hash:        r.Hash,
+		Algorithm:   r.Algorithm,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.encoder.Encode(entry); err != nil {
+		return fmt.Errorf("error writing log entry for %s: %w", r.Destination, err)
+	}
+	return nil
+}
+
+func (l *ActionLog) Close() error {
+	return l.file.Close()
+}
+
+// ReadActionLog parses the entries of an action log. A log cut short by a
+// crash may end in a partial line; malformed lines are passed to warnFn and
+// skipped so the complete entries can still be undone.
+func ReadActionLog(r io.Reader, warnFn func(error)) ([]LogEntry, error) {
+	var entries []LogEntry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			warn(warnFn, fmt.Errorf("skipping malformed log line %d: %w", line, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// CheckStillLinked verifies that the destination of entry is still the link
+// dedup created, or still missing if it was deleted, so undo never
+// overwrites a file the user has since changed.
+func CheckStillLinked(entry LogEntry) error {
+	destInfo, err := os.Lstat(entry.Destination)
+	if entry.Link == LinkDelete {
+		if err == nil {
+			return fmt.Errorf("deleted destination %s has been recreated", entry.Destination)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error checking %s: %w", entry.Destination, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("destination %s is missing: %w", entry.Destination, err)
+	}
+
+	if entry.Link == LinkSymlink {
+		if destInfo.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("destination %s is no longer a symlink", entry.Destination)
+		}
+		target, err := os.Readlink(entry.Destination)
+		if err != nil {
+			return fmt.Errorf("error reading symlink %s: %w", entry.Destination, err)
+		}
+		if target != entry.Target {
+			return fmt.Errorf("symlink %s now points to %s instead of %s", entry.Destination, target, entry.Target)
+		}
+		return nil
+	}
+
+	sourceInfo, err := os.Stat(entry.Source)
+	if err != nil {
+		return fmt.Errorf("source %s is missing: %w", entry.Source, err)
+	}
+	if !os.SameFile(destInfo, sourceInfo) {
+		return fmt.Errorf("destination %s is no longer a hard link to %s", entry.Destination, entry.Source)
+	}
+	return nil
+}
+
+// RestoreEntry replaces the link at entry.Destination with the original
+// file, or puts a deleted one back, moving it from the trash if it was kept
+// there and otherwise copying the source with the original mode,
+// modification time and extended attributes. The link is replaced by a
+// rename, so the destination is never missing.
+func RestoreEntry(entry LogEntry) error {
+	if err := CheckStillLinked(entry); err != nil {
+		return err
+	}
+	if entry.Link == LinkDelete {
+		// The directory may have been pruned once it was left empty
+		if err := os.MkdirAll(filepath.Dir(entry.Destination), 0o755); err != nil {
+			return fmt.Errorf("error recreating directory for %s: %w", entry.Destination, err)
+		}
+	}
+
+	if entry.Trash != "" {
+		if _, err := os.Lstat(entry.Trash); err == nil {
+			if err := moveFile(entry.Trash, entry.Destination); err != nil {
+				return fmt.Errorf("error restoring %s from trash: %w", entry.Destination, err)
+			}
+			return nil
+		}
+	}
+
+	return copyReplace(entry.Source, entry.Destination, entry.Mode.Perm(), entry.ModTime, entry.Xattrs)
+}
@@ -0,0 +1,95 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// applyLogged replaces the duplicates between source and dest as
+// applyBetween does, recording each replacement in a new action log, and
+// returns the log's contents.
+func applyLogged(t *testing.T, source, dest string, opts ApplyOptions) []byte {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "actions.log")
+	log, err := OpenActionLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replaced in destination order, so the log's order is known
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Destination < duplicates[j].Destination })
+	opts.OnResult = func(r Result) {
+		if r.Outcome == Replaced {
+			if err := log.Record(r.Replacement); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err := Apply(context.Background(), duplicates, opts).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestUndoPartialLog(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "first", "b.txt": "second"})
+	writeFiles(t, dest, map[string]string{"a.txt": "first", "b.txt": "second"})
+	if err := os.Chmod(filepath.Join(dest, "a.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := applyLogged(t, source, dest, ApplyOptions{})
+	lines := bytes.SplitAfter(contents, []byte("\n"))
+	if len(lines) != 3 || len(lines[2]) != 0 {
+		t.Fatalf("log has %d lines, want 2:\n%s", len(lines)-1, contents)
+	}
+	// A crash while writing the second entry leaves half a line
+	partial := append(lines[0], lines[1][:len(lines[1])/2]...)
+
+	var warnings []error
+	entries, err := ReadActionLog(bytes.NewReader(partial), func(err error) { warnings = append(warnings, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || len(warnings) != 1 {
+		t.Fatalf("read %d entries and %d warnings, want 1 of each", len(entries), len(warnings))
+	}
+	if err := RestoreEntry(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := entries[0].Destination
+	if want := filepath.Join(dest, "a.txt"); restored != want {
+		t.Fatalf("first entry restores %s, want %s", restored, want)
+	}
+	info, err := os.Lstat(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0o600 {
+		t.Errorf("restored %s has mode %v, want a regular file with -rw-------", restored, info.Mode())
+	}
+	if got := readFile(t, restored); got != "first" {
+		t.Errorf("restored %s holds %q, want %q", restored, got, "first")
+	}
+	if !isSymlink(filepath.Join(dest, "b.txt")) {
+		t.Error("b.txt, whose entry was cut short, was restored")
+	}
+	// Undoing the same entry again must not clobber the restored file
+	if err := RestoreEntry(entries[0]); err == nil {
+		t.Error("restoring an entry twice succeeded")
+	}
+}
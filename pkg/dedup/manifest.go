@@ -0,0 +1,109 @@
+package dedup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// ManifestVersion is the manifest format WriteTo produces and ReadManifest
+// accepts.
+const ManifestVersion = 1
+
+// ManifestEntry is a file recorded in a manifest.
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// Manifest is a snapshot of the hashes of a scanned tree, so the tree can be
+// compared against later without scanning it again.
+type Manifest struct {
+	Version   int                      `json:"version"`
+	Root      string                   `json:"root"` // Absolute path of the scanned tree
+	Algorithm HashAlgorithm            `json:"algorithm"`
+	Entries   map[string]ManifestEntry `json:"files"` // Keyed by path relative to Root
+}
+
+// NewManifest hashes every file found by scanning root. Files that can't be
+// hashed are passed to warnFn and left out. Hashing stops early if ctx is
+// cancelled.
+func NewManifest(ctx context.Context, root string, files map[string]*FileMetadata, warnFn func(error)) (*Manifest, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %s: %w", root, err)
+	}
+
+	m := &Manifest{
+		Version:   ManifestVersion,
+		Root:      absRoot,
+		Algorithm: HashXXH64,
+		Entries:   make(map[string]ManifestEntry, len(files)),
+	}
+	for key, metadata := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if metadata.algorithm != "" {
+			m.Algorithm = metadata.algorithm
+		}
+		hash, err := metadata.ContentHash()
+		if err != nil {
+			warn(warnFn, fmt.Errorf("could not hash %s: %w", key, err))
+			continue
+		}
+		m.Entries[key] = ManifestEntry{Size: metadata.Size, ModTime: metadata.ModTime, Hash: hash}
+	}
+	return m, nil
+}
+
+// WriteTo writes the manifest to w as JSON.
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("error encoding manifest: %w", err)
+	}
+	n, err := w.Write(append(data, '\n'))
+	if err != nil {
+		return int64(n), fmt.Errorf("error writing manifest: %w", err)
+	}
+	return int64(n), nil
+}
+
+// ReadManifest reads a manifest written by WriteTo, rejecting versions it
+// doesn't understand.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d (expected %d)", m.Version, ManifestVersion)
+	}
+	if _, err := ParseHashAlgorithm(string(m.Algorithm)); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Files returns the recorded files keyed by their relative path, as Scan
+// would return them for Root. Their hashes come from the manifest, so
+// comparing them doesn't read the files.
+func (m *Manifest) Files() map[string]*FileMetadata {
+	files := make(map[string]*FileMetadata, len(m.Entries))
+	for key, entry := range m.Entries {
+		files[key] = &FileMetadata{
+			Size:      entry.Size,
+			Path:      filepath.Join(m.Root, key),
+			RelPath:   key,
+			ModTime:   entry.ModTime,
+			hash:      entry.Hash,
+			algorithm: m.Algorithm,
+		}
+	}
+	return files
+}
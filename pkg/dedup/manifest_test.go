@@ -0,0 +1,76 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "same", "sub/b.txt": "source only"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same", "sub/b.txt": "changed"})
+	ctx := context.Background()
+
+	files, _, err := Scan(ctx, source, ScanOptions{Hash: HashSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := NewManifest(ctx, source, files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := manifest.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Times lose their monotonic reading in JSON, so compare them apart
+	for key, entry := range manifest.Entries {
+		got := read.Entries[key]
+		if !got.ModTime.Equal(entry.ModTime) {
+			t.Errorf("%s: modification time %v, want %v", key, got.ModTime, entry.ModTime)
+		}
+		got.ModTime = entry.ModTime
+		read.Entries[key] = got
+	}
+	if !reflect.DeepEqual(read, manifest) {
+		t.Errorf("read %+v, want %+v", read, manifest)
+	}
+	if read.Algorithm != HashSHA256 || read.Root != source {
+		t.Errorf("read algorithm %s and root %s, want sha256 and %s", read.Algorithm, read.Root, source)
+	}
+
+	// The manifest stands in for the source tree
+	destFiles, _, err := Scan(ctx, dest, ScanOptions{Hash: read.Algorithm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err := FindDuplicates(ctx, read.Files(), destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dest/a.txt <- source/a.txt"}; !reflect.DeepEqual(pairedPaths(t, dir, duplicates), want) {
+		t.Errorf("found %q, want %q", pairedPaths(t, dir, duplicates), want)
+	}
+}
+
+func TestReadManifestRejectsUnknownVersion(t *testing.T) {
+	for _, input := range []string{
+		`{"version": 2, "root": "/", "algorithm": "xxh64", "files": {}}`,
+		`{"version": 1, "root": "/", "algorithm": "crc32", "files": {}}`,
+		`{"version": 1,`,
+	} {
+		if _, err := ReadManifest(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadManifest(%s) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,711 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MatchOptions controls how FindDuplicates pairs source and destination files.
+type MatchOptions struct {
+	Mode       MatchMode
+	IgnoreCase bool // Pair names that differ only in case
+	// Pair names that differ only in Unicode normalization, as a name
+	// written on macOS (NFD) and the same name written on Linux (NFC) do
+	NormalizeUnicode bool
+
+	Jobs int // Number of files hashed concurrently
+	// OpenLimit, if set, bounds the files hashed at once, however many Jobs
+	// hash them. It may be shared with ApplyOptions.OpenLimit to bound the
+	// open files of the whole run.
+	OpenLimit *OpenLimiter
+
+	// Warn receives the files that couldn't be compared.
+	Warn func(error)
+	// OnDuplicate, if set, is called with every pair FindDuplicates finds,
+	// as it finds them, so callers can report progress.
+	OnDuplicate func(Duplicate)
+	// OnHardLinked, if set, is called with every destination FindDuplicates
+	// leaves out because it is already a hard link to a source it would be
+	// paired with.
+	OnHardLinked func(Duplicate)
+}
+
+// groupBySize buckets the keys of files by their file size so that only
+// files whose size collides with the other side are ever hashed. Keys within
+// each group are sorted so matching is deterministic.
+func groupBySize(files map[string]*FileMetadata) map[int64][]string {
+	groups := make(map[int64][]string)
+	for key, metadata := range files {
+		groups[metadata.Size] = append(groups[metadata.Size], key)
+	}
+	for _, keys := range groups {
+		sort.Strings(keys)
+	}
+	return groups
+}
+
+// hashAll computes the content hash of every file on a pool of jobs workers,
+// so reading one file overlaps with hashing another. Files that can't be
+// hashed are returned with their errors, so each is reported once rather
+// than hashed again when compared. Files not yet handed to a worker are
+// skipped once ctx is cancelled.
+func hashAll(ctx context.Context, files []*FileMetadata, jobs int, open *OpenLimiter) map[*FileMetadata]error {
+	work := make(chan *FileMetadata, jobs)
+	var mu sync.Mutex // Guards failed
+	failed := make(map[*FileMetadata]error)
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+	for i := 0; i < jobs; i++ {
+		go func() {
+			defer wg.Done()
+			for metadata := range work {
+				open.acquire(1)
+				_, err := metadata.ContentHash()
+				open.release(1)
+				if err != nil {
+					mu.Lock()
+					failed[metadata] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, metadata := range files {
+		select {
+		case work <- metadata:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	return failed
+}
+
+// linkedSource returns the file among sourceKeys that dest is a hard link
+// to, or nil if there is none.
+func linkedSource(dest *FileMetadata, sourceKeys []string, sourceFiles map[string]*FileMetadata) *FileMetadata {
+	for _, sourceKey := range sourceKeys {
+		if source := sourceFiles[sourceKey]; source.hardLinked(dest) {
+			return source
+		}
+	}
+	return nil
+}
+
+// newDuplicate pairs dest with the source it duplicates.
+func newDuplicate(source, dest *FileMetadata) Duplicate {
+	return Duplicate{
+		Source:      source.Path,
+		Destination: dest.Path,
+		RelPath:     dest.RelPath,
+		Size:        dest.Size,
+		Hash:        source.exactHash(),
+		Algorithm:   source.algorithm,
+
+		SourceModTime: source.ModTime,
+		DestModTime:   dest.ModTime,
+	}
+}
+
+// FindDuplicates pairs each destination file with a source file that has the
+// same contents and, depending on opts.Mode, the same name or relative path.
+// Every destination appears at most once, and duplicates are sorted by
+// destination. Destinations already hard-linked to a candidate source are
+// left out and passed to opts.OnHardLinked instead. Only files whose size and
+// key collide with the other side are hashed, on a pool of opts.Jobs
+// workers. Hashing stops early if ctx is cancelled.
+//
+// Files are compared in batches of sizes, smallest first, each hashed just
+// before it is compared, so opts.OnDuplicate receives the first duplicates
+// while later files are still being read. Within a size it receives them in
+// order of destination.
+func FindDuplicates(ctx context.Context, sourceFiles, destFiles map[string]*FileMetadata, opts MatchOptions) ([]Duplicate, error) {
+	type sizeGroup struct {
+		size        int64
+		destKeys    []string
+		sourceByKey map[string][]string
+		candidates  []*FileMetadata // Files to hash before the group is compared
+	}
+	var groups []sizeGroup
+
+	sourceSizes := groupBySize(sourceFiles)
+	for size, destKeys := range groupBySize(destFiles) {
+		// Sizes unique to the destination can never have a duplicate
+		sourceKeys, exists := sourceSizes[size]
+		if !exists {
+			continue
+		}
+
+		sourceByKey := make(map[string][]string)
+		for _, sourceKey := range sourceKeys {
+			matchKey := opts.Mode.key(sourceKey, opts.IgnoreCase, opts.NormalizeUnicode)
+			sourceByKey[matchKey] = append(sourceByKey[matchKey], sourceKey)
+		}
+		for _, keys := range sourceByKey {
+			sort.Strings(keys)
+		}
+		sort.Strings(destKeys)
+		group := sizeGroup{size: size, destKeys: destKeys, sourceByKey: sourceByKey}
+
+		queued := make(map[*FileMetadata]bool)
+		queue := func(metadata *FileMetadata) {
+			if !queued[metadata] {
+				queued[metadata] = true
+				group.candidates = append(group.candidates, metadata)
+			}
+		}
+		for _, destKey := range destKeys {
+			destMetadata := destFiles[destKey]
+			sourceKeys := sourceByKey[opts.Mode.key(destKey, opts.IgnoreCase, opts.NormalizeUnicode)]
+			if linkedSource(destMetadata, sourceKeys, sourceFiles) != nil {
+				continue
+			}
+			for _, sourceKey := range sourceKeys {
+				if sourceMetadata := sourceFiles[sourceKey]; !sourceMetadata.SameFile(destMetadata) {
+					queue(sourceMetadata)
+					queue(destMetadata)
+				}
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].size < groups[j].size })
+
+	jobs := max(opts.Jobs, 1)
+	unhashed := make(map[*FileMetadata]bool) // Files already reported as unreadable
+	var duplicates []Duplicate
+	for start := 0; start < len(groups); {
+		// Hash enough groups at once to keep every worker busy; the
+		// comparisons below then only look the hashes up
+		end := start
+		var batch []*FileMetadata
+		for end < len(groups) && (end == start || len(batch) < 4*jobs) {
+			batch = append(batch, groups[end].candidates...)
+			end++
+		}
+		if opts.Mode != MatchSizeMTime {
+			failed := hashAll(ctx, batch, jobs, opts.OpenLimit)
+			for _, metadata := range batch {
+				if err, ok := failed[metadata]; ok {
+					warn(opts.Warn, fmt.Errorf("could not compare %s: %w", metadata.RelPath, err))
+					unhashed[metadata] = true
+				}
+			}
+		}
+
+		for _, group := range groups[start:end] {
+			sourceByKey := group.sourceByKey
+			for _, destKey := range group.destKeys {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				destMetadata := destFiles[destKey]
+				sourceKeys := sourceByKey[opts.Mode.key(destKey, opts.IgnoreCase, opts.NormalizeUnicode)]
+				// Relinking a destination that already shares its storage
+				// with a candidate would reclaim nothing
+				if linked := linkedSource(destMetadata, sourceKeys, sourceFiles); linked != nil {
+					if opts.OnHardLinked != nil {
+						opts.OnHardLinked(newDuplicate(linked, destMetadata))
+					}
+					continue
+				}
+				if unhashed[destMetadata] {
+					continue
+				}
+				for _, sourceKey := range sourceKeys {
+					sourceMetadata := sourceFiles[sourceKey]
+					// Replacing a file with a link to itself would destroy it
+					if sourceMetadata.SameFile(destMetadata) || unhashed[sourceMetadata] {
+						continue
+					}
+					equal, err := sourceMetadata.matches(destMetadata, opts.Mode)
+					if err != nil {
+						warn(opts.Warn, fmt.Errorf("could not compare %s: %w", destKey, err))
+						continue
+					}
+					if equal {
+						dup := newDuplicate(sourceMetadata, destMetadata)
+						duplicates = append(duplicates, dup)
+						if opts.OnDuplicate != nil {
+							opts.OnDuplicate(dup)
+						}
+						break
+					}
+				}
+			}
+		}
+		start = end
+	}
+
+	sortByDestination(duplicates)
+	return duplicates, nil
+}
+
+// ChooseCanonical regroups duplicates found between sourceFiles and destFiles
+// into sets of a source and every destination paired with it, and links the
+// other copies in each set to the one policy keeps. KeepFirst and KeepSource
+// keep the source, as FindDuplicates does.
+func ChooseCanonical(duplicates []Duplicate, sourceFiles, destFiles map[string]*FileMetadata, policy KeepPolicy) []Duplicate {
+	if policy == KeepFirst || policy == KeepSource {
+		return duplicates
+	}
+
+	byPath := make(map[string]*FileMetadata, len(sourceFiles))
+	for _, metadata := range sourceFiles {
+		byPath[metadata.Path] = metadata
+	}
+
+	var sources []string
+	sets := make(map[string][]*FileMetadata)
+	for _, dup := range duplicates {
+		if _, exists := sets[dup.Source]; !exists {
+			sources = append(sources, dup.Source)
+		}
+		sets[dup.Source] = append(sets[dup.Source], destFiles[dup.RelPath])
+	}
+
+	var result []Duplicate
+	for _, source := range sources {
+		dests := sets[source]
+		sort.Slice(dests, func(i, j int) bool { return dests[i].Path < dests[j].Path })
+		members := append([]*FileMetadata{byPath[source]}, dests...)
+
+		canonical := members[1]
+		if policy != KeepDest {
+			canonical = members[0]
+			for _, candidate := range members[1:] {
+				if policy.prefers(candidate, canonical) {
+					canonical = candidate
+				}
+			}
+		}
+
+		hash := canonical.exactHash()
+		for _, member := range members {
+			if member == canonical {
+				continue
+			}
+			result = append(result, Duplicate{
+				Source:      canonical.Path,
+				Destination: member.Path,
+				RelPath:     member.RelPath,
+				Size:        canonical.Size,
+				Hash:        hash,
+				Algorithm:   canonical.algorithm,
+
+				SourceModTime: canonical.ModTime,
+				DestModTime:   member.ModTime,
+			})
+		}
+	}
+	sortByDestination(result)
+	return result
+}
+
+// Reverse swaps the sides of duplicates found between sourceFiles and a
+// destination tree, so each source is replaced by a link to its destination
+// instead. A source paired with several destinations is linked to the first
+// in path order and the others are left alone.
+func Reverse(duplicates []Duplicate, sourceFiles map[string]*FileMetadata) []Duplicate {
+	byPath := make(map[string]*FileMetadata, len(sourceFiles))
+	for _, metadata := range sourceFiles {
+		byPath[metadata.Path] = metadata
+	}
+
+	var result []Duplicate
+	linked := make(map[string]bool)
+	for _, dup := range duplicates {
+		// Duplicates are sorted by destination, so the first one wins
+		if linked[dup.Source] {
+			continue
+		}
+		linked[dup.Source] = true
+		dup.Source, dup.Destination = dup.Destination, dup.Source
+		dup.SourceModTime, dup.DestModTime = dup.DestModTime, dup.SourceModTime
+		dup.RelPath = byPath[dup.Destination].RelPath
+		result = append(result, dup)
+	}
+	sortByDestination(result)
+	return result
+}
+
+// DuplicateGroup is a set of files with identical contents.
+type DuplicateGroup struct {
+	Hash        string
+	Size        int64    // Size of each copy
+	Keep        []string // Files the other copies are linked to
+	Replace     []string // Copies that are replaced by links
+	Reclaimable int64    // Bytes freed by replacing every copy in Replace
+}
+
+// GroupDuplicates collects duplicates into groups of identical contents,
+// ordered by the bytes they could reclaim, largest first. Paths within each
+// group are sorted.
+func GroupDuplicates(duplicates []Duplicate) []DuplicateGroup {
+	var groups []*DuplicateGroup
+	byHash := make(map[string]*DuplicateGroup)
+	kept := make(map[string]bool)
+
+	for _, dup := range duplicates {
+		// Every duplicate is hashed unless the sizes alone decided it
+		key := dup.Hash
+		if key == "" {
+			key = "source:" + dup.Source
+		}
+		group, exists := byHash[key]
+		if !exists {
+			group = &DuplicateGroup{Hash: dup.Hash, Size: dup.Size}
+			byHash[key] = group
+			groups = append(groups, group)
+		}
+		if !kept[dup.Source] {
+			kept[dup.Source] = true
+			group.Keep = append(group.Keep, dup.Source)
+		}
+		group.Replace = append(group.Replace, dup.Destination)
+		group.Reclaimable += dup.Size
+	}
+
+	result := make([]DuplicateGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.Keep)
+		sort.Strings(group.Replace)
+		result = append(result, *group)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Reclaimable != result[j].Reclaimable {
+			return result[i].Reclaimable > result[j].Reclaimable
+		}
+		return result[i].Keep[0] < result[j].Keep[0]
+	})
+	return result
+}
+
+// DirSavings totals the duplicates whose destinations are in one directory.
+type DirSavings struct {
+	Dir         string
+	Files       int   // Duplicates in Dir
+	Reclaimable int64 // Bytes freed by replacing every one of them
+}
+
+// SavingsByDir totals duplicates by the directory holding their destination,
+// ordered by the bytes they could reclaim, largest first, and then by
+// directory.
+func SavingsByDir(duplicates []Duplicate) []DirSavings {
+	byDir := make(map[string]*DirSavings)
+	for _, dup := range duplicates {
+		dir := filepath.Dir(dup.Destination)
+		savings, exists := byDir[dir]
+		if !exists {
+			savings = &DirSavings{Dir: dir}
+			byDir[dir] = savings
+		}
+		savings.Files++
+		savings.Reclaimable += dup.Size
+	}
+
+	result := make([]DirSavings, 0, len(byDir))
+	for _, savings := range byDir {
+		result = append(result, *savings)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Reclaimable != result[j].Reclaimable {
+			return result[i].Reclaimable > result[j].Reclaimable
+		}
+		return result[i].Dir < result[j].Dir
+	})
+	return result
+}
+
+// UniqueFiles returns the keys found only in sourceFiles and only in
+// destFiles, each sorted. Keys are paths relative to the scanned roots.
+func UniqueFiles(sourceFiles, destFiles map[string]*FileMetadata) (onlySource, onlyDest []string) {
+	onlySource = []string{}
+	for key := range sourceFiles {
+		if _, exists := destFiles[key]; !exists {
+			onlySource = append(onlySource, key)
+		}
+	}
+	onlyDest = []string{}
+	for key := range destFiles {
+		if _, exists := sourceFiles[key]; !exists {
+			onlyDest = append(onlyDest, key)
+		}
+	}
+	sort.Strings(onlySource)
+	sort.Strings(onlyDest)
+	return onlySource, onlyDest
+}
+
+// TreeDiff compares two trees file by file at the same relative path.
+type TreeDiff struct {
+	OnlySource []string // Removed from, or never copied to, the destination
+	OnlyDest   []string // Added in the destination
+	Modified   []string // In both trees with different contents
+	Identical  []string // In both trees with the same contents
+}
+
+// DiffTrees compares the files of sourceFiles and destFiles that share a
+// key, deciding whether contents are the same as opts.Mode would, and lists
+// the keys found on only one side as UniqueFiles does. Every list is sorted.
+// Files that can't be compared are passed to opts.Warn and left out.
+func DiffTrees(ctx context.Context, sourceFiles, destFiles map[string]*FileMetadata, opts MatchOptions) (TreeDiff, error) {
+	var diff TreeDiff
+	diff.OnlySource, diff.OnlyDest = UniqueFiles(sourceFiles, destFiles)
+	diff.Modified = []string{}
+	diff.Identical = []string{}
+
+	for key, sourceMetadata := range sourceFiles {
+		if err := ctx.Err(); err != nil {
+			return TreeDiff{}, err
+		}
+		destMetadata, exists := destFiles[key]
+		if !exists {
+			continue
+		}
+		equal, err := sourceMetadata.matches(destMetadata, opts.Mode)
+		if err != nil {
+			warn(opts.Warn, fmt.Errorf("could not compare %s: %w", key, err))
+			continue
+		}
+		if equal {
+			diff.Identical = append(diff.Identical, key)
+		} else {
+			diff.Modified = append(diff.Modified, key)
+		}
+	}
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.Identical)
+	return diff, nil
+}
+
+// SizeMismatch is a destination file whose counterpart in the source has a
+// different size, such as a file edited in one of the trees.
+type SizeMismatch struct {
+	RelPath    string // Destination path relative to its scanned root
+	Source     string
+	Dest       string
+	SourceSize int64
+	DestSize   int64
+}
+
+// SizeMismatches lists the destination files that share a name or relative
+// path with source files, as opts.Mode pairs them, but whose size matches
+// none of them. Sizes are all that is compared, so nothing is read. Under
+// MatchContent files are paired by relative path. A destination with several
+// candidates is reported against the first in path order. The result is
+// sorted by destination.
+func SizeMismatches(sourceFiles, destFiles map[string]*FileMetadata, opts MatchOptions) []SizeMismatch {
+	mode := opts.Mode
+	if mode == MatchContent {
+		mode = MatchRelPath
+	}
+	sourceByKey := make(map[string][]*FileMetadata)
+	for key, metadata := range sourceFiles {
+		matchKey := mode.key(key, opts.IgnoreCase, opts.NormalizeUnicode)
+		sourceByKey[matchKey] = append(sourceByKey[matchKey], metadata)
+	}
+
+	mismatches := []SizeMismatch{}
+	for key, destMetadata := range destFiles {
+		candidates := sourceByKey[mode.key(key, opts.IgnoreCase, opts.NormalizeUnicode)]
+		if len(candidates) == 0 {
+			continue
+		}
+		first := candidates[0]
+		sameSize := false
+		for _, candidate := range candidates {
+			if candidate.Size == destMetadata.Size {
+				sameSize = true
+				break
+			}
+			if candidate.Path < first.Path {
+				first = candidate
+			}
+		}
+		if sameSize {
+			continue
+		}
+		mismatches = append(mismatches, SizeMismatch{
+			RelPath:    destMetadata.RelPath,
+			Source:     first.Path,
+			Dest:       destMetadata.Path,
+			SourceSize: first.Size,
+			DestSize:   destMetadata.Size,
+		})
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Dest < mismatches[j].Dest })
+	return mismatches
+}
+
+// CaseCollisions returns the sets of keys in files that are distinct but
+// share a match key once case is folded, each set sorted and the sets ordered
+// by their first key. Such source files are all candidates for the same
+// destinations, and the first one in sorted order with equal contents is
+// paired.
+func CaseCollisions(files map[string]*FileMetadata, mode MatchMode) [][]string {
+	if mode == MatchContent {
+		return nil
+	}
+
+	byKey := make(map[string][]string)
+	for key := range files {
+		folded := mode.key(key, true, false)
+		byKey[folded] = append(byKey[folded], key)
+	}
+
+	var collisions [][]string
+	for _, keys := range byKey {
+		sort.Strings(keys)
+		// Under name matching, equal names in different directories collide
+		// regardless of case, so only report names that differ
+		names := make(map[string]bool)
+		for _, key := range keys {
+			names[mode.key(key, false, false)] = true
+		}
+		if len(names) > 1 {
+			collisions = append(collisions, keys)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return collisions
+}
+
+// GroupIdentical partitions files into classes of identical contents,
+// returning only classes with at least two members. Unlike FindDuplicates it
+// considers a single tree, so every file is compared against every other
+// file of the same size. Files that can't be hashed are passed to warnFn.
+func GroupIdentical(ctx context.Context, files map[string]*FileMetadata, warnFn func(error)) ([][]*FileMetadata, error) {
+	var groups [][]*FileMetadata
+
+	for _, keys := range groupBySize(files) {
+		if len(keys) < 2 {
+			continue
+		}
+
+		byHash := make(map[string][]*FileMetadata)
+		var hashes []string
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			hash, err := files[key].ContentHash()
+			if err != nil {
+				warn(warnFn, fmt.Errorf("could not hash %s: %w", key, err))
+				continue
+			}
+			if _, exists := byHash[hash]; !exists {
+				hashes = append(hashes, hash)
+			}
+			byHash[hash] = append(byHash[hash], files[key])
+		}
+
+		for _, hash := range hashes {
+			if len(byHash[hash]) > 1 {
+				groups = append(groups, byHash[hash])
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// LinkToCanonical picks the copy policy prefers in each group and returns a
+// duplicate linking every other copy to it, sorted by destination.
+func LinkToCanonical(groups [][]*FileMetadata, policy KeepPolicy) []Duplicate {
+	var duplicates []Duplicate
+
+	for _, group := range groups {
+		canonical := group[0]
+		for _, candidate := range group[1:] {
+			if policy.prefers(candidate, canonical) {
+				canonical = candidate
+			}
+		}
+
+		for _, member := range group {
+			// Hard links to the canonical already share its storage
+			if member == canonical || member.SameFile(canonical) {
+				continue
+			}
+			duplicates = append(duplicates, Duplicate{
+				Source:      canonical.Path,
+				Destination: member.Path,
+				RelPath:     member.RelPath,
+				Size:        canonical.Size,
+				Hash:        canonical.exactHash(),
+				Algorithm:   canonical.algorithm,
+
+				SourceModTime: canonical.ModTime,
+				DestModTime:   member.ModTime,
+			})
+		}
+	}
+
+	sortByDestination(duplicates)
+	return duplicates
+}
+
+// FindDuplicatesWithin adds to duplicates, found between two trees, the
+// files of destFiles that duplicate each other without being in duplicates.
+// The source wins: a file identical to one already paired with a source is
+// linked to the copy that pair keeps. The rest are grouped as GroupIdentical
+// does and linked to the copy policy prefers in each group. The result is
+// sorted by destination. Files that can't be hashed are passed to warnFn.
+func FindDuplicatesWithin(ctx context.Context, destFiles map[string]*FileMetadata, duplicates []Duplicate, policy KeepPolicy, warnFn func(error)) ([]Duplicate, error) {
+	groups, err := GroupIdentical(ctx, destFiles, warnFn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every path already paired, by the duplicate naming the copy kept
+	kept := make(map[string]Duplicate, 2*len(duplicates))
+	for _, dup := range duplicates {
+		kept[dup.Source] = dup
+		kept[dup.Destination] = dup
+	}
+
+	result := append([]Duplicate(nil), duplicates...)
+	var unpaired [][]*FileMetadata
+	for _, group := range groups {
+		var pair Duplicate
+		paired := false
+		for _, member := range group {
+			if pair, paired = kept[member.Path]; paired {
+				break
+			}
+		}
+		if !paired {
+			unpaired = append(unpaired, group)
+			continue
+		}
+		for _, member := range group {
+			if _, done := kept[member.Path]; done {
+				continue
+			}
+			result = append(result, Duplicate{
+				Source:      pair.Source,
+				Destination: member.Path,
+				RelPath:     member.RelPath,
+				Size:        member.Size,
+				Hash:        member.exactHash(),
+				Algorithm:   member.algorithm,
+
+				SourceModTime: pair.SourceModTime,
+				DestModTime:   member.ModTime,
+			})
+		}
+	}
+	result = append(result, LinkToCanonical(unpaired, policy)...)
+
+	sortByDestination(result)
+	return result, nil
+}
@@ -0,0 +1,652 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scanBoth scans source and dest, failing the test on error.
+func scanBoth(t *testing.T, source, dest string) (sourceFiles, destFiles map[string]*FileMetadata) {
+	t.Helper()
+	sourceFiles, destFiles, _, err := ScanAll(context.Background(), []string{source}, []string{dest}, ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sourceFiles, destFiles
+}
+
+// findBetween scans source and dest and returns the duplicates opts finds
+// between them, failing the test on error.
+func findBetween(t *testing.T, source, dest string, opts MatchOptions) []Duplicate {
+	t.Helper()
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return duplicates
+}
+
+// pairedPaths returns "destination <- source" for every duplicate, both
+// relative to dir and slash-separated, sorted.
+func pairedPaths(t *testing.T, dir string, duplicates []Duplicate) []string {
+	t.Helper()
+	rel := func(path string) string {
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filepath.ToSlash(relPath)
+	}
+	pairs := make([]string, len(duplicates))
+	for i, dup := range duplicates {
+		pairs[i] = rel(dup.Destination) + " <- " + rel(dup.Source)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func TestFindDuplicatesComparesContents(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"same.txt": "contents", "diff.txt": "contents", "only.txt": "source"})
+	writeFiles(t, dest, map[string]string{"same.txt": "contents", "diff.txt": "CONTENTS", "other.txt": "dest"})
+
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 1 || duplicates[0].Destination != filepath.Join(dest, "same.txt") {
+		t.Errorf("found %+v, want only same.txt", duplicates)
+	}
+
+	// Files without a counterpart of the same name are never read
+	if sourceFiles["only.txt"].hash != "" || destFiles["other.txt"].hash != "" {
+		t.Error("a file with nothing to compare against was hashed")
+	}
+}
+
+func TestFindDuplicatesHashesOnlySizeCollisions(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "short", "b.txt": "same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "much longer", "b.txt": "same"})
+
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 1 {
+		t.Errorf("found %+v, want only b.txt", duplicates)
+	}
+	if sourceFiles["a.txt"].hash != "" || destFiles["a.txt"].hash != "" {
+		t.Error("files whose sizes differ were hashed")
+	}
+}
+
+func TestFindDuplicatesSameNamedFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a/config.json": `{"a": 1}`,
+		"b/config.json": `{"b": 2}`,
+	}
+	writeFiles(t, filepath.Join(dir, "source"), files)
+	writeFiles(t, filepath.Join(dir, "dest"), files)
+
+	duplicates := findBetween(t, filepath.Join(dir, "source"), filepath.Join(dir, "dest"), MatchOptions{Mode: MatchRelPath})
+	want := []string{
+		"dest/a/config.json <- source/a/config.json",
+		"dest/b/config.json <- source/b/config.json",
+	}
+	if got := pairedPaths(t, dir, duplicates); !reflect.DeepEqual(got, want) {
+		t.Errorf("found %q, want %q", got, want)
+	}
+}
+
+func TestFindDuplicatesMatchModes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, filepath.Join(dir, "source"), map[string]string{"photos/2021/a.jpg": "photo"})
+	writeFiles(t, filepath.Join(dir, "dest"), map[string]string{"photos/2022/a.jpg": "photo"})
+
+	tests := []struct {
+		mode MatchMode
+		want []string
+	}{
+		{MatchRelPath, []string{}},
+		{MatchName, []string{"dest/photos/2022/a.jpg <- source/photos/2021/a.jpg"}},
+		{MatchContent, []string{"dest/photos/2022/a.jpg <- source/photos/2021/a.jpg"}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			duplicates := findBetween(t, filepath.Join(dir, "source"), filepath.Join(dir, "dest"), MatchOptions{Mode: test.mode})
+			if got := pairedPaths(t, dir, duplicates); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("found %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindDuplicatesByContent(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"holiday.jpg": "beach", "backup/holiday.jpg": "beach", "notes.txt": "notes"})
+	writeFiles(t, dest, map[string]string{
+		"IMG_001.jpg":    "beach",
+		"sub/beach.jpeg": "beach",
+		"todo.txt":       "notes",
+		"same-size.txt":  "NOTES",
+	})
+
+	// Both copies of the photo link to one source, whatever their names
+	want := []string{
+		"dest/IMG_001.jpg <- source/backup/holiday.jpg",
+		"dest/sub/beach.jpeg <- source/backup/holiday.jpg",
+		"dest/todo.txt <- source/notes.txt",
+	}
+	if got := pairedPaths(t, dir, findBetween(t, source, dest, MatchOptions{Mode: MatchContent})); !reflect.DeepEqual(got, want) {
+		t.Errorf("found %q, want %q", got, want)
+	}
+}
+
+// findWithin scans root and returns the duplicates among its files linked to
+// the copy policy keeps, failing the test on error.
+func findWithin(t *testing.T, root string, policy KeepPolicy) []Duplicate {
+	t.Helper()
+	files, _, err := Scan(context.Background(), root, ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := GroupIdentical(context.Background(), files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LinkToCanonical(groups, policy)
+}
+
+func TestThreeIdenticalFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":     "same",
+		"b.txt":     "same",
+		"sub/c.txt": "same",
+		"d.txt":     "diff",
+	})
+
+	want := []string{"b.txt <- a.txt", "sub/c.txt <- a.txt"}
+	if got := pairedPaths(t, root, findWithin(t, root, KeepFirst)); !reflect.DeepEqual(got, want) {
+		t.Errorf("found %q, want %q", got, want)
+	}
+}
+
+func TestFindDuplicatesIgnoreCase(t *testing.T) {
+	tests := []struct {
+		name         string
+		source, dest string
+	}{
+		{"ASCII", "Photos/Photo.JPG", "photos/photo.jpg"},
+		{"Unicode", "ΕΛΛΆΔΑ/Ärger.txt", "ελλάδα/ärger.txt"},
+		{"final sigma", "ΟΔΟΣ.txt", "οδος.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, filepath.Join(dir, "source"), map[string]string{test.source: "same"})
+			writeFiles(t, filepath.Join(dir, "dest"), map[string]string{test.dest: "same"})
+			source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+
+			if got := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath}); len(got) != 0 {
+				t.Errorf("without IgnoreCase found %d duplicates, want 0", len(got))
+			}
+			want := []string{"dest/" + test.dest + " <- source/" + test.source}
+			got := pairedPaths(t, dir, findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath, IgnoreCase: true}))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("with IgnoreCase found %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFindDuplicatesNormalizeUnicode(t *testing.T) {
+	const nfc, nfd = "caf\u00e9/r\u00e9sum\u00e9.txt", "cafe\u0301/re\u0301sume\u0301.txt"
+	for _, mode := range []MatchMode{MatchRelPath, MatchName} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, filepath.Join(dir, "source"), map[string]string{nfc: "same"})
+			writeFiles(t, filepath.Join(dir, "dest"), map[string]string{nfd: "same"})
+			source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+
+			if got := findBetween(t, source, dest, MatchOptions{Mode: mode}); len(got) != 0 {
+				t.Errorf("without NormalizeUnicode found %d duplicates, want 0", len(got))
+			}
+			// The duplicate keeps each file's name as it is on disk
+			want := []string{"dest/" + nfd + " <- source/" + nfc}
+			got := pairedPaths(t, dir, findBetween(t, source, dest, MatchOptions{Mode: mode, NormalizeUnicode: true}))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("with NormalizeUnicode found %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"photo.jpg": "lower",
+		"Photo.JPG": "upper",
+		"other.txt": "other",
+	})
+	files, _, err := Scan(context.Background(), root, ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Skip("the filesystem folds case itself")
+	}
+
+	want := [][]string{{"Photo.JPG", "photo.jpg"}}
+	if got := CaseCollisions(files, MatchRelPath); !reflect.DeepEqual(got, want) {
+		t.Errorf("CaseCollisions = %q, want %q", got, want)
+	}
+}
+
+func TestSavingsByDir(t *testing.T) {
+	photos, docs := filepath.Join("dest", "photos"), filepath.Join("dest", "docs")
+	duplicates := []Duplicate{
+		{Destination: filepath.Join(photos, "a.jpg"), Size: 300},
+		{Destination: filepath.Join(docs, "a.txt"), Size: 100},
+		{Destination: filepath.Join(photos, "b.jpg"), Size: 200},
+		{Destination: filepath.Join(docs, "b.txt"), Size: 50},
+		{Destination: filepath.Join(docs, "c.txt"), Size: 50},
+		// Ties are broken by directory
+		{Destination: filepath.Join("dest", "b", "x"), Size: 200},
+		{Destination: filepath.Join("dest", "a", "x"), Size: 200},
+	}
+	want := []DirSavings{
+		{Dir: photos, Files: 2, Reclaimable: 500},
+		{Dir: filepath.Join("dest", "a"), Files: 1, Reclaimable: 200},
+		{Dir: filepath.Join("dest", "b"), Files: 1, Reclaimable: 200},
+		{Dir: docs, Files: 3, Reclaimable: 200},
+	}
+	if got := SavingsByDir(duplicates); !reflect.DeepEqual(got, want) {
+		t.Errorf("SavingsByDir = %+v, want %+v", got, want)
+	}
+}
+
+func TestUniqueFiles(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"both.txt": "same", "sub/only-source.txt": "s", "z.txt": "z"})
+	writeFiles(t, dest, map[string]string{"both.txt": "same", "only-dest.txt": "d"})
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+
+	onlySource, onlyDest := UniqueFiles(sourceFiles, destFiles)
+	if want := []string{filepath.Join("sub", "only-source.txt"), "z.txt"}; !reflect.DeepEqual(onlySource, want) {
+		t.Errorf("only in source: %q, want %q", onlySource, want)
+	}
+	if want := []string{"only-dest.txt"}; !reflect.DeepEqual(onlyDest, want) {
+		t.Errorf("only in destination: %q, want %q", onlyDest, want)
+	}
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dest/both.txt <- source/both.txt"}; !reflect.DeepEqual(pairedPaths(t, dir, duplicates), want) {
+		t.Errorf("duplicates: %q, want %q", pairedPaths(t, dir, duplicates), want)
+	}
+}
+
+func TestGroupDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"big.bin": "four copies", "small.txt": "two"})
+	writeFiles(t, dest, map[string]string{"x.bin": "four copies", "y/z.bin": "four copies", "w.bin": "four copies", "small.txt": "two"})
+
+	groups := GroupDuplicates(findBetween(t, source, dest, MatchOptions{Mode: MatchContent}))
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2: %+v", len(groups), groups)
+	}
+	big := groups[0]
+	size := int64(len("four copies"))
+	if big.Hash == "" || big.Size != size || big.Reclaimable != 3*size {
+		t.Errorf("largest group = %+v, want a hash, size %d and %d reclaimable", big, size, 3*size)
+	}
+	if want := []string{filepath.Join(source, "big.bin")}; !reflect.DeepEqual(big.Keep, want) {
+		t.Errorf("largest group keeps %q, want %q", big.Keep, want)
+	}
+	want := []string{filepath.Join(dest, "w.bin"), filepath.Join(dest, "x.bin"), filepath.Join(dest, "y", "z.bin")}
+	if !reflect.DeepEqual(big.Replace, want) {
+		t.Errorf("largest group replaces %q, want %q", big.Replace, want)
+	}
+	if groups[1].Reclaimable != int64(len("two")) {
+		t.Errorf("second group reclaims %d bytes, want %d", groups[1].Reclaimable, len("two"))
+	}
+}
+
+// setModTime sets the modification time of the file at path.
+func setModTime(t *testing.T, path string, modTime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChooseCanonical(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"mid.txt": "same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same", "longer/name.txt": "same"})
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	setModTime(t, filepath.Join(dest, "longer", "name.txt"), base)
+	setModTime(t, filepath.Join(dest, "a.txt"), base.Add(time.Hour))
+	setModTime(t, filepath.Join(source, "mid.txt"), base.Add(2*time.Hour))
+
+	tests := []struct {
+		policy KeepPolicy
+		keep   string
+	}{
+		{KeepFirst, "source/mid.txt"},
+		{KeepSource, "source/mid.txt"},
+		{KeepDest, "dest/a.txt"},
+		{KeepOldest, "dest/longer/name.txt"},
+		{KeepNewest, "source/mid.txt"},
+		{KeepShortestPath, "dest/a.txt"},
+		{KeepLongestPath, "dest/longer/name.txt"},
+	}
+	all := []string{"dest/a.txt", "dest/longer/name.txt", "source/mid.txt"}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			sourceFiles, destFiles := scanBoth(t, source, dest)
+			duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchContent})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			for _, path := range all {
+				if path != test.keep {
+					want = append(want, path+" <- "+test.keep)
+				}
+			}
+			got := pairedPaths(t, dir, ChooseCanonical(duplicates, sourceFiles, destFiles, test.policy))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKeepPolicyBreaksTiesByPath(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"b.txt": "same", "a.txt": "same", "c.txt": "same"})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		setModTime(t, filepath.Join(root, name), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+
+	for _, policy := range []KeepPolicy{KeepOldest, KeepNewest, KeepShortestPath, KeepLongestPath} {
+		want := []string{"b.txt <- a.txt", "c.txt <- a.txt"}
+		if got := pairedPaths(t, root, findWithin(t, root, policy)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", policy, got, want)
+		}
+	}
+}
+
+func TestMatchSizeMTime(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	// Equal sizes throughout; only the times tell the pairs apart
+	writeFiles(t, source, map[string]string{"same-time.txt": "aaaa", "other-time.txt": "bbbb"})
+	writeFiles(t, dest, map[string]string{"same-time.txt": "cccc", "other-time.txt": "bbbb"})
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	setModTime(t, filepath.Join(source, "same-time.txt"), modTime)
+	setModTime(t, filepath.Join(dest, "same-time.txt"), modTime)
+	setModTime(t, filepath.Join(source, "other-time.txt"), modTime)
+	setModTime(t, filepath.Join(dest, "other-time.txt"), modTime.Add(time.Second))
+
+	want := []string{"dest/same-time.txt <- source/same-time.txt"}
+	if got := pairedPaths(t, dir, findBetween(t, source, dest, MatchOptions{Mode: MatchSizeMTime})); !reflect.DeepEqual(got, want) {
+		t.Errorf("found %q, want %q", got, want)
+	}
+
+	// A single file is scanned with its time too
+	files, _, err := Scan(context.Background(), filepath.Join(source, "same-time.txt"), ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := files["same-time.txt"]; got == nil || !got.ModTime.Equal(modTime) {
+		t.Errorf("scanning a single file gave %+v, want modification time %v", got, modTime)
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{
+		"same.txt":      "same",
+		"edited.txt":    "before",
+		"resized.txt":   "short",
+		"removed.txt":   "gone",
+		"sub/moved.txt": "moved",
+	})
+	writeFiles(t, dest, map[string]string{
+		"same.txt":    "same",
+		"edited.txt":  "after!",
+		"resized.txt": "much longer",
+		"added.txt":   "new",
+		"moved.txt":   "moved",
+	})
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+
+	diff, err := DiffTrees(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TreeDiff{
+		OnlySource: []string{"removed.txt", filepath.Join("sub", "moved.txt")},
+		OnlyDest:   []string{"added.txt", "moved.txt"},
+		Modified:   []string{"edited.txt", "resized.txt"},
+		Identical:  []string{"same.txt"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffTrees = %+v, want %+v", diff, want)
+	}
+}
+
+func TestFindDuplicatesSortedByDestination(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	files := make(map[string]string)
+	for i := range 30 {
+		// Sizes vary so the order found can't follow the paths by chance
+		files[fmt.Sprintf("dir%d/file%02d.txt", i%4, i)] = strings.Repeat("x", 30-i)
+	}
+	writeFiles(t, source, files)
+	writeFiles(t, dest, files)
+
+	want := make([]string, 0, len(files))
+	for relPath := range files {
+		want = append(want, filepath.Join(dest, filepath.FromSlash(relPath)))
+	}
+	sort.Strings(want)
+	for range 3 {
+		duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath, Jobs: 4})
+		got := make([]string, len(duplicates))
+		for i, dup := range duplicates {
+			got[i] = dup.Destination
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("duplicates in order %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFindDuplicatesConcurrentHashing(t *testing.T) {
+	const files = 300
+	source, dest := writeFixture(t, files, 0.5)
+	dir := filepath.Dir(source)
+
+	// The reference compares the two files at every path byte by byte
+	var want []string
+	for i := range files {
+		relPath := filepath.Join(fmt.Sprintf("dir%03d", i/100), fmt.Sprintf("file%05d", i))
+		if readFile(t, filepath.Join(source, relPath)) == readFile(t, filepath.Join(dest, relPath)) {
+			want = append(want, filepath.ToSlash(filepath.Join("dest", relPath)+" <- "+filepath.Join("source", relPath)))
+		}
+	}
+	sort.Strings(want)
+	if len(want) != files/2 {
+		t.Fatalf("the fixture has %d duplicates, want %d", len(want), files/2)
+	}
+
+	for _, mode := range []MatchMode{MatchRelPath, MatchName, MatchContent} {
+		for _, opts := range []MatchOptions{{Jobs: 1}, {Jobs: 8}, {Jobs: 8, OpenLimit: NewOpenLimiter(2)}} {
+			opts.Mode = mode
+			t.Run(fmt.Sprintf("%s with %d jobs, limiting open files %v", mode, opts.Jobs, opts.OpenLimit != nil), func(t *testing.T) {
+				got := pairedPaths(t, dir, findBetween(t, source, dest, opts))
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("found %d duplicates, want the %d the reference found", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestFindDuplicatesReportsUnhashableFilesOnce(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "aaa", "b.txt": "bbb", "c.txt": "ccc"})
+	writeFiles(t, dest, map[string]string{"a.txt": "aaa", "gone.txt": "ggg"})
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	// Removed after the scan, so hashing it fails
+	if err := os.Remove(filepath.Join(dest, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []error
+	duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{
+		Mode: MatchContent,
+		Jobs: 4,
+		Warn: func(err error) { warnings = append(warnings, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pairedPaths(t, dir, duplicates); !reflect.DeepEqual(got, []string{"dest/a.txt <- source/a.txt"}) {
+		t.Errorf("found %q, want only a.txt", got)
+	}
+	// Three sources could pair with it, but it is reported once
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "gone.txt") {
+		t.Errorf("warnings = %v, want one about gone.txt", warnings)
+	}
+}
+
+func TestSizeMismatches(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "1", "sub/b.txt": "22", "c.txt": "same", "only.txt": "x"})
+	writeFiles(t, dest, map[string]string{"a.txt": "111", "sub/b.txt": "2", "c.txt": "diff", "moved/a.txt": "1111", "new.txt": "y"})
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+
+	tests := []struct {
+		mode MatchMode
+		want []SizeMismatch
+	}{
+		{MatchRelPath, []SizeMismatch{
+			{RelPath: "a.txt", Source: filepath.Join(source, "a.txt"), Dest: filepath.Join(dest, "a.txt"), SourceSize: 1, DestSize: 3},
+			{RelPath: filepath.Join("sub", "b.txt"), Source: filepath.Join(source, "sub", "b.txt"), Dest: filepath.Join(dest, "sub", "b.txt"), SourceSize: 2, DestSize: 1},
+		}},
+		{MatchName, []SizeMismatch{
+			{RelPath: "a.txt", Source: filepath.Join(source, "a.txt"), Dest: filepath.Join(dest, "a.txt"), SourceSize: 1, DestSize: 3},
+			{RelPath: filepath.Join("moved", "a.txt"), Source: filepath.Join(source, "a.txt"), Dest: filepath.Join(dest, "moved", "a.txt"), SourceSize: 1, DestSize: 4},
+			{RelPath: filepath.Join("sub", "b.txt"), Source: filepath.Join(source, "sub", "b.txt"), Dest: filepath.Join(dest, "sub", "b.txt"), SourceSize: 2, DestSize: 1},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			// c.txt has the same size, so it isn't reported even though its
+			// contents differ
+			if got := SizeMismatches(sourceFiles, destFiles, MatchOptions{Mode: test.mode}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SizeMismatches = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindDuplicatesWithin(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "same", "b.txt": "only in source"})
+	writeFiles(t, dest, map[string]string{
+		"a.txt":     "same",
+		"copy.txt":  "same",
+		"x.txt":     "other",
+		"sub/y.txt": "other",
+		"z.txt":     "unique",
+	})
+
+	sourceFiles, destFiles := scanBoth(t, source, dest)
+	ctx := context.Background()
+	duplicates, err := FindDuplicates(ctx, sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicates, err = FindDuplicatesWithin(ctx, destFiles, duplicates, KeepFirst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy of a paired file goes to the source, not the paired copy
+	want := []string{
+		"dest/a.txt <- source/a.txt",
+		"dest/copy.txt <- source/a.txt",
+		"dest/x.txt <- dest/sub/y.txt",
+	}
+	if got := pairedPaths(t, dir, duplicates); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindDuplicatesWithin paired %q, want %q", got, want)
+	}
+	for i := 1; i < len(duplicates); i++ {
+		if duplicates[i-1].Destination > duplicates[i].Destination {
+			t.Errorf("duplicates not sorted by destination: %s before %s", duplicates[i-1].Destination, duplicates[i].Destination)
+		}
+	}
+}
+
+func TestFindDuplicatesPrefixHash(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"same.bin": "header: same tail", "diff.bin": "header: one tail"})
+	writeFiles(t, dest, map[string]string{"same.bin": "header: same tail", "diff.bin": "header: two tail"})
+
+	exact := []string{"dest/same.bin <- source/same.bin"}
+	approximate := []string{"dest/diff.bin <- source/diff.bin", "dest/same.bin <- source/same.bin"}
+	tests := []struct {
+		prefix int64
+		want   []string
+	}{
+		{0, exact},
+		{int64(len("header: ")), approximate},
+		// A prefix longer than the files hashes them whole
+		{1 << 20, exact},
+	}
+	for _, test := range tests {
+		sourceFiles, destFiles, _, err := ScanAll(context.Background(), []string{source}, []string{dest}, ScanOptions{PrefixHash: test.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		duplicates, err := FindDuplicates(context.Background(), sourceFiles, destFiles, MatchOptions{Mode: MatchRelPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pairedPaths(t, dir, duplicates); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("PrefixHash %d: paired %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
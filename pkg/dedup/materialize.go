@@ -0,0 +1,87 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InternalLink is a symlink whose target resolves to a regular file under
+// the same root, such as one created by Apply within a single tree.
+type InternalLink struct {
+	Path   string // The symlink
+	Target string // The regular file it resolves to
+}
+
+// FindInternalLinks returns the symlinks under root, in lexical order, that
+// resolve to regular files under root. Broken links and those that can't be
+// resolved are passed to warnFn; links leaving root are skipped.
+func FindInternalLinks(ctx context.Context, root string, warnFn func(error)) ([]InternalLink, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %s: %w", root, err)
+	}
+	resolvedRoot, err = filepath.Abs(resolvedRoot)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %s: %w", root, err)
+	}
+
+	var links []InternalLink
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			warn(warnFn, fmt.Errorf("could not resolve symlink %s: %w", path, err))
+			return nil
+		}
+		target, err = filepath.Abs(target)
+		if err != nil {
+			warn(warnFn, fmt.Errorf("could not resolve symlink %s: %w", path, err))
+			return nil
+		}
+		rel, err := filepath.Rel(resolvedRoot, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			warn(warnFn, fmt.Errorf("could not get info for %s: %w", target, err))
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			links = append(links, InternalLink{Path: path, Target: target})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// Materialize replaces link with an independent copy of its target, with
+// the target's mode, modification time and extended attributes. The copy is
+// renamed over the link, so the path is never missing.
+func Materialize(link InternalLink) error {
+	info, err := os.Stat(link.Target)
+	if err != nil {
+		return fmt.Errorf("error accessing %s: %w", link.Target, err)
+	}
+	xattrs, err := readXattrs(link.Target)
+	if err != nil {
+		return err
+	}
+	return copyReplace(link.Target, link.Path, info.Mode().Perm(), info.ModTime(), xattrs)
+}
@@ -0,0 +1,43 @@
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaterialize(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	writeFiles(t, root, map[string]string{"original.txt": "shared"})
+	writeFiles(t, dir, map[string]string{"outside.txt": "elsewhere"})
+	symlink(t, filepath.Join("..", "original.txt"), filepath.Join(root, "sub", "copy.txt"))
+	symlink(t, filepath.Join(dir, "outside.txt"), filepath.Join(root, "outside-link.txt"))
+
+	links, err := FindInternalLinks(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Path != filepath.Join(root, "sub", "copy.txt") {
+		t.Fatalf("found links %+v, want only sub/copy.txt", links)
+	}
+	if err := Materialize(links[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	copyPath := filepath.Join(root, "sub", "copy.txt")
+	if isSymlink(copyPath) || readFile(t, copyPath) != "shared" {
+		t.Fatal("link wasn't replaced by a copy of its target")
+	}
+	// The copies are now independent
+	if err := os.WriteFile(copyPath, []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "original.txt")); got != "shared" {
+		t.Errorf("editing the copy changed the original to %q", got)
+	}
+	if !isSymlink(filepath.Join(root, "outside-link.txt")) {
+		t.Error("a link leaving the root was materialized")
+	}
+}
@@ -0,0 +1,149 @@
+package dedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// PlanVersion is the plan format WriteTo produces and ReadPlan accepts.
+const PlanVersion = 1
+
+// PlanEntry is a duplicate recorded in a plan, with what is known about both
+// files when it was planned.
+type PlanEntry struct {
+	Source        string        `json:"source"`
+	Destination   string        `json:"destination"`
+	RelPath       string        `json:"rel_path"`
+	Size          int64         `json:"size"`
+	Hash          string        `json:"hash"`
+	Algorithm     HashAlgorithm `json:"algorithm"`
+	SourceModTime time.Time     `json:"source_mod_time"`
+	DestModTime   time.Time     `json:"dest_mod_time"`
+}
+
+// Plan lists the replacements a dry run decided on, so they can be reviewed
+// and applied later, or on another machine sharing the same paths.
+type Plan struct {
+	Version       int         `json:"version"`
+	Created       time.Time   `json:"created"`
+	Link          LinkType    `json:"link"`
+	RelativeLinks bool        `json:"relative_links,omitempty"`
+	LinkBase      string      `json:"link_base,omitempty"`
+	Entries       []PlanEntry `json:"duplicates"`
+}
+
+// NewPlan returns an empty plan replacing duplicates as opts would.
+func NewPlan(opts ApplyOptions) *Plan {
+	link := opts.Link
+	if link == "" {
+		link = LinkSymlink
+	}
+	return &Plan{
+		Version:       PlanVersion,
+		Created:       time.Now(),
+		Link:          link,
+		RelativeLinks: opts.RelativeLinks,
+		LinkBase:      opts.LinkBase,
+	}
+}
+
+// Add records dup in the plan. A duplicate found without reading its files,
+// such as under MatchSizeMTime, is hashed now so the plan can be checked
+// against the files when it is applied; it is an error if its two files
+// turn out to differ.
+func (p *Plan) Add(dup Duplicate) error {
+	if dup.Hash == "" {
+		algorithm := dup.Algorithm
+		if algorithm == "" {
+			algorithm = HashXXH64
+		}
+		hash, err := hashFile(dup.Source, algorithm, 0, nil, 0)
+		if err != nil {
+			return err
+		}
+		destHash, err := hashFile(dup.Destination, algorithm, 0, nil, 0)
+		if err != nil {
+			return err
+		}
+		if hash != destHash {
+			return fmt.Errorf("%s and %s differ, so %s isn't planned", dup.Source, dup.Destination, dup.Destination)
+		}
+		dup.Hash, dup.Algorithm = hash, algorithm
+	}
+	p.Entries = append(p.Entries, PlanEntry{
+		Source:        dup.Source,
+		Destination:   dup.Destination,
+		RelPath:       dup.RelPath,
+		Size:          dup.Size,
+		Hash:          dup.Hash,
+		Algorithm:     dup.Algorithm,
+		SourceModTime: dup.SourceModTime,
+		DestModTime:   dup.DestModTime,
+	})
+	return nil
+}
+
+// Duplicates returns the planned duplicates, in the order they were added.
+func (p *Plan) Duplicates() []Duplicate {
+	duplicates := make([]Duplicate, len(p.Entries))
+	for i, entry := range p.Entries {
+		duplicates[i] = Duplicate{
+			Source:        entry.Source,
+			Destination:   entry.Destination,
+			RelPath:       entry.RelPath,
+			Size:          entry.Size,
+			Hash:          entry.Hash,
+			Algorithm:     entry.Algorithm,
+			SourceModTime: entry.SourceModTime,
+			DestModTime:   entry.DestModTime,
+		}
+	}
+	return duplicates
+}
+
+// Options returns opts with the link settings the plan was made with.
+func (p *Plan) Options(opts ApplyOptions) ApplyOptions {
+	opts.Link = p.Link
+	opts.RelativeLinks = p.RelativeLinks
+	opts.LinkBase = p.LinkBase
+	return opts
+}
+
+// WriteTo writes the plan to w as JSON.
+func (p *Plan) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("error encoding plan: %w", err)
+	}
+	n, err := w.Write(append(data, '\n'))
+	if err != nil {
+		return int64(n), fmt.Errorf("error writing plan: %w", err)
+	}
+	return int64(n), nil
+}
+
+// ReadPlan reads a plan written by WriteTo, rejecting versions it doesn't
+// understand and entries that couldn't be checked against the files.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	var p Plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("error parsing plan: %w", err)
+	}
+	if p.Version != PlanVersion {
+		return nil, fmt.Errorf("unsupported plan version %d (expected %d)", p.Version, PlanVersion)
+	}
+	if _, err := ParseLinkType(string(p.Link)); err != nil {
+		return nil, fmt.Errorf("error parsing plan: %w", err)
+	}
+	for _, entry := range p.Entries {
+		if entry.Hash == "" {
+			return nil, fmt.Errorf("error parsing plan: %s has no hash", entry.Destination)
+		}
+		if _, err := ParseHashAlgorithm(string(entry.Algorithm)); err != nil {
+			return nil, fmt.Errorf("error parsing plan: %s: %w", entry.Destination, err)
+		}
+	}
+	return &p, nil
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "same", "b.txt": "also same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same", "b.txt": "also same"})
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, root := range []string{source, dest} {
+		for _, name := range []string{"a.txt", "b.txt"} {
+			setModTime(t, filepath.Join(root, name), modTime)
+		}
+	}
+	// Size-and-time matching reads nothing, so Add hashes the files itself
+	duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchSizeMTime})
+	if len(duplicates) != 2 {
+		t.Fatalf("found %d duplicates, want 2", len(duplicates))
+	}
+
+	plan := NewPlan(ApplyOptions{Link: LinkHardlink, RelativeLinks: true, LinkBase: dir})
+	for _, dup := range duplicates {
+		if err := plan.Add(dup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := plan.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := read.Options(ApplyOptions{})
+	if opts.Link != LinkHardlink || !opts.RelativeLinks || opts.LinkBase != dir {
+		t.Errorf("options = %+v, want the plan's link settings", opts)
+	}
+	got := read.Duplicates()
+	if len(got) != len(duplicates) {
+		t.Fatalf("read %d duplicates, want %d", len(got), len(duplicates))
+	}
+	for i, dup := range got {
+		want := duplicates[i]
+		if dup.Source != want.Source || dup.Destination != want.Destination || dup.RelPath != want.RelPath || dup.Size != want.Size ||
+			!dup.SourceModTime.Equal(want.SourceModTime) || !dup.DestModTime.Equal(want.DestModTime) {
+			t.Errorf("duplicate %d = %+v, want %+v", i, dup, want)
+		}
+		if dup.Hash == "" || dup.Algorithm != HashXXH64 {
+			t.Errorf("duplicate %d has hash %q by %q, want one computed when it was planned", i, dup.Hash, dup.Algorithm)
+		}
+	}
+
+	// The plan is stale for a file rewritten since, even at the same size
+	// and time
+	writeFiles(t, dest, map[string]string{"a.txt": "SAME"})
+	setModTime(t, filepath.Join(dest, "a.txt"), modTime)
+	outcomes := make(map[string]Outcome)
+	opts.Rehash = true
+	opts.OnResult = func(r Result) { outcomes[filepath.Base(r.Destination)] = r.Outcome }
+	summary := Apply(context.Background(), got, opts)
+	if outcomes["a.txt"] != SkippedChanged || outcomes["b.txt"] != Replaced || summary.Replaced != 1 {
+		t.Errorf("outcomes = %v, want a.txt skipped as changed and b.txt replaced", outcomes)
+	}
+}
+
+func TestReadPlanErrors(t *testing.T) {
+	tests := []struct {
+		name, plan, want string
+	}{
+		{"unknown version", `{"version": 2, "link": "symlink"}`, "unsupported plan version 2"},
+		{"unknown link", `{"version": 1, "link": "reflink"}`, "reflink"},
+		{"unhashed entry", `{"version": 1, "link": "symlink", "duplicates": [{"source": "a", "destination": "b"}]}`, "b"},
+		{"malformed", `{"version": `, "error parsing plan"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadPlan(strings.NewReader(test.plan))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+	if _, err := ReadPlan(strings.NewReader("")); err == nil {
+		t.Errorf("an empty plan was read: %v", err)
+	}
+}
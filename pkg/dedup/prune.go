@@ -0,0 +1,85 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PruneEmptyDirs removes the directories that held paths and are now empty,
+// then any of their parents left empty in turn, deepest first. Only
+// directories below one of roots are considered, and the roots themselves
+// are never removed. Directories that can't be removed are passed to warnFn.
+// It returns the directories removed.
+func PruneEmptyDirs(roots, paths []string, warnFn func(error)) []string {
+	candidates := make(map[string]bool)
+	for _, path := range paths {
+		root, ok := containingRoot(roots, path)
+		if !ok {
+			continue
+		}
+		for dir := filepath.Dir(filepath.Clean(path)); dir != root && !candidates[dir]; dir = filepath.Dir(dir) {
+			candidates[dir] = true
+		}
+	}
+
+	dirs := make([]string, 0, len(candidates))
+	for dir := range candidates {
+		dirs = append(dirs, dir)
+	}
+	// Children sort after their parents, so reverse order removes them first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	var removed []string
+	for _, dir := range dirs {
+		empty, err := isEmptyDir(dir)
+		if err == nil && empty {
+			err = os.Remove(dir)
+			if err == nil {
+				removed = append(removed, dir)
+				continue
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			warn(warnFn, fmt.Errorf("could not remove empty directory %s: %w", dir, err))
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// containingRoot returns the cleaned root that path is below, if any.
+func containingRoot(roots []string, path string) (string, bool) {
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if filepath.Clean(path) != root && isWithin(root, path) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// isWithin reports whether path is dir or inside it. Both must be absolute
+// or both relative to the same directory.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isEmptyDir reports whether the directory at path has no entries.
+func isEmptyDir(path string) (bool, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,53 @@
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPruneEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	root, emptied, outside := filepath.Join(dir, "root"), filepath.Join(dir, "emptied"), filepath.Join(dir, "outside")
+	writeFiles(t, root, map[string]string{
+		"a/b/c/deleted.txt": "x",
+		"a/kept.txt":        "x",
+		"x/deleted.txt":     "x",
+		"deleted.txt":       "x",
+	})
+	writeFiles(t, emptied, map[string]string{"deleted.txt": "x"})
+	writeFiles(t, outside, map[string]string{"sub/deleted.txt": "x"})
+	deleted := []string{
+		filepath.Join(root, "a", "b", "c", "deleted.txt"),
+		filepath.Join(root, "x", "deleted.txt"),
+		filepath.Join(root, "deleted.txt"),
+		filepath.Join(emptied, "deleted.txt"),
+		filepath.Join(outside, "sub", "deleted.txt"),
+	}
+	for _, path := range deleted {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var warnings []error
+	removed := PruneEmptyDirs([]string{root, emptied}, deleted, func(err error) { warnings = append(warnings, err) })
+	want := []string{
+		filepath.Join(root, "a", "b"),
+		filepath.Join(root, "a", "b", "c"),
+		filepath.Join(root, "x"),
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %q, want %q", removed, want)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings: %v", warnings)
+	}
+	// Roots are never removed, even left empty, nor is anything outside them
+	for _, path := range []string{root, emptied, filepath.Join(root, "a"), filepath.Join(outside, "sub")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package dedup
+
+import "time"
+
+// retry calls op until it succeeds, fails with an error that isn't
+// transient, or has been retried retries times. It waits delay before the
+// first retry and twice as long before each one after, and returns the error
+// of the last call.
+func retry(retries int, delay time.Duration, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= retries || !transient(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	busy := &os.PathError{Op: "remove", Path: "a.txt", Err: syscall.EBUSY}
+	missing := fmt.Errorf("failed to replace a.txt: %w", &os.PathError{Op: "remove", Path: "a.txt", Err: syscall.ENOENT})
+	tests := []struct {
+		name    string
+		retries int
+		errs    []error // Returned by successive calls, then nil
+		calls   int
+		wantErr error
+	}{
+		{"success", 3, nil, 1, nil},
+		{"transient then success", 3, []error{busy, busy}, 3, nil},
+		{"transient past the retries", 2, []error{busy, busy, busy, busy}, 3, busy},
+		{"permanent", 3, []error{missing, busy}, 1, missing},
+		{"no retries", 0, []error{busy}, 1, busy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := retry(test.retries, 0, func() error {
+				calls++
+				if calls <= len(test.errs) {
+					return test.errs[calls-1]
+				}
+				return nil
+			})
+			if err != test.wantErr {
+				t.Errorf("err = %v, want %v", err, test.wantErr)
+			}
+			if calls != test.calls {
+				t.Errorf("op called %d times, want %d", calls, test.calls)
+			}
+		})
+	}
+}
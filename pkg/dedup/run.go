@@ -0,0 +1,123 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RunOptions configures every phase of Run.
+type RunOptions struct {
+	Scan  ScanOptions
+	Match MatchOptions
+	Apply ApplyOptions
+
+	Keep      KeepPolicy // Which copy the others are linked to; empty means KeepFirst
+	Direction Direction  // Between trees, which side is replaced; empty means SourceWins
+}
+
+// RunResult summarizes a Run.
+type RunResult struct {
+	Scanned      int   // Files kept by the scans
+	ScannedBytes int64 // Total size of those files
+	Duplicates   int   // Duplicates found, replaced or not
+	Replaced     int   // Duplicates replaced, or that would be under DryRun
+	Skipped      int   // Duplicates left alone, such as those Verify found to differ
+	Failed       int   // Duplicates that couldn't be replaced
+	Reclaimed    int64 // Bytes freed by the replacements
+
+	ScanStats ScanStats
+
+	// How long each phase took
+	ScanTime  time.Duration
+	MatchTime time.Duration
+	ApplyTime time.Duration
+
+	Errs []error // Why each Failed duplicate wasn't replaced
+}
+
+// Err joins the errors of every failed replacement, or returns nil if none
+// failed.
+func (r RunResult) Err() error {
+	return errors.Join(r.Errs...)
+}
+
+// Run scans sourcePaths and destPaths, pairs their duplicates and replaces
+// them, as a caller chaining ScanAll, FindDuplicates and Apply would. Without
+// destPaths it instead links the copies within the single tree in
+// sourcePaths to each other. The error is only set if a phase couldn't run
+// at all; failed replacements are counted in the result.
+func Run(ctx context.Context, sourcePaths, destPaths []string, opts RunOptions) (RunResult, error) {
+	var result RunResult
+	if len(destPaths) == 0 && len(sourcePaths) != 1 {
+		return result, fmt.Errorf("a single tree must be one path, got %d", len(sourcePaths))
+	}
+
+	began := time.Now()
+	var scanned []map[string]*FileMetadata
+	var sourceFiles, destFiles map[string]*FileMetadata
+	var err error
+	if len(destPaths) == 0 {
+		sourceFiles, result.ScanStats, err = Scan(ctx, sourcePaths[0], opts.Scan)
+		scanned = append(scanned, sourceFiles)
+	} else {
+		sourceFiles, destFiles, result.ScanStats, err = ScanAll(ctx, sourcePaths, destPaths, opts.Scan)
+		scanned = append(scanned, sourceFiles, destFiles)
+	}
+	result.ScanTime = time.Since(began)
+	if err != nil {
+		return result, err
+	}
+	for _, files := range scanned {
+		for _, metadata := range files {
+			result.Scanned++
+			result.ScannedBytes += metadata.Size
+		}
+	}
+
+	keep := opts.Keep
+	if keep == "" {
+		keep = KeepFirst
+	}
+	began = time.Now()
+	var duplicates []Duplicate
+	if len(destPaths) == 0 {
+		var groups [][]*FileMetadata
+		groups, err = GroupIdentical(ctx, sourceFiles, opts.Match.Warn)
+		duplicates = LinkToCanonical(groups, keep)
+	} else {
+		duplicates, err = FindDuplicates(ctx, sourceFiles, destFiles, opts.Match)
+		if opts.Direction == DestWins {
+			duplicates = Reverse(duplicates, sourceFiles)
+		} else {
+			duplicates = ChooseCanonical(duplicates, sourceFiles, destFiles, keep)
+		}
+	}
+	result.MatchTime = time.Since(began)
+	if err != nil {
+		return result, err
+	}
+	result.Duplicates = len(duplicates)
+
+	applyOpts := opts.Apply
+	applyOpts.OnResult = func(r Result) {
+		switch r.Outcome {
+		case Replaced, Planned:
+		case Failed:
+			result.Failed++
+		default:
+			result.Skipped++
+		}
+		if opts.Apply.OnResult != nil {
+			opts.Apply.OnResult(r)
+		}
+	}
+	began = time.Now()
+	summary := Apply(ctx, duplicates, applyOpts)
+	result.ApplyTime = time.Since(began)
+	result.Replaced = summary.Replaced
+	result.Reclaimed = summary.Reclaimed
+	result.Errs = summary.Errs
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "aaaa", "b.txt": "bb", "c.txt": "original", "d.txt": "d"})
+	writeFiles(t, dest, map[string]string{"a.txt": "aaaa", "b.txt": "bb", "c.txt": "changed!", "e.txt": "e"})
+
+	result, err := Run(context.Background(), []string{source}, []string{dest}, RunOptions{
+		Match: MatchOptions{Mode: MatchRelPath},
+		Apply: ApplyOptions{
+			Link:          LinkHardlink,
+			ShouldReplace: func(dup Duplicate) bool { return filepath.Base(dup.Destination) != "b.txt" },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := RunResult{
+		Scanned:      8,
+		ScannedBytes: 2 * (4 + 2 + 8 + 1),
+		Duplicates:   2,
+		Replaced:     1,
+		Skipped:      1,
+		Reclaimed:    4,
+	}
+	got := result
+	got.ScanStats, got.ScanTime, got.MatchTime, got.ApplyTime, got.Errs = ScanStats{}, 0, 0, 0, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result = %+v, want %+v", got, want)
+	}
+	sourceInfo, err := os.Stat(filepath.Join(source, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destInfo, err := os.Stat(filepath.Join(dest, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(sourceInfo, destInfo) {
+		t.Error("dest/a.txt wasn't replaced by a hard link")
+	}
+}
+
+func TestRunSingleTree(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "same", "sub/b.txt": "same", "c.txt": "other"})
+
+	result, err := Run(context.Background(), []string{root}, nil, RunOptions{Apply: ApplyOptions{Link: LinkHardlink, DryRun: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Scanned != 3 || result.Duplicates != 1 || result.Replaced != 1 || result.Reclaimed != 4 {
+		t.Errorf("result = %+v, want 3 files scanned and one 4-byte duplicate planned", result)
+	}
+	if isSymlink(filepath.Join(root, "sub", "b.txt")) || isSymlink(filepath.Join(root, "a.txt")) {
+		t.Error("a dry run replaced a file")
+	}
+
+	if _, err := Run(context.Background(), []string{root, root}, nil, RunOptions{}); err == nil {
+		t.Error("Run accepted two paths without a destination")
+	}
+}
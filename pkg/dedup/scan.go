@@ -0,0 +1,676 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ScanOptions controls which regular files Scan keeps.
+type ScanOptions struct {
+	MinSize int64    // Skip files smaller than this many bytes
+	MaxSize int64    // Skip files larger than this many bytes; 0 means no limit
+	Exclude []string // Glob patterns of relative paths to skip
+	Include []string // If set, only files matching one of these globs are kept
+	// Extensions, if set, keeps only files whose names end in one of them,
+	// ignoring case. The leading dot is optional, so "jpg" and ".JPG" are
+	// the same, and an extension may have several parts, as "tar.gz" does.
+	Extensions []string
+	// SkipEmpty skips zero-byte files, which all have the same contents and
+	// so would otherwise all be duplicates of one another.
+	SkipEmpty bool
+	// IgnoreFile names a file, such as ".dedupignore", whose rules are read
+	// from each scanned root and excluded along with Exclude. The file
+	// itself is never kept.
+	IgnoreFile string
+	// ExcludeRules are excluded along with Exclude in every scanned root,
+	// such as the rules of a shared file read with ReadIgnoreFile. Their
+	// negations only re-include what an earlier rule of theirs excluded.
+	ExcludeRules IgnoreRules
+	Jobs         int // Number of directories read concurrently
+
+	FollowSymlinks bool          // Resolve symlinks and descend into symlinked directories
+	OneFileSystem  bool          // Don't descend into directories on another device than the root
+	MaxDepth       int           // Levels of directories read, counting the root as one; 0 means no limit
+	Cache          *HashCache    // Reuse hashes computed by earlier runs, if set
+	Hash           HashAlgorithm // Hash used to compare contents; empty means HashXXH64
+	BufferSize     int           // Bytes read at a time when hashing; 0 means DefaultBufferSize
+	ReadLimit      *ReadLimiter  // Throttles the reads of hashing the files found, if set
+	// PrefixHash, if positive, hashes only the first PrefixHash bytes of
+	// each file, so files of the same size that merely start alike are
+	// taken as duplicates. It trades accuracy for speed on large files: the
+	// duplicates of larger files carry no hash, and should be replaced only
+	// with ApplyOptions.Verify.
+	PrefixHash int64
+	// InspectArchives also keeps the members of the .zip, .tar, .tar.gz and
+	// .tgz files found, under virtual paths joining the archive's path and
+	// the member's name with ArchiveSeparator. Members can only be
+	// reported: they aren't files on disk, so they can't be replaced.
+	InspectArchives bool
+	// OpenLimit, if set, bounds the archives InspectArchives has open at
+	// once. It may be shared with MatchOptions.OpenLimit.
+	OpenLimit *OpenLimiter
+
+	// Warn receives the problems that don't stop the scan, such as a file
+	// whose info can't be read. Unreadable subdirectories are collected in
+	// ScanStats.Unreadable instead. It may be called concurrently.
+	Warn func(error)
+	// OnFile, if set, is called with every file the scan keeps, so callers
+	// can report progress. It may be called concurrently.
+	OnFile func(*FileMetadata)
+	// OnDestFile, if set, is called in place of OnFile for the files
+	// ScanAll finds under its destination paths, so callers can follow the
+	// progress of each side. It may be called concurrently.
+	OnDestFile func(*FileMetadata)
+}
+
+// ScanStats counts the files Scan skipped because of ScanOptions, and lists
+// the directories it couldn't read.
+type ScanStats struct {
+	Empty          int // Zero-byte files skipped by SkipEmpty
+	TooSmall       int
+	TooLarge       int
+	Excluded       int // Files and directories matching an exclude pattern
+	NotIncluded    int // Files matching no include pattern
+	OtherExtension int // Files with none of the Extensions
+	// Symlinks FollowSymlinks couldn't follow because their target is
+	// missing. Without FollowSymlinks no symlink is ever kept, so none are
+	// counted.
+	BrokenSymlinks int
+	// Special files, which have no contents to compare. Devices counts
+	// block and character devices, and OtherSpecial anything else that is
+	// neither a regular file, a directory nor a symlink.
+	NamedPipes   int
+	Sockets      int
+	Devices      int
+	OtherSpecial int
+
+	Unreadable      []UnreadableDir // Sorted by path within each scanned root
+	OtherFileSystem []string        // Directories skipped by OneFileSystem, sorted likewise
+}
+
+// UnreadableDir is a subdirectory Scan skipped because it couldn't be read,
+// such as one whose permissions deny listing it.
+type UnreadableDir struct {
+	Path string
+	Err  error
+}
+
+// Add adds the counts and unreadable directories of other to stats.
+func (stats *ScanStats) Add(other ScanStats) {
+	stats.Empty += other.Empty
+	stats.TooSmall += other.TooSmall
+	stats.TooLarge += other.TooLarge
+	stats.Excluded += other.Excluded
+	stats.NotIncluded += other.NotIncluded
+	stats.OtherExtension += other.OtherExtension
+	stats.BrokenSymlinks += other.BrokenSymlinks
+	stats.NamedPipes += other.NamedPipes
+	stats.Sockets += other.Sockets
+	stats.Devices += other.Devices
+	stats.OtherSpecial += other.OtherSpecial
+	stats.Unreadable = append(stats.Unreadable, other.Unreadable...)
+	stats.OtherFileSystem = append(stats.OtherFileSystem, other.OtherFileSystem...)
+}
+
+// Special returns the number of special files skipped.
+func (stats ScanStats) Special() int {
+	return stats.NamedPipes + stats.Sockets + stats.Devices + stats.OtherSpecial
+}
+
+// countSpecial counts a skipped file with mode if it is a special file.
+func (stats *ScanStats) countSpecial(mode os.FileMode) {
+	switch {
+	case mode.IsRegular(), mode.IsDir(), mode&os.ModeSymlink != 0:
+	case mode&os.ModeNamedPipe != 0:
+		stats.NamedPipes++
+	case mode&os.ModeSocket != 0:
+		stats.Sockets++
+	case mode&os.ModeDevice != 0:
+		stats.Devices++
+	default:
+		stats.OtherSpecial++
+	}
+}
+
+// matchesExclude reports whether relPath matches any of the exclude patterns.
+func matchesExclude(relPath string, patterns []string) bool {
+	return matchesAnyPattern(relPath, patterns)
+}
+
+// matchesInclude reports whether relPath matches any of the include patterns.
+// An empty include list matches everything.
+func matchesInclude(relPath string, patterns []string) bool {
+	return len(patterns) == 0 || matchesAnyPattern(relPath, patterns)
+}
+
+// hasExtension reports whether the name of relPath ends in one of
+// extensions, ignoring case. An empty list matches everything.
+func hasExtension(relPath string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	name := strings.ToLower(filepath.Base(relPath))
+	for _, ext := range extensions {
+		ext = "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+		if len(name) > len(ext) && strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyPattern reports whether relPath matches any of patterns. Patterns
+// use filepath.Match syntax per path segment, and a "**" segment matches any
+// number of segments. A pattern without a slash matches at any depth, so
+// "*.lock" and "node_modules" behave like their .gitignore counterparts.
+func matchesAnyPattern(relPath string, patterns []string) bool {
+	pathSegments := strings.Split(filepath.ToSlash(relPath), "/")
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if matchSegments(strings.Split(pattern, "/"), pathSegments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if matched, err := filepath.Match(pattern[0], path[0]); err != nil || !matched {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// ValidatePattern reports a malformed glob before the scan starts, since
+// filepath.Match only surfaces ErrBadPattern when it is evaluated.
+func ValidatePattern(pattern string) error {
+	for _, segment := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// walker collects the files found under root that pass opts. Subdirectories
+// are walked concurrently, bounded by opts.Jobs. Like filepath.WalkDir it
+// works from the DirEntry values os.ReadDir returns, so only files that pass
+// the name filters are stat'ed; WalkDir itself isn't used because it reads
+// one directory at a time and can't follow symlinks for FollowSymlinks.
+type walker struct {
+	ctx  context.Context
+	root string
+	opts ScanOptions
+	sem  chan struct{} // Limits the number of concurrent directory walks
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex // Guards files, stats and visited
+	files   map[string]*FileMetadata
+	stats   ScanStats
+	visited map[string]bool // Directories walked with FollowSymlinks, so cycles end
+
+	ignore     IgnoreRules // Rules read from opts.IgnoreFile at root
+	rootDev    uint64      // Device holding root, if hasRootDev
+	hasRootDev bool        // Whether OneFileSystem can compare devices on this platform
+}
+
+// Scan returns every regular file under path keyed by its path relative to
+// path. A single file is keyed by its base name. With FollowSymlinks, a
+// directory reached again through a symlink or bind mount is skipped with a
+// warning. Once ctx is cancelled no further directories are read and ctx's
+// error is returned.
+func Scan(ctx context.Context, path string, opts ScanOptions) (map[string]*FileMetadata, ScanStats, error) {
+	if opts.Hash == "" {
+		opts.Hash = HashXXH64
+	}
+	w := &walker{
+		ctx:     ctx,
+		root:    path,
+		opts:    opts,
+		sem:     make(chan struct{}, max(opts.Jobs, 1)),
+		files:   make(map[string]*FileMetadata),
+		visited: make(map[string]bool),
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, ScanStats{}, fmt.Errorf("error accessing path %s: %w", path, err)
+	}
+
+	if opts.OneFileSystem {
+		w.rootDev, _, w.hasRootDev = fileID(fileInfo)
+	}
+
+	if !fileInfo.IsDir() {
+		if fileInfo.Mode().IsRegular() {
+			w.addFile(w.files, &w.stats, filepath.Base(path), path, fileInfo)
+		} else {
+			w.stats.countSpecial(fileInfo.Mode())
+		}
+		return w.files, w.stats, nil
+	}
+
+	if w.ignore, err = loadIgnoreRules(path, opts.IgnoreFile); err != nil {
+		return nil, ScanStats{}, err
+	}
+
+	err = w.walkDir("")
+	w.wg.Wait()
+	if err != nil {
+		return nil, ScanStats{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, ScanStats{}, err
+	}
+	sort.Slice(w.stats.Unreadable, func(i, j int) bool {
+		return w.stats.Unreadable[i].Path < w.stats.Unreadable[j].Path
+	})
+	sort.Strings(w.stats.OtherFileSystem)
+	return w.files, w.stats, nil
+}
+
+// ScanList returns the regular files among paths keyed by their path
+// relative to root, as if Scan had walked root and found only those files.
+// The options filter the list as they would a walk. Paths outside root and
+// files that can't be read are passed to opts.Warn and skipped.
+func ScanList(ctx context.Context, root string, paths []string, opts ScanOptions) (map[string]*FileMetadata, ScanStats, error) {
+	if opts.Hash == "" {
+		opts.Hash = HashXXH64
+	}
+	w := &walker{ctx: ctx, root: root, opts: opts}
+	if info, err := os.Stat(root); err == nil && info.IsDir() {
+		if w.ignore, err = loadIgnoreRules(root, opts.IgnoreFile); err != nil {
+			return nil, ScanStats{}, err
+		}
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, ScanStats{}, fmt.Errorf("error resolving path %s: %w", root, err)
+	}
+
+	files := make(map[string]*FileMetadata)
+	var stats ScanStats
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, ScanStats{}, err
+		}
+
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			warn(opts.Warn, fmt.Errorf("could not resolve %s: %w", path, err))
+			continue
+		}
+		relPath, err := filepath.Rel(absRoot, absPath)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			warn(opts.Warn, fmt.Errorf("skipping %s: not under %s", path, root))
+			continue
+		}
+		fullPath := filepath.Join(root, relPath)
+		if relPath == "." {
+			// A single file is keyed by its base name, as in Scan
+			relPath = filepath.Base(absPath)
+		}
+
+		if opts.tooDeep(filepath.Dir(relPath)) {
+			continue
+		}
+		// A walk would have pruned excluded directories before reaching the file
+		excluded := false
+		for dir := relPath; dir != "." && !excluded; dir = filepath.Dir(dir) {
+			excluded = w.excluded(dir)
+		}
+		if excluded {
+			stats.Excluded++
+			continue
+		}
+		if !matchesInclude(relPath, opts.Include) {
+			stats.NotIncluded++
+			continue
+		}
+		if !hasExtension(relPath, opts.Extensions) {
+			stats.OtherExtension++
+			continue
+		}
+
+		var info os.FileInfo
+		if opts.FollowSymlinks {
+			info, err = os.Stat(fullPath)
+			if errors.Is(err, os.ErrNotExist) && isSymlink(fullPath) {
+				stats.BrokenSymlinks++
+				continue
+			}
+		} else {
+			info, err = os.Lstat(fullPath)
+		}
+		if err != nil {
+			warn(opts.Warn, fmt.Errorf("could not get info for %s: %w", relPath, err))
+			continue
+		}
+		if info.Mode().IsRegular() {
+			w.addFile(files, &stats, relPath, fullPath, info)
+		} else {
+			stats.countSpecial(info.Mode())
+		}
+	}
+	return files, stats, nil
+}
+
+// isSymlink reports whether path is a symlink, whether or not its target
+// exists.
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// descend walks the subdirectory relDir, on a new goroutine if a slot is
+// free and inline otherwise so a saturated pool can never deadlock.
+func (w *walker) descend(relDir string) {
+	select {
+	case w.sem <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.sem }()
+			w.walkSubdir(relDir)
+		}()
+	default:
+		w.walkSubdir(relDir)
+	}
+}
+
+func (w *walker) walkSubdir(relDir string) {
+	if err := w.walkDir(relDir); err != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.stats.Unreadable = append(w.stats.Unreadable, UnreadableDir{Path: filepath.Join(w.root, relDir), Err: err})
+	}
+}
+
+// walkDir adds the regular files in root/relDir and its subdirectories,
+// keyed by their path relative to root.
+func (w *walker) walkDir(relDir string) error {
+	// Stop starting new work once cancelled; Scan reports the error
+	if w.ctx.Err() != nil {
+		return nil
+	}
+
+	dirPath := filepath.Join(w.root, relDir)
+	// Followed symlinks and bind mounts can lead back to a directory already
+	// walked; without FollowSymlinks the extra Stat isn't worth it
+	if w.opts.FollowSymlinks && !w.markVisited(dirPath) {
+		warn(w.opts.Warn, fmt.Errorf("skipping %s: directory already visited through another path", relDir))
+		return nil
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %w", dirPath, err)
+	}
+
+	// Collect this directory's results locally and merge them once
+	files := make(map[string]*FileMetadata)
+	var stats ScanStats
+
+	// Process each entry in the directory
+	for _, entry := range entries {
+		relPath := filepath.Join(relDir, entry.Name())
+		// Excluded directories are pruned without being read
+		if w.excluded(relPath) {
+			stats.Excluded++
+			continue
+		}
+		fullPath := filepath.Join(w.root, relPath)
+
+		isDir := entry.IsDir()
+		var info os.FileInfo
+		if w.opts.FollowSymlinks && entry.Type()&os.ModeSymlink != 0 {
+			// Resolve the link to find out what it points to
+			info, err = os.Stat(fullPath)
+			if errors.Is(err, os.ErrNotExist) {
+				stats.BrokenSymlinks++
+				continue
+			}
+			if err != nil {
+				warn(w.opts.Warn, fmt.Errorf("could not follow symlink %s: %w", relPath, err))
+				continue
+			}
+			isDir = info.IsDir()
+		}
+
+		if isDir {
+			if w.opts.tooDeep(relPath) {
+				continue
+			}
+			if w.hasRootDev && !w.sameDevice(entry, info) {
+				stats.OtherFileSystem = append(stats.OtherFileSystem, fullPath)
+				continue
+			}
+			w.descend(relPath)
+			continue
+		}
+		// Include patterns only select files; directories are always descended.
+		// Excludes were checked first, so they take precedence over includes.
+		if !matchesInclude(relPath, w.opts.Include) {
+			stats.NotIncluded++
+			continue
+		}
+		if !hasExtension(relPath, w.opts.Extensions) {
+			stats.OtherExtension++
+			continue
+		}
+		if info == nil {
+			info, err = entry.Info()
+			if err != nil {
+				warn(w.opts.Warn, fmt.Errorf("could not get info for %s: %w", relPath, err))
+				continue
+			}
+		}
+
+		if info.Mode().IsRegular() {
+			w.addFile(files, &stats, relPath, fullPath, info)
+		} else {
+			stats.countSpecial(info.Mode())
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, metadata := range files {
+		w.files[key] = metadata
+	}
+	w.stats.Add(stats)
+	return nil
+}
+
+// excluded reports whether relPath matches an exclude pattern or the ignore
+// file's rules, or is the ignore file itself.
+func (w *walker) excluded(relPath string) bool {
+	if w.opts.IgnoreFile != "" && relPath == w.opts.IgnoreFile {
+		return true
+	}
+	return matchesExclude(relPath, w.opts.Exclude) || w.opts.ExcludeRules.Ignores(relPath) || w.ignore.Ignores(relPath)
+}
+
+// tooDeep reports whether the directory relDir, relative to the root, is
+// beyond MaxDepth and so isn't read.
+func (opts ScanOptions) tooDeep(relDir string) bool {
+	if opts.MaxDepth <= 0 || relDir == "." || relDir == "" {
+		return false
+	}
+	depth := strings.Count(filepath.ToSlash(relDir), "/") + 1
+	return depth >= opts.MaxDepth
+}
+
+// sameDevice reports whether the directory entry is on the root's device.
+// info is the entry's resolved info if it is a followed symlink. Entries
+// whose device can't be read are treated as being on the root's device.
+func (w *walker) sameDevice(entry os.DirEntry, info os.FileInfo) bool {
+	if info == nil {
+		var err error
+		if info, err = entry.Info(); err != nil {
+			return true
+		}
+	}
+	dev, _, ok := fileID(info)
+	return !ok || dev == w.rootDev
+}
+
+// markVisited records the directory at dirPath as walked and reports whether
+// this is the first visit. Directories are identified by device and inode, or
+// by their resolved path where the platform doesn't provide those.
+func (w *walker) markVisited(dirPath string) bool {
+	var key string
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		// Let the caller's ReadDir report the problem
+		return true
+	}
+	if dev, ino, ok := fileID(info); ok {
+		key = fmt.Sprintf("%d:%d", dev, ino)
+	} else if key, err = filepath.EvalSymlinks(dirPath); err != nil {
+		return true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.visited[key] {
+		return false
+	}
+	w.visited[key] = true
+	return true
+}
+
+// addFile records a regular file in files under key unless the scan options
+// filter it out, in which case the reason is counted in stats.
+func (w *walker) addFile(files map[string]*FileMetadata, stats *ScanStats, key, path string, info os.FileInfo) {
+	if w.opts.InspectArchives && isArchive(path) {
+		w.addArchiveMembers(files, stats, key, path)
+	}
+	if !w.keepSize(stats, info.Size()) {
+		return
+	}
+	metadata := NewFileMetadata(key, path, info)
+	metadata.algorithm = w.opts.Hash
+	metadata.bufferSize = w.opts.BufferSize
+	metadata.cache = w.opts.Cache
+	metadata.readLimit = w.opts.ReadLimit
+	metadata.prefix = w.opts.PrefixHash
+	w.keep(files, key, metadata)
+}
+
+// keepSize reports whether a file of size bytes passes the size options,
+// counting the reason in stats if it doesn't.
+func (w *walker) keepSize(stats *ScanStats, size int64) bool {
+	if w.opts.SkipEmpty && size == 0 {
+		stats.Empty++
+		return false
+	}
+	if size < w.opts.MinSize {
+		stats.TooSmall++
+		return false
+	}
+	if w.opts.MaxSize > 0 && size > w.opts.MaxSize {
+		stats.TooLarge++
+		return false
+	}
+	return true
+}
+
+// keep records metadata in files under key and passes it to OnFile.
+func (w *walker) keep(files map[string]*FileMetadata, key string, metadata *FileMetadata) {
+	files[key] = metadata
+	if w.opts.OnFile != nil {
+		w.opts.OnFile(metadata)
+	}
+}
+
+// ScanAll scans every source and destination path concurrently and merges
+// each side into a single map. When the same key is found under more than
+// one path, the path listed first wins and the others are reported to
+// opts.Warn.
+func ScanAll(ctx context.Context, sourcePaths, destPaths []string, opts ScanOptions) (map[string]*FileMetadata, map[string]*FileMetadata, ScanStats, error) {
+	paths := append(append([]string{}, sourcePaths...), destPaths...)
+	results := make([]map[string]*FileMetadata, len(paths))
+	stats := make([]ScanStats, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	wg.Add(len(paths))
+
+	destOpts := opts
+	if opts.OnDestFile != nil {
+		destOpts.OnFile = opts.OnDestFile
+	}
+	for i, path := range paths {
+		pathOpts := opts
+		if i >= len(sourcePaths) {
+			pathOpts = destOpts
+		}
+		go func() {
+			defer wg.Done()
+			results[i], stats[i], errs[i] = Scan(ctx, path, pathOpts)
+		}()
+	}
+
+	wg.Wait()
+
+	// Check for errors
+	var totals ScanStats
+	for i, err := range errs {
+		if err != nil && i < len(sourcePaths) {
+			return nil, nil, ScanStats{}, fmt.Errorf("error processing source path: %w", err)
+		}
+		if err != nil {
+			return nil, nil, ScanStats{}, fmt.Errorf("error processing destination path: %w", err)
+		}
+		totals.Add(stats[i])
+	}
+
+	sourceFiles := mergeFiles(paths[:len(sourcePaths)], results[:len(sourcePaths)], opts.Warn)
+	destFiles := mergeFiles(paths[len(sourcePaths):], results[len(sourcePaths):], opts.Warn)
+	return sourceFiles, destFiles, totals, nil
+}
+
+// mergeFiles combines the scans of paths in order, keeping the first file
+// found for each key so the result doesn't depend on scan timing.
+func mergeFiles(paths []string, results []map[string]*FileMetadata, warnFn func(error)) map[string]*FileMetadata {
+	if len(results) == 1 {
+		return results[0]
+	}
+
+	merged := make(map[string]*FileMetadata)
+	for i, files := range results {
+		for key, metadata := range files {
+			if existing, exists := merged[key]; exists {
+				warn(warnFn, fmt.Errorf("ignoring %s in %s, already found at %s", key, paths[i], existing.Path))
+				continue
+			}
+			merged[key] = metadata
+		}
+	}
+	return merged
+}
@@ -0,0 +1,530 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeFiles creates files under root, keyed by slash-separated path relative
+// to root, with the given contents.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for relPath, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// relPaths returns the keys of files, slash-separated and sorted.
+func relPaths(files map[string]*FileMetadata) []string {
+	paths := make([]string, 0, len(files))
+	for relPath := range files {
+		paths = append(paths, filepath.ToSlash(relPath))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// scanFiles scans root with opts and returns the paths found, failing the
+// test on error.
+func scanFiles(t *testing.T, root string, opts ScanOptions) []string {
+	t.Helper()
+	files, _, err := Scan(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relPaths(files)
+}
+
+// walkReference finds the files a scan of root with opts should keep using
+// filepath.WalkDir, applying every filter in a single visitor.
+func walkReference(t *testing.T, root string, opts ScanOptions) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if matchesExclude(relPath, opts.Exclude) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if opts.tooDeep(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !matchesInclude(relPath, opts.Include) || !hasExtension(relPath, opts.Extensions) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() < opts.MinSize || (opts.MaxSize > 0 && info.Size() > opts.MaxSize) {
+			return nil
+		}
+		paths = append(paths, filepath.ToSlash(relPath))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestScanMatchesWalkDir(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":                      "a",
+		"b.jpg":                      strings.Repeat("b", 100),
+		"empty":                      "",
+		"docs/readme.md":             "readme",
+		"docs/deep/deeper/notes.txt": strings.Repeat("n", 10),
+		"node_modules/pkg/index.js":  "js",
+		"src/main.go":                "package main",
+		"src/go.lock":                "lock",
+		"src/vendor/lib/lib.go":      strings.Repeat("l", 1000),
+	})
+	if err := os.Symlink("a.txt", filepath.Join(root, "link.txt")); err != nil {
+		t.Log("symlinks unsupported:", err)
+	}
+
+	tests := []struct {
+		name string
+		opts ScanOptions
+	}{
+		{"everything", ScanOptions{}},
+		{"concurrent", ScanOptions{Jobs: 4}},
+		{"exclude", ScanOptions{Exclude: []string{"node_modules", "*.lock"}}},
+		{"include", ScanOptions{Include: []string{"**/*.go"}}},
+		{"extensions", ScanOptions{Extensions: []string{"txt", ".JPG"}}},
+		{"sizes", ScanOptions{MinSize: 2, MaxSize: 100}},
+		{"depth", ScanOptions{MaxDepth: 2, Jobs: 4}},
+		{"combined", ScanOptions{Exclude: []string{"vendor"}, Include: []string{"src/**"}, MinSize: 1, Jobs: 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, want := scanFiles(t, root, test.opts), walkReference(t, root, test.opts)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Scan found %q, filepath.WalkDir found %q", got, want)
+			}
+		})
+	}
+}
+
+func TestScanSizeLimits(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"small.txt": "abc", "exact.txt": "abcd", "large.txt": "abcdefgh"})
+
+	tests := []struct {
+		name               string
+		opts               ScanOptions
+		kept               int
+		tooSmall, tooLarge int
+	}{
+		{"no limits", ScanOptions{}, 3, 0, 0},
+		{"minimum", ScanOptions{MinSize: 4}, 2, 1, 0},
+		{"maximum", ScanOptions{MaxSize: 4}, 2, 0, 1},
+		{"both inclusive", ScanOptions{MinSize: 4, MaxSize: 4}, 1, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, stats, err := Scan(context.Background(), root, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != test.kept || stats.TooSmall != test.tooSmall || stats.TooLarge != test.tooLarge {
+				t.Errorf("kept %d, %d too small, %d too large; want %d, %d, %d",
+					len(files), stats.TooSmall, stats.TooLarge, test.kept, test.tooSmall, test.tooLarge)
+			}
+		})
+	}
+}
+
+func TestMatchesExclude(t *testing.T) {
+	tests := []struct {
+		relPath  string
+		patterns []string
+		want     bool
+	}{
+		{"a.txt", nil, false},
+		{"go.lock", []string{"*.lock"}, true},
+		{"deep/dir/go.lock", []string{"*.lock"}, true},
+		{"go.lock.bak", []string{"*.lock"}, false},
+		{"node_modules", []string{"node_modules"}, true},
+		{"web/node_modules", []string{"node_modules"}, true},
+		{".git/objects/ab/cd", []string{".git/**"}, true},
+		{"src/.git/HEAD", []string{".git/**"}, false},
+		{"src/.git/HEAD", []string{"**/.git/**"}, true},
+		{"src/main.go", []string{"src/*.go"}, true},
+		{"src/pkg/main.go", []string{"src/*.go"}, false},
+		{"src/pkg/main.go", []string{"src/**/*.go"}, true},
+		{"src/main.go", []string{"src/**/*.go"}, true},
+		{"a.txt", []string{"*.jpg", "a.*"}, true},
+	}
+	for _, test := range tests {
+		if got := matchesExclude(filepath.FromSlash(test.relPath), test.patterns); got != test.want {
+			t.Errorf("matchesExclude(%q, %q) = %v, want %v", test.relPath, test.patterns, got, test.want)
+		}
+	}
+}
+
+func TestScanPrunesExcludedDirectories(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"keep.txt":              "keep",
+		"go.lock":               "lock",
+		"node_modules/a/b.js":   "js",
+		"node_modules/c/d.js":   "js",
+		"web/node_modules/e.js": "js",
+	})
+
+	files, stats, err := Scan(context.Background(), root, ScanOptions{Exclude: []string{"node_modules", "*.lock"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := relPaths(files), []string{"keep.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+	// The lock file and both node_modules directories, not the files in them
+	if stats.Excluded != 3 {
+		t.Errorf("Excluded = %d, want 3", stats.Excluded)
+	}
+}
+
+func TestHasExtension(t *testing.T) {
+	tests := []struct {
+		relPath    string
+		extensions []string
+		want       bool
+	}{
+		{"a.jpg", nil, true},
+		{"a.jpg", []string{".jpg"}, true},
+		{"a.JPG", []string{"jpg"}, true},
+		{"sub/a.jpeg", []string{".jpg", "JPEG"}, true},
+		{"a.tar.gz", []string{"tar.gz"}, true},
+		{"a.gz", []string{"tar.gz"}, false},
+		{"a.png", []string{".jpg"}, false},
+		{"jpg", []string{".jpg"}, false},
+		{".jpg", []string{".jpg"}, false}, // A dotfile named after the extension has none
+		{"jpg.d/a", []string{".jpg"}, false},
+	}
+	for _, test := range tests {
+		if got := hasExtension(test.relPath, test.extensions); got != test.want {
+			t.Errorf("hasExtension(%q, %q) = %v, want %v", test.relPath, test.extensions, got, test.want)
+		}
+	}
+}
+
+func TestScanExtensions(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.jpg": "a", "b.PNG": "b", "sub/c.mp4": "c", "d.txt": "d", "e": "e"})
+	files, stats, err := Scan(context.Background(), root, ScanOptions{Extensions: []string{"jpg", ".png", ".MP4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := relPaths(files), []string{"a.jpg", "b.PNG", "sub/c.mp4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+	if stats.OtherExtension != 2 {
+		t.Errorf("OtherExtension = %d, want 2", stats.OtherExtension)
+	}
+}
+
+func TestMatchesInclude(t *testing.T) {
+	tests := []struct {
+		relPath  string
+		patterns []string
+		want     bool
+	}{
+		{"a.txt", nil, true},
+		{"a.jpg", []string{"*.jpg", "*.png"}, true},
+		{"photos/b.png", []string{"*.jpg", "*.png"}, true},
+		{"notes.txt", []string{"*.jpg", "*.png"}, false},
+		{"photos/c.jpg", []string{"videos/**"}, false},
+	}
+	for _, test := range tests {
+		if got := matchesInclude(filepath.FromSlash(test.relPath), test.patterns); got != test.want {
+			t.Errorf("matchesInclude(%q, %q) = %v, want %v", test.relPath, test.patterns, got, test.want)
+		}
+	}
+}
+
+func TestScanExcludeOverridesInclude(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.jpg":         "a",
+		"b.png":         "b",
+		"c.txt":         "c",
+		"private/d.jpg": "d",
+	})
+
+	opts := ScanOptions{Include: []string{"*.jpg", "*.png"}, Exclude: []string{"private"}}
+	if got, want := scanFiles(t, root, opts), []string{"a.jpg", "b.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+}
+
+func TestScanConcurrentlyFindsEveryFile(t *testing.T) {
+	root := t.TempDir()
+	files := make(map[string]string)
+	for i := range 20 {
+		for j := range 5 {
+			files[fmt.Sprintf("dir%02d/sub%d/file%d", i, j, j)] = "contents"
+		}
+	}
+	writeFiles(t, root, files)
+
+	// Run with -race to check the walkers merge their results safely
+	got := scanFiles(t, root, ScanOptions{Jobs: 8})
+	if want := scanFiles(t, root, ScanOptions{Jobs: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Jobs: 8 found %d files, Jobs: 1 found %d", len(got), len(want))
+	}
+	if len(got) != len(files) {
+		t.Errorf("found %d files, want %d", len(got), len(files))
+	}
+}
+
+func TestScanAllMultiplePaths(t *testing.T) {
+	dir := t.TempDir()
+	first, second, dest := filepath.Join(dir, "first"), filepath.Join(dir, "second"), filepath.Join(dir, "dest")
+	writeFiles(t, first, map[string]string{"a.txt": "first a", "b.txt": "b"})
+	writeFiles(t, second, map[string]string{"a.txt": "second a", "c.txt": "c"})
+	writeFiles(t, dest, map[string]string{"d.txt": "d"})
+
+	sourceFiles, destFiles, _, err := ScanAll(context.Background(), []string{first, second}, []string{dest}, ScanOptions{Jobs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := relPaths(sourceFiles), []string{"a.txt", "b.txt", "c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("source files = %q, want %q", got, want)
+	}
+	// The path listed first wins a key found under both
+	if got, want := sourceFiles["a.txt"].Path, filepath.Join(first, "a.txt"); got != want {
+		t.Errorf("a.txt is %s, want %s", got, want)
+	}
+	if got, want := relPaths(destFiles), []string{"d.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("destination files = %q, want %q", got, want)
+	}
+}
+
+// symlink creates a symlink at link pointing to target, and any missing
+// parent directories, skipping the test where the platform doesn't allow
+// symlinks.
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+}
+
+func TestScanSkipsBrokenSymlinks(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	symlink(t, filepath.Join(root, "missing.txt"), filepath.Join(root, "broken.txt"))
+	symlink(t, filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "valid.txt"))
+
+	for _, follow := range []bool{false, true} {
+		files, stats, err := Scan(context.Background(), root, ScanOptions{FollowSymlinks: follow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"a.txt"}
+		wantBroken := 0
+		if follow {
+			want, wantBroken = []string{"a.txt", "sub/valid.txt"}, 1
+		}
+		if got := relPaths(files); !reflect.DeepEqual(got, want) {
+			t.Errorf("FollowSymlinks %v: found %q, want %q", follow, got, want)
+		}
+		if stats.BrokenSymlinks != wantBroken {
+			t.Errorf("FollowSymlinks %v: counted %d broken symlinks, want %d", follow, stats.BrokenSymlinks, wantBroken)
+		}
+	}
+}
+
+func TestScanFollowsSymlinkedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	writeFiles(t, outside, map[string]string{"b.txt": "b", "sub/c.txt": "c"})
+	symlink(t, outside, filepath.Join(root, "linked"))
+	symlink(t, filepath.Join(outside, "b.txt"), filepath.Join(root, "b-link.txt"))
+
+	if got, want := scanFiles(t, root, ScanOptions{}), []string{"a.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without FollowSymlinks Scan found %q, want %q", got, want)
+	}
+	want := []string{"a.txt", "b-link.txt", "linked/b.txt", "linked/sub/c.txt"}
+	if got := scanFiles(t, root, ScanOptions{FollowSymlinks: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("with FollowSymlinks Scan found %q, want %q", got, want)
+	}
+}
+
+func TestScanSymlinkCycle(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	symlink(t, "..", filepath.Join(root, "sub", "up"))
+	symlink(t, root, filepath.Join(root, "self"))
+
+	type result struct {
+		files    map[string]*FileMetadata
+		err      error
+		warnings int
+	}
+	done := make(chan result, 1)
+	go func() {
+		var warnings atomic.Int32
+		opts := ScanOptions{FollowSymlinks: true, Jobs: 4, Warn: func(error) { warnings.Add(1) }}
+		files, _, err := Scan(context.Background(), root, opts)
+		done <- result{files, err, int(warnings.Load())}
+	}()
+
+	select {
+	case got := <-done:
+		if got.err != nil {
+			t.Fatal(got.err)
+		}
+		if want := []string{"a.txt", "sub/b.txt"}; !reflect.DeepEqual(relPaths(got.files), want) {
+			t.Errorf("Scan found %q, want %q", relPaths(got.files), want)
+		}
+		if got.warnings != 2 {
+			t.Errorf("got %d warnings, want one for each link back to a visited directory", got.warnings)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan didn't finish on a tree with symlink cycles")
+	}
+}
+
+func TestScanTracksVisitedOnlyWhenFollowing(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/deeper/c.txt": "c"})
+
+	for _, follow := range []bool{false, true} {
+		w := &walker{
+			ctx:     context.Background(),
+			root:    root,
+			opts:    ScanOptions{Hash: HashXXH64, FollowSymlinks: follow},
+			sem:     make(chan struct{}, 1),
+			files:   make(map[string]*FileMetadata),
+			visited: make(map[string]bool),
+		}
+		if err := w.walkDir(""); err != nil {
+			t.Fatal(err)
+		}
+		w.wg.Wait()
+		if len(w.files) != 3 {
+			t.Errorf("follow %v: found %d files, want 3", follow, len(w.files))
+		}
+		// Without symlinks to follow, directories aren't stat'ed to spot cycles
+		if want := map[bool]int{false: 0, true: 3}[follow]; len(w.visited) != want {
+			t.Errorf("follow %v: %d directories marked visited, want %d", follow, len(w.visited), want)
+		}
+	}
+}
+
+func TestScanSkipsUnreadableDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "locked/b.txt": "b", "open/c.txt": "c"})
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0o755)
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("permissions don't stop this user reading directories")
+	}
+
+	files, stats, err := Scan(context.Background(), root, ScanOptions{Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := relPaths(files), []string{"a.txt", "open/c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+	if len(stats.Unreadable) != 1 || stats.Unreadable[0].Path != locked || !errors.Is(stats.Unreadable[0].Err, fs.ErrPermission) {
+		t.Errorf("Unreadable = %v, want %s with a permission error", stats.Unreadable, locked)
+	}
+}
+
+func TestScanList(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	writeFiles(t, root, map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/c.log": "c", "skip/d.txt": "d"})
+	writeFiles(t, dir, map[string]string{"outside.txt": "o"})
+
+	var warnings []error
+	paths := []string{
+		filepath.Join(root, "a.txt"),
+		filepath.Join(root, "sub", "b.txt"),
+		filepath.Join(root, "sub", "c.log"),
+		filepath.Join(root, "skip", "d.txt"),
+		filepath.Join(root, "missing.txt"),
+		filepath.Join(dir, "outside.txt"),
+	}
+	opts := ScanOptions{Exclude: []string{"skip"}, Include: []string{"*.txt"}, Warn: func(err error) { warnings = append(warnings, err) }}
+	files, stats, err := ScanList(context.Background(), root, paths, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := relPaths(files), []string{"a.txt", "sub/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanList kept %q, want %q", got, want)
+	}
+	if b := files[filepath.Join("sub", "b.txt")]; b == nil || b.Path != filepath.Join(root, "sub", "b.txt") || b.Size != 1 {
+		t.Errorf("sub/b.txt = %+v, want its full path and size", b)
+	}
+	if stats.Excluded != 1 || stats.NotIncluded != 1 {
+		t.Errorf("stats = %+v, want one file excluded and one not included", stats)
+	}
+	// The missing file and the one outside the root
+	if len(warnings) != 2 {
+		t.Errorf("got warnings %v, want 2", warnings)
+	}
+}
+
+func TestScanMaxDepth(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "one/b.txt": "b", "one/two/c.txt": "c"})
+
+	tests := []struct {
+		maxDepth int
+		want     []string
+	}{
+		{1, []string{"a.txt"}},                                // --max-depth 0
+		{2, []string{"a.txt", "one/b.txt"}},                   // --max-depth 1
+		{0, []string{"a.txt", "one/b.txt", "one/two/c.txt"}},  // Unlimited
+		{10, []string{"a.txt", "one/b.txt", "one/two/c.txt"}}, // Deeper than the tree
+	}
+	for _, test := range tests {
+		if got := scanFiles(t, root, ScanOptions{MaxDepth: test.maxDepth, Jobs: 2}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("MaxDepth %d: found %q, want %q", test.maxDepth, got, test.want)
+		}
+	}
+}
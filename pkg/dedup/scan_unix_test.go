@@ -0,0 +1,76 @@
+//go:build unix
+
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// otherDevice returns a directory on another device than dir, skipping the
+// test if none of the usual mount points is.
+func otherDevice(t *testing.T, dir string) string {
+	t.Helper()
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, _, _ := fileID(info)
+	for _, candidate := range []string{"/dev/shm", "/dev", "/proc", "/sys"} {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			if candidateDev, _, _ := fileID(info); candidateDev != dev {
+				return candidate
+			}
+		}
+	}
+	t.Skip("no directory on another device to test with")
+	return ""
+}
+
+// Run on Unix only, where directories report the device holding them.
+func TestScanOneFileSystem(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	mount := otherDevice(t, root)
+	// A followed symlink reaches the other device as a mount point would
+	symlink(t, mount, filepath.Join(root, "mnt"))
+
+	files, stats, err := Scan(context.Background(), root, ScanOptions{FollowSymlinks: true, OneFileSystem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := relPaths(files), []string{"a.txt", "sub/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan found %q, want %q", got, want)
+	}
+	if want := []string{filepath.Join(root, "mnt")}; !reflect.DeepEqual(stats.OtherFileSystem, want) {
+		t.Errorf("OtherFileSystem = %q, want %q", stats.OtherFileSystem, want)
+	}
+}
+
+func TestScanSkipsNamedPipes(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	if err := syscall.Mkfifo(filepath.Join(root, "pipe"), 0o644); err != nil {
+		t.Skipf("can't create a named pipe: %v", err)
+	}
+	symlink(t, filepath.Join(root, "pipe"), filepath.Join(root, "link"))
+
+	// Opening the pipe would block until a writer came along, so a scan
+	// that returns at all has not tried to
+	for _, follow := range []bool{false, true} {
+		files, stats, err := Scan(context.Background(), root, ScanOptions{FollowSymlinks: follow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := relPaths(files), []string{"a.txt"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("FollowSymlinks %v: Scan found %q, want %q", follow, got, want)
+		}
+		if stats.NamedPipes == 0 || stats.Special() != stats.NamedPipes {
+			t.Errorf("FollowSymlinks %v: NamedPipes = %d, Special() = %d", follow, stats.NamedPipes, stats.Special())
+		}
+	}
+}
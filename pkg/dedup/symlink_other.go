@@ -0,0 +1,9 @@
+//go:build !windows
+
+package dedup
+
+// symlinkNotPermitted reports whether err means symlinks need a privilege the
+// process lacks. Only Windows restricts symlinks that way.
+func symlinkNotPermitted(err error) bool {
+	return false
+}
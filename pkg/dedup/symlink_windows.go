@@ -0,0 +1,16 @@
+//go:build windows
+
+package dedup
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// symlinkNotPermitted reports whether err is Windows refusing to create a
+// symlink because the process lacks the privilege, as it does without
+// Developer Mode or elevation.
+func symlinkNotPermitted(err error) bool {
+	return errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD)
+}
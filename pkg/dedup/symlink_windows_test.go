@@ -0,0 +1,60 @@
+//go:build windows
+
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHardlinkFallback(t *testing.T) {
+	probe := filepath.Join(t.TempDir(), "link")
+	err := os.Symlink(probe, probe)
+	if err == nil {
+		t.Skip("the process may create symlinks, so there is nothing to fall back from")
+	}
+	if !symlinkNotPermitted(err) {
+		t.Fatalf("creating a symlink failed with %v, not for lack of privilege", err)
+	}
+
+	for _, fallback := range []bool{false, true} {
+		dir := t.TempDir()
+		source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+		writeFiles(t, source, map[string]string{"a.txt": "same"})
+		writeFiles(t, dest, map[string]string{"a.txt": "same"})
+		duplicates := findBetween(t, source, dest, MatchOptions{Mode: MatchRelPath})
+
+		var results []Result
+		Apply(context.Background(), duplicates, ApplyOptions{
+			Link:             LinkSymlink,
+			HardlinkFallback: fallback,
+			OnResult:         func(result Result) { results = append(results, result) },
+		})
+		if len(results) != 1 {
+			t.Fatalf("got %d results, want 1", len(results))
+		}
+		result := results[0]
+		if !fallback {
+			if result.Outcome != Failed || !symlinkNotPermitted(result.Err) {
+				t.Errorf("without the fallback the outcome is %v (%v), want the privilege error", result.Outcome, result.Err)
+			}
+			continue
+		}
+		if result.Outcome != Replaced || result.Replacement.Link != LinkHardlink {
+			t.Fatalf("with the fallback the outcome is %v (%v) by %s, want a hard link", result.Outcome, result.Err, result.Replacement.Link)
+		}
+		sourceInfo, err := os.Stat(duplicates[0].Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		destInfo, err := os.Stat(duplicates[0].Destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(sourceInfo, destInfo) {
+			t.Error("the destination isn't a hard link to the source")
+		}
+	}
+}
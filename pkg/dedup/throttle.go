@@ -0,0 +1,67 @@
+package dedup
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ReadLimiter caps the combined rate at which files are read for hashing and
+// verifying, across every goroutine sharing it, so a run doesn't saturate a
+// disk other users need. A nil ReadLimiter doesn't limit anything.
+type ReadLimiter struct {
+	mu     sync.Mutex // Guards tokens and last
+	rate   float64    // Bytes allowed per second
+	tokens float64    // Bytes that may be read now; negative while readers wait
+	last   time.Time  // When tokens was last topped up
+}
+
+// NewReadLimiter returns a limiter allowing bytesPerSec bytes to be read per
+// second, or nil if bytesPerSec isn't positive.
+func NewReadLimiter(bytesPerSec int64) *ReadLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &ReadLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n more bytes fit within the rate. Each caller reserves
+// its bytes before sleeping, so concurrent readers queue up instead of all
+// waking at once.
+func (l *ReadLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	// Unused allowance is kept for a second at most, bounding bursts
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// reader returns r throttled by l, or r itself if l is nil.
+func (l *ReadLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limit: l}
+}
+
+// limitedReader charges every read from r to limit.
+type limitedReader struct {
+	r     io.Reader
+	limit *ReadLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limit.wait(n)
+	return n, err
+}
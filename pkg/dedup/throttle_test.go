@@ -0,0 +1,53 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadLimiter(t *testing.T) {
+	const rate = 2 << 20 // Bytes per second
+	const readers, perReader = 4, 256 << 10
+	limit := NewReadLimiter(rate)
+
+	began := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := io.Copy(io.Discard, limit.reader(bytes.NewReader(make([]byte, perReader))))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	took := time.Since(began)
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The limiter starts with no allowance, so the readers share the rate
+	// from the first byte; sleeps only overshoot
+	want := time.Duration(float64(readers*perReader) / rate * float64(time.Second))
+	if took < want*9/10 || took > want*3 {
+		t.Errorf("reading %d bytes at %d bytes/s took %s, want about %s", readers*perReader, rate, took, want)
+	}
+}
+
+func TestNewReadLimiterUnlimited(t *testing.T) {
+	if NewReadLimiter(0) != nil || NewReadLimiter(-1) != nil {
+		t.Error("a rate of 0 or less limits reads")
+	}
+	var unlimited *ReadLimiter
+	r := bytes.NewReader(nil)
+	if unlimited.reader(r) != io.Reader(r) {
+		t.Error("a nil limiter wraps its reader")
+	}
+}
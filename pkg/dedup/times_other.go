@@ -0,0 +1,13 @@
+//go:build !unix
+
+package dedup
+
+import (
+	"errors"
+	"time"
+)
+
+// lchtimes is not supported on this platform.
+func lchtimes(path string, atime, mtime time.Time) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package dedup
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lchtimes sets the access and modification times of path, changing a
+// symlink itself rather than the file it points to.
+func lchtimes(path string, atime, mtime time.Time) error {
+	return unix.Lutimes(path, []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	})
+}
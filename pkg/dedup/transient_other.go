@@ -0,0 +1,15 @@
+//go:build !windows
+
+package dedup
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transient reports whether err is a failure that may succeed if retried,
+// such as a file on a network filesystem that is briefly busy.
+func transient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETXTBSY) ||
+		errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
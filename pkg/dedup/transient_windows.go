@@ -0,0 +1,15 @@
+//go:build windows
+
+package dedup
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// transient reports whether err is a failure that may succeed if retried,
+// such as a file another process briefly holds open without sharing it.
+func transient(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
@@ -0,0 +1,136 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// reserveTrashPath claims a free path for relPath inside trashDir by creating
+// an empty placeholder there, appending a counter if the name is taken. The
+// placeholder is exclusive, so concurrent workers never pick the same path.
+func reserveTrashPath(trashDir, relPath string) (string, error) {
+	base := filepath.Join(trashDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create trash directory for %s: %w", relPath, err)
+	}
+
+	for i := 0; ; i++ {
+		candidate := base
+		if i > 0 {
+			candidate = fmt.Sprintf("%s.%d", base, i)
+		}
+		file, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to reserve trash path %s: %w", candidate, err)
+		}
+		file.Close()
+		return candidate, nil
+	}
+}
+
+// keepInTrash puts the destination of dup into trashDir, preserving its path
+// relative to the scanned root, and returns where it was put. The destination
+// itself is left in place for the link to be renamed over. The trash entry
+// is a hard link where possible, so it costs no space.
+func keepInTrash(dup Duplicate, trashDir string) (string, error) {
+	trashPath, err := reserveTrashPath(trashDir, dup.RelPath)
+	if err != nil {
+		return "", err
+	}
+
+	tempPath, err := createTemp(trashPath, func(tempPath string) error {
+		return os.Link(dup.Destination, tempPath)
+	})
+	if err == nil {
+		if err = os.Rename(tempPath, trashPath); err != nil {
+			os.Remove(tempPath)
+		}
+	} else {
+		// Across filesystems, or where hard links aren't allowed, copy instead
+		var info os.FileInfo
+		var xattrs map[string][]byte
+		if info, err = os.Stat(dup.Destination); err == nil {
+			if xattrs, err = readXattrs(dup.Destination); err == nil {
+				err = copyReplace(dup.Destination, trashPath, info.Mode().Perm(), info.ModTime(), xattrs)
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(trashPath)
+		return "", fmt.Errorf("failed to move %s to trash: %w", dup.Destination, err)
+	}
+	return trashPath, nil
+}
+
+// moveFile renames src to dst, falling back to copying when they are on
+// different filesystems. An existing dst is replaced.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return err
+	}
+	if err := copyReplace(src, dst, info.Mode().Perm(), info.ModTime(), xattrs); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyReplace writes a copy of src with the given mode, modification time
+// and extended attributes to a temporary file next to dst and renames it
+// over dst, so dst is never missing or partially written.
+func copyReplace(src, dst string, mode os.FileMode, modTime time.Time, xattrs map[string][]byte) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer source.Close()
+
+	temp, err := os.CreateTemp(filepath.Dir(dst), ".dedup-copy-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %s: %w", dst, err)
+	}
+	tempPath := temp.Name()
+	// Clean up the temporary file unless it was renamed into place
+	defer os.Remove(tempPath)
+
+	_, err = io.Copy(temp, source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", src, dst, err)
+	}
+
+	if err := writeXattrs(tempPath, xattrs); err != nil {
+		return err
+	}
+	if err := os.Chmod(tempPath, mode); err != nil {
+		return fmt.Errorf("error setting mode of %s: %w", dst, err)
+	}
+	if err := os.Chtimes(tempPath, modTime, modTime); err != nil {
+		return fmt.Errorf("error setting times of %s: %w", dst, err)
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		return fmt.Errorf("error replacing %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	source, dest, trash := filepath.Join(dir, "source"), filepath.Join(dir, "dest"), filepath.Join(dir, "trash")
+	writeFiles(t, source, map[string]string{"sub/a.txt": "same"})
+	writeFiles(t, dest, map[string]string{"sub/a.txt": "same"})
+	// An earlier run's trash already holds a file by that name
+	writeFiles(t, trash, map[string]string{"sub/a.txt": "earlier"})
+
+	applyBetween(t, source, dest, ApplyOptions{Link: LinkSymlink, TrashDir: trash})
+
+	if !isSymlink(filepath.Join(dest, "sub", "a.txt")) {
+		t.Error("destination wasn't replaced by a symlink")
+	}
+	if got := readFile(t, filepath.Join(trash, "sub", "a.txt")); got != "earlier" {
+		t.Errorf("earlier trash entry holds %q, want it untouched", got)
+	}
+	trashed := filepath.Join(trash, "sub", "a.txt.1")
+	if got := readFile(t, trashed); got != "same" {
+		t.Errorf("trashed file holds %q, want %q", got, "same")
+	}
+	if err := os.Remove(trashed); err != nil {
+		t.Errorf("trashed file can't be removed: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "sub", "a.txt")); got != "same" {
+		t.Errorf("link reads %q after emptying the trash, want %q", got, "same")
+	}
+}
+
+func TestReserveTrashPath(t *testing.T) {
+	trash := t.TempDir()
+	for _, want := range []string{"a.txt", "a.txt.1", "a.txt.2"} {
+		path, err := reserveTrashPath(trash, "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join(trash, want) {
+			t.Errorf("reserved %s, want %s", path, filepath.Join(trash, want))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LinkStatus is the result of checking a symlink with VerifyLinks.
+type LinkStatus string
+
+const (
+	LinkOK      LinkStatus = "ok"
+	LinkBroken  LinkStatus = "broken"  // The target is missing or not a regular file
+	LinkChanged LinkStatus = "changed" // The target no longer matches the file the link replaced
+)
+
+// LinkCheck reports the state of one symlink found by VerifyLinks.
+type LinkCheck struct {
+	Path   string
+	Target string // Path stored in the link
+	Status LinkStatus
+	Err    error // Why the link is broken or changed
+}
+
+// VerifyLinks checks every symlink under root, in lexical order, reporting
+// those whose target is missing. Links recorded in entries, such as those
+// read from an action log, are also compared with the file they replaced:
+// the target must still have its size and, if it was hashed, its contents.
+// Files are read in chunks of bufSize bytes.
+func VerifyLinks(ctx context.Context, root string, entries []LogEntry, bufSize int) ([]LinkCheck, error) {
+	replaced := make(map[string]LogEntry)
+	for _, entry := range entries {
+		if entry.Link != LinkSymlink {
+			continue
+		}
+		if path, err := filepath.Abs(entry.Destination); err == nil {
+			// Later entries describe the most recent replacement
+			replaced[path] = entry
+		}
+	}
+
+	var checks []LinkCheck
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("error reading symlink %s: %w", path, err)
+		}
+		absPath, _ := filepath.Abs(path)
+		entry, recorded := replaced[absPath]
+		status, err := checkLink(path, entry, recorded, bufSize)
+		checks = append(checks, LinkCheck{Path: path, Target: target, Status: status, Err: err})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
+
+// checkLink checks the symlink at path, and compares its target with entry
+// if the link was recorded.
+func checkLink(path string, entry LogEntry, recorded bool, bufSize int) (LinkStatus, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return LinkBroken, err
+	}
+	if !info.Mode().IsRegular() {
+		return LinkBroken, errors.New("target is not a regular file")
+	}
+	if !recorded {
+		return LinkOK, nil
+	}
+
+	if info.Size() != entry.Size {
+		return LinkChanged, fmt.Errorf("target size changed from %d to %d bytes", entry.Size, info.Size())
+	}
+	if entry.Hash != "" {
+		hash, err := HashFile(path, entry.Algorithm, bufSize)
+		if err != nil {
+			return LinkBroken, err
+		}
+		if hash != entry.Hash {
+			return LinkChanged, errors.New("target contents changed")
+		}
+	}
+	return LinkOK, nil
+}
@@ -0,0 +1,52 @@
+package dedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyLinks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "target", "b.txt": "edited later"})
+	symlink(t, filepath.Join(dir, "a.txt"), filepath.Join(dir, "valid"))
+	symlink(t, filepath.Join(dir, "missing.txt"), filepath.Join(dir, "broken"))
+	symlink(t, filepath.Join(dir, "b.txt"), filepath.Join(dir, "changed"))
+
+	hash, err := HashFile(filepath.Join(dir, "b.txt"), HashXXH64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []LogEntry{{
+		Destination: filepath.Join(dir, "changed"),
+		Link:        LinkSymlink,
+		Size:        int64(len("edited later")),
+		Hash:        hash,
+		Algorithm:   HashXXH64,
+	}}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("edited LATER"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	checks, err := VerifyLinks(context.Background(), dir, entries, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]LinkStatus{"broken": LinkBroken, "changed": LinkChanged, "valid": LinkOK}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d: %+v", len(checks), len(want), checks)
+	}
+	for _, check := range checks {
+		name := filepath.Base(check.Path)
+		if check.Status != want[name] {
+			t.Errorf("%s: status %s, want %s", name, check.Status, want[name])
+		}
+		if (check.Err == nil) != (check.Status == LinkOK) {
+			t.Errorf("%s: status %s with error %v", name, check.Status, check.Err)
+		}
+	}
+	if checks[2].Target != filepath.Join(dir, "a.txt") {
+		t.Errorf("valid link target = %q, want %q", checks[2].Target, filepath.Join(dir, "a.txt"))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package dedup
+
+// readXattrs returns nil; extended attributes aren't read on this platform.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs does nothing; extended attributes aren't written on this
+// platform.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build linux || darwin
+
+package dedup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of path, without following a
+// symlink, or nil if it has none or its filesystem doesn't support them.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrBuffer(func(buf []byte) (int, error) { return unix.Llistxattr(path, buf) })
+	if unsupported(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing extended attributes of %s: %w", path, err)
+	}
+
+	var attrs map[string][]byte
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrBuffer(func(buf []byte) (int, error) { return unix.Lgetxattr(path, string(name), buf) })
+		if err != nil {
+			return nil, fmt.Errorf("error reading extended attribute %s of %s: %w", name, path, err)
+		}
+		if attrs == nil {
+			attrs = make(map[string][]byte)
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the extended attributes attrs on path.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("error setting extended attribute %s of %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// xattrBuffer calls get first to learn the size of the value and then to
+// read it, retrying if the value grew in between.
+func xattrBuffer(get func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := get(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// unsupported reports whether err means the filesystem has no extended
+// attributes.
+func unsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin
+
+package dedup
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestUndoRestoresXattrs(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	writeFiles(t, source, map[string]string{"a.txt": "same"})
+	writeFiles(t, dest, map[string]string{"a.txt": "same"})
+	destPath := filepath.Join(dest, "a.txt")
+	if err := unix.Setxattr(destPath, "user.dedup.tag", []byte("blue"), 0); err != nil {
+		t.Skipf("the filesystem doesn't support user extended attributes: %v", err)
+	}
+	want := map[string][]byte{"user.dedup.tag": []byte("blue")}
+
+	contents := applyLogged(t, source, dest, ApplyOptions{Link: LinkSymlink})
+	if !isSymlink(destPath) {
+		t.Fatal("the destination wasn't replaced")
+	}
+	entries, err := ReadActionLog(bytes.NewReader(contents), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Xattrs, want) {
+		t.Fatalf("log entries = %+v, want one recording %q", entries, want)
+	}
+
+	if err := RestoreEntry(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	if isSymlink(destPath) || readFile(t, destPath) != "same" {
+		t.Fatal("the destination wasn't restored")
+	}
+	got, err := readXattrs(destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored extended attributes = %q, want %q", got, want)
+	}
+}
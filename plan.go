@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// writePlan writes plan to path.
+func writePlan(path string, plan *dedup.Plan, out output) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating plan %s: %w", path, err)
+	}
+	_, err = plan.WriteTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out.messages, "Wrote %d planned replacements to %s\n", len(plan.Entries), path)
+	return nil
+}
+
+// readPlan reads the plan at path.
+func readPlan(path string) (*dedup.Plan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening plan %s: %w", path, err)
+	}
+	defer file.Close()
+	plan, err := dedup.ReadPlan(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plan, nil
+}
+
+// applyPlan replaces the duplicates in the plan at opts.planApply, linked as
+// the plan says, asking first if they are more than --confirm-threshold.
+// Every file is hashed again first, so a stale plan can't replace a file
+// whose contents changed since it was made.
+func applyPlan(ctx context.Context, opts options, stdin io.Reader, out output) int {
+	plan, err := readPlan(opts.planApply)
+	if err != nil {
+		return aborted(ctx, out, err)
+	}
+	opts.apply = plan.Options(opts.apply)
+	opts.apply.Rehash = true
+	fmt.Fprintf(out.messages, "Plan %s: %d duplicates to %s, made %s\n", opts.planApply, len(plan.Entries), plan.Link, plan.Created.Format("2006-01-02 15:04:05"))
+
+	var log *dedup.ActionLog
+	if opts.logPath != "" && !opts.apply.DryRun {
+		log, err = dedup.OpenActionLog(opts.logPath)
+		if err != nil {
+			return aborted(ctx, out, err)
+		}
+		defer log.Close()
+	}
+
+	duplicates := plan.Duplicates()
+	if code, stop := checkLargeChange(opts, len(duplicates), 0, stdin, out); stop {
+		return code
+	}
+	summary := applyDuplicates(ctx, duplicates, opts, log, nil, out)
+	return finishApply(ctx, opts, out, summary, len(duplicates))
+}
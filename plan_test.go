@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanOutAndApply(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"a.txt": "duplicate", "b.txt": "also duplicate"},
+		map[string]string{"a.txt": "duplicate", "b.txt": "also duplicate"})
+	plan := filepath.Join(t.TempDir(), "plan.json")
+
+	code, stdout, stderr := runCommand(t, "", "--plan-out", plan, "--link", "hardlink", source, dest)
+	if code != exitOK {
+		t.Fatalf("planning exited %d; stderr:\n%s", code, stderr)
+	}
+	if strings.Contains(stdout, "Dry run by default") {
+		t.Errorf("planning is explained as a dry run by default:\n%s", stdout)
+	}
+	if isSymlink(t, filepath.Join(dest, "a.txt")) || isSymlink(t, filepath.Join(dest, "b.txt")) {
+		t.Fatal("planning replaced a file")
+	}
+
+	// b.txt changes after the plan was made, so only a.txt is replaced
+	writeTree(t, dest, map[string]string{"b.txt": "changed since"})
+	code, stdout, stderr = runCommand(t, "", "--plan-apply", plan, "--apply")
+	if code != exitOK {
+		t.Fatalf("applying the plan exited %d; stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "2 duplicates to hardlink") {
+		t.Errorf("stdout doesn't describe the plan:\n%s", stdout)
+	}
+	if !sameFile(t, filepath.Join(source, "a.txt"), filepath.Join(dest, "a.txt")) {
+		t.Error("dest/a.txt wasn't hard-linked as planned")
+	}
+	if sameFile(t, filepath.Join(source, "b.txt"), filepath.Join(dest, "b.txt")) {
+		t.Error("dest/b.txt, changed since the plan, was replaced")
+	}
+}
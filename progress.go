@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = time.Second
+
+// progressLine redraws a status line on out every progressInterval until it
+// is stopped. render is called from the drawing goroutine, so the counters
+// it reads must be safe for concurrent use.
+type progressLine struct {
+	out    io.Writer
+	render func() string
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startProgress starts drawing the line produced by render, or returns nil
+// if progress is disabled. A nil progressLine can still be stopped.
+func startProgress(enabled bool, out io.Writer, render func() string) *progressLine {
+	if !enabled {
+		return nil
+	}
+
+	p := &progressLine{out: out, render: render, done: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(p.out, "\r%s", p.render())
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// stop draws the final state of the line and ends it.
+func (p *progressLine) stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	fmt.Fprintf(p.out, "\r%s\n", p.render())
+}
+
+// scanProgress counts the files a scan has kept so far.
+type scanProgress struct {
+	files atomic.Int64
+	bytes atomic.Int64
+}
+
+func (p *scanProgress) add(metadata *dedup.FileMetadata) {
+	p.files.Add(1)
+	p.bytes.Add(metadata.Size)
+}
+
+func (p *scanProgress) String() string {
+	return "Scanned " + p.count()
+}
+
+// count describes the files counted so far, such as "12 files (3.4 MiB)".
+func (p *scanProgress) count() string {
+	return fmt.Sprintf("%d files (%s)", p.files.Load(), formatBytes(p.bytes.Load()))
+}
+
+// isTerminal reports whether stream, stdin or an output, is a file attached
+// to a terminal, where progress is shown by default and a user can be asked.
+func isTerminal(stream any) bool {
+	file, ok := stream.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
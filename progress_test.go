@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScanProgressPerSide(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"a.txt": "aaaa", "b.txt": "bb", "sub/c.txt": "c"},
+		map[string]string{"a.txt": "aaaa", "d.txt": "dddddd"})
+
+	code, _, stderr := runCommand(t, "", "--progress", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	// The line is drawn a last time once both scans are done
+	if want := "Scanned source: 3 files (7 B), dest: 2 files (10 B)\n"; !strings.Contains(stderr, want) {
+		t.Errorf("stderr doesn't contain %q:\n%s", want, stderr)
+	}
+}
+
+func TestProgressDisabled(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "a"}, map[string]string{"a.txt": "a"})
+
+	// stderr isn't a terminal, so progress is off unless asked for
+	if _, _, stderr := runCommand(t, "", source, dest); strings.Contains(stderr, "Scanned source") {
+		t.Errorf("progress was drawn without --progress:\n%s", stderr)
+	}
+	var line *progressLine
+	line.stop()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// prompter asks questions on out and reads the answers from in, so
+// interactive mode can be driven by something other than a terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// ask prints question and returns the trimmed, lowercased answer. Running out
+// of input is treated as an empty answer so a closed stdin declines.
+func (p *prompter) ask(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	line, err := p.in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("error reading answer: %w", err)
+	}
+	if errors.Is(err, io.EOF) {
+		fmt.Fprintln(p.out)
+	}
+	return strings.ToLower(strings.TrimSpace(line)), nil
+}
+
+// confirmDuplicates lists duplicates and asks whether to replace them. The
+// user may answer "e" to decide for each file instead. It returns the
+// duplicates that should be replaced.
+func confirmDuplicates(p *prompter, duplicates []dedup.Duplicate) ([]dedup.Duplicate, error) {
+	if len(duplicates) == 0 {
+		return nil, nil
+	}
+
+	for _, dup := range duplicates {
+		fmt.Fprintf(p.out, "  %s -> %s\n", dup.Destination, dup.Source)
+	}
+
+	for {
+		answer, err := p.ask(fmt.Sprintf("Replace %d files? [y/N/e to choose each] ", len(duplicates)))
+		if err != nil {
+			return nil, err
+		}
+		switch answer {
+		case "y", "yes":
+			return duplicates, nil
+		case "", "n", "no":
+			return nil, nil
+		case "e", "each":
+			return chooseEach(p, duplicates)
+		}
+	}
+}
+
+// chooseEach asks about every duplicate in turn: y replaces it, n skips it,
+// a replaces it and all remaining ones, and q skips all remaining ones.
+func chooseEach(p *prompter, duplicates []dedup.Duplicate) ([]dedup.Duplicate, error) {
+	var selected []dedup.Duplicate
+
+	for i := 0; i < len(duplicates); i++ {
+		dup := duplicates[i]
+		answer, err := p.ask(fmt.Sprintf("Replace %s with link to %s? [y/n/a/q] ", dup.Destination, dup.Source))
+		if err != nil {
+			return nil, err
+		}
+		switch answer {
+		case "y", "yes":
+			selected = append(selected, dup)
+		case "", "n", "no":
+		case "a", "all":
+			return append(selected, duplicates[i:]...), nil
+		case "q", "quit":
+			return selected, nil
+		default:
+			// Ask again about the same file
+			i--
+		}
+	}
+
+	return selected, nil
+}
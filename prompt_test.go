@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+func TestConfirmDuplicates(t *testing.T) {
+	duplicates := []dedup.Duplicate{
+		{Source: "src/a", Destination: "dst/a"},
+		{Source: "src/b", Destination: "dst/b"},
+		{Source: "src/c", Destination: "dst/c"},
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []string // Destinations selected
+	}{
+		{"yes", "y\n", []string{"dst/a", "dst/b", "dst/c"}},
+		{"no", "n\n", nil},
+		{"default", "\n", nil},
+		{"closed input", "", nil},
+		{"asks again", "maybe\nYES\n", []string{"dst/a", "dst/b", "dst/c"}},
+		{"each", "e\ny\nn\ny\n", []string{"dst/a", "dst/c"}},
+		{"each then all", "e\nn\na\n", []string{"dst/b", "dst/c"}},
+		{"each then quit", "e\ny\nq\n", []string{"dst/a"}},
+		{"each asks again", "e\n?\ny\n\n\n", []string{"dst/a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, err := confirmDuplicates(newPrompter(strings.NewReader(test.input), io.Discard), duplicates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, dup := range selected {
+				got = append(got, dup.Destination)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("selected %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// defaultSizeBuckets are the sizes the --stats histogram is split at unless
+// --stats-buckets gives others.
+var defaultSizeBuckets = []int64{1 << 10, 1 << 20, 100 << 20}
+
+// phaseTimings records how long each phase of a run took and how much it
+// scanned, for --stats. A nil phaseTimings records nothing, so callers don't
+// need to check whether --stats was given.
+type phaseTimings struct {
+	files  int64 // Files kept by the scans
+	bytes  int64 // Total size of those files
+	phases []timedPhase
+	sizes  []sizeBucket     // Histogram of the duplicates found, if any were recorded
+	exts   []extensionCount // Duplicates found per extension, alongside sizes
+}
+
+type timedPhase struct {
+	name string
+	took time.Duration
+}
+
+// start begins timing the named phase and returns the function that ends it.
+func (t *phaseTimings) start(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	began := time.Now()
+	return func() {
+		t.phases = append(t.phases, timedPhase{name: name, took: time.Since(began)})
+	}
+}
+
+// addScanned counts the files a finished scan kept.
+func (t *phaseTimings) addScanned(counts *scanProgress) {
+	if t == nil {
+		return
+	}
+	t.files += counts.files.Load()
+	t.bytes += counts.bytes.Load()
+}
+
+// addDuplicates records the histogram of duplicates' sizes, split at bounds,
+// and how many of them have each extension.
+func (t *phaseTimings) addDuplicates(duplicates []dedup.Duplicate, bounds []int64) {
+	if t == nil {
+		return
+	}
+	t.sizes = sizeHistogram(duplicates, bounds)
+	t.exts = extensionBreakdown(duplicates)
+}
+
+// sizeBucket counts the duplicates of at least min bytes and less than max.
+// The last bucket has no upper bound, and a max of 0.
+type sizeBucket struct {
+	min, max int64
+	count    int
+	bytes    int64 // Total size of the duplicates counted
+}
+
+// sizeHistogram counts duplicates by size into the buckets between
+// ascending bounds: one below the first bound, one between each pair and one
+// from the last bound up.
+func sizeHistogram(duplicates []dedup.Duplicate, bounds []int64) []sizeBucket {
+	buckets := make([]sizeBucket, len(bounds)+1)
+	for i := range buckets {
+		if i > 0 {
+			buckets[i].min = bounds[i-1]
+		}
+		if i < len(bounds) {
+			buckets[i].max = bounds[i]
+		}
+	}
+	for _, dup := range duplicates {
+		i := sort.Search(len(bounds), func(i int) bool { return dup.Size < bounds[i] })
+		buckets[i].count++
+		buckets[i].bytes += dup.Size
+	}
+	return buckets
+}
+
+// noExtension labels the duplicates whose names have no extension.
+const noExtension = "(none)"
+
+// extensionCount counts the duplicates whose destinations have one extension.
+type extensionCount struct {
+	ext   string // Lower-cased, with its dot, or noExtension
+	count int
+	bytes int64 // Total size of the duplicates counted
+}
+
+// extensionBreakdown counts duplicates by the lower-cased extension of their
+// destinations, most bytes first.
+func extensionBreakdown(duplicates []dedup.Duplicate) []extensionCount {
+	index := make(map[string]int)
+	var counts []extensionCount
+	for _, dup := range duplicates {
+		ext := strings.ToLower(filepath.Ext(dup.Destination))
+		if ext == "" {
+			ext = noExtension
+		}
+		i, ok := index[ext]
+		if !ok {
+			i = len(counts)
+			index[ext] = i
+			counts = append(counts, extensionCount{ext: ext})
+		}
+		counts[i].count++
+		counts[i].bytes += dup.Size
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].bytes != counts[j].bytes {
+			return counts[i].bytes > counts[j].bytes
+		}
+		return counts[i].ext < counts[j].ext
+	})
+	return counts
+}
+
+// label describes the sizes b counts, such as "1.0 KiB - 1.0 MiB".
+func (b sizeBucket) label() string {
+	switch {
+	case b.max == 0:
+		return ">= " + formatBytes(b.min)
+	case b.min == 0:
+		return "< " + formatBytes(b.max)
+	default:
+		return formatBytes(b.min) + " - " + formatBytes(b.max)
+	}
+}
+
+// print writes a table of the phases recorded so far, and the size of the
+// scan, to w, followed by the histogram of duplicates and their extensions if
+// those were recorded.
+func (t *phaseTimings) print(w io.Writer) {
+	if t == nil {
+		return
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "Phase\tTime")
+	var total time.Duration
+	for _, phase := range t.phases {
+		fmt.Fprintf(table, "%s\t%s\n", phase.name, phase.took.Round(time.Microsecond))
+		total += phase.took
+	}
+	fmt.Fprintf(table, "total\t%s\n", total.Round(time.Microsecond))
+	table.Flush()
+	fmt.Fprintf(w, "Scanned %d files, %d bytes (%s)\n", t.files, t.bytes, formatBytes(t.bytes))
+
+	if t.sizes == nil {
+		return
+	}
+	table = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "Duplicate size\tFiles\tBytes")
+	for _, bucket := range t.sizes {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", bucket.label(), bucket.count, formatBytes(bucket.bytes))
+	}
+	table.Flush()
+
+	if len(t.exts) == 0 {
+		return
+	}
+	table = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "Extension\tFiles\tBytes")
+	for _, ext := range t.exts {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", ext.ext, ext.count, formatBytes(ext.bytes))
+	}
+	table.Flush()
+}
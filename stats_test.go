@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	source, dest := newTrees(t,
+		map[string]string{"a.txt": "duplicate", "b.txt": "source"},
+		map[string]string{"a.txt": "duplicate", "b.txt": "destination"})
+	opts, valid := validateArgs([]string{"--stats", "--apply", source, dest}, io.Discard, io.Discard)
+	if !valid {
+		t.Fatal("validateArgs rejected the arguments")
+	}
+	opts.timings = &phaseTimings{}
+	out := output{report: io.Discard, results: io.Discard, messages: io.Discard, errors: io.Discard, log: newLogger(io.Discard, logText, slog.LevelError)}
+
+	ctx := context.Background()
+	duplicates, _, err := findDuplicatesBetween(ctx, opts, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := applyDuplicates(ctx, duplicates, opts, nil, nil, out); summary.Replaced != 1 {
+		t.Fatalf("replaced %d duplicates, want 1: %v", summary.Replaced, summary.Err())
+	}
+
+	var names []string
+	for _, phase := range opts.timings.phases {
+		names = append(names, phase.name)
+	}
+	if want := []string{"scan", "hash and compare", "replace"}; !slices.Equal(names, want) {
+		t.Errorf("phases = %q, want %q", names, want)
+	}
+	wantBytes := int64(len("duplicate")*2 + len("source") + len("destination"))
+	if opts.timings.files != 4 || opts.timings.bytes != wantBytes {
+		t.Errorf("scanned %d files, %d bytes, want 4 files, %d bytes", opts.timings.files, opts.timings.bytes, wantBytes)
+	}
+}
+
+func TestStatsFlag(t *testing.T) {
+	source, dest := newTrees(t, map[string]string{"a.txt": "a"}, map[string]string{"a.txt": "a"})
+
+	_, stdout, _ := runCommand(t, "", source, dest)
+	if strings.Contains(stdout, "Phase") {
+		t.Errorf("stats were printed without --stats:\n%s", stdout)
+	}
+	code, stdout, stderr := runCommand(t, "", "--stats", source, dest)
+	if code != exitOK {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr)
+	}
+	for _, want := range []string{"Phase", "scan", "total", "Scanned 2 files, 2 bytes"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout doesn't contain %q:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	var duplicates []dedup.Duplicate
+	for _, size := range []int64{0, 1023, 1024, 5000, 1 << 20, 100<<20 - 1, 100 << 20, 1 << 30} {
+		duplicates = append(duplicates, dedup.Duplicate{Size: size})
+	}
+	got := sizeHistogram(duplicates, defaultSizeBuckets)
+	want := []sizeBucket{
+		{min: 0, max: 1 << 10, count: 2, bytes: 1023},
+		{min: 1 << 10, max: 1 << 20, count: 2, bytes: 1024 + 5000},
+		{min: 1 << 20, max: 100 << 20, count: 2, bytes: 1<<20 + 100<<20 - 1},
+		{min: 100 << 20, max: 0, count: 2, bytes: 100<<20 + 1<<30},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("histogram = %+v, want %+v", got, want)
+	}
+
+	labels := make([]string, len(got))
+	for i, bucket := range got {
+		labels[i] = bucket.label()
+	}
+	if want := []string{"< 1.0 KiB", "1.0 KiB - 1.0 MiB", "1.0 MiB - 100.0 MiB", ">= 100.0 MiB"}; !slices.Equal(labels, want) {
+		t.Errorf("labels = %q, want %q", labels, want)
+	}
+
+	// Without bounds every duplicate lands in one bucket, and without
+	// duplicates every bucket is empty
+	if got := sizeHistogram(duplicates, nil); len(got) != 1 || got[0].count != len(duplicates) {
+		t.Errorf("histogram without bounds = %+v", got)
+	}
+	for _, bucket := range sizeHistogram(nil, []int64{10, 20}) {
+		if bucket.count != 0 || bucket.bytes != 0 {
+			t.Errorf("histogram of no duplicates has %+v", bucket)
+		}
+	}
+}
+
+func TestStatsBucketsFlag(t *testing.T) {
+	opts, valid := validateArgs([]string{"--stats", "--stats-buckets", "4k,1M", "a", "b"}, io.Discard, io.Discard)
+	if want := []int64{4 << 10, 1 << 20}; !valid || !slices.Equal(opts.statsBuckets, want) {
+		t.Errorf("--stats-buckets 4k,1M gave %v, valid %v, want %v", opts.statsBuckets, valid, want)
+	}
+	for _, buckets := range []string{"1M,4k", "4k,4k", "x"} {
+		if _, valid := validateArgs([]string{"--stats", "--stats-buckets", buckets, "a", "b"}, io.Discard, io.Discard); valid {
+			t.Errorf("--stats-buckets %s was accepted", buckets)
+		}
+	}
+	if _, valid := validateArgs([]string{"--stats-buckets", "4k", "a", "b"}, io.Discard, io.Discard); valid {
+		t.Error("--stats-buckets was accepted without --stats")
+	}
+}
+
+func TestExtensionBreakdown(t *testing.T) {
+	duplicates := []dedup.Duplicate{
+		{Destination: filepath.Join("dest", "a.jpg"), Size: 10},
+		{Destination: filepath.Join("dest", "b.JPG"), Size: 20},
+		{Destination: filepath.Join("dest", "c.mp4"), Size: 100},
+		{Destination: filepath.Join("dest", "README"), Size: 5},
+		{Destination: filepath.Join("dest.d", "LICENSE"), Size: 5},
+		{Destination: filepath.Join("dest", "d.png"), Size: 10},
+	}
+	want := []extensionCount{
+		{ext: ".mp4", count: 1, bytes: 100},
+		{ext: ".jpg", count: 2, bytes: 30},
+		{ext: noExtension, count: 2, bytes: 10},
+		{ext: ".png", count: 1, bytes: 10},
+	}
+	if got := extensionBreakdown(duplicates); !slices.Equal(got, want) {
+		t.Errorf("breakdown = %+v, want %+v", got, want)
+	}
+}
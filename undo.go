@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// undoLog restores every destination recorded in the log at path, newest
+// first. It returns how many files were restored and the errors of those
+// that couldn't be.
+func undoLog(path string, dryRun bool, out output) (int, []error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, []error{fmt.Errorf("error opening log file %s: %w", path, err)}
+	}
+	defer file.Close()
+
+	entries, err := dedup.ReadActionLog(file, out.warn)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	var restored int
+	var errs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if dryRun {
+			if err := dedup.CheckStillLinked(entry); err != nil {
+				out.log.Error("could not check replaced file", "path", entry.Destination, "err", err)
+				errs = append(errs, err)
+				continue
+			}
+			fmt.Fprintf(out.messages, "Would restore %s from %s\n", entry.Destination, entry.Source)
+			restored++
+			continue
+		}
+
+		if err := dedup.RestoreEntry(entry); err != nil {
+			out.log.Error("could not restore file", "path", entry.Destination, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(out.messages, "Restored %s from %s\n", entry.Destination, entry.Source)
+		out.log.Info("restored file", "path", entry.Destination, "source", entry.Source)
+		restored++
+	}
+
+	return restored, errs
+}
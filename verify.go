@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/heshanpadmasiri/dedup/pkg/dedup"
+)
+
+// linkCheckJSON is the --format=json representation of a problem found by
+// --verify-links.
+type linkCheckJSON struct {
+	Path   string           `json:"path"`
+	Target string           `json:"target"`
+	Status dedup.LinkStatus `json:"status"`
+	Error  string           `json:"error"`
+}
+
+// verifyLinks checks the symlinks under the single path in opts against the
+// action log at opts.logPath, if given, and reports the broken and changed
+// ones. It returns how many problems were found.
+func verifyLinks(ctx context.Context, opts options, out output) (int, error) {
+	var entries []dedup.LogEntry
+	if opts.logPath != "" {
+		file, err := os.Open(opts.logPath)
+		if err != nil {
+			return 0, fmt.Errorf("error opening log file %s: %w", opts.logPath, err)
+		}
+		entries, err = dedup.ReadActionLog(file, out.warn)
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	root := opts.sourcePaths[0]
+	fmt.Fprintf(out.messages, "Path: %s\n", root)
+	checks, err := dedup.VerifyLinks(ctx, root, entries, opts.scan.BufferSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var problems []dedup.LinkCheck
+	for _, check := range checks {
+		if check.Status != dedup.LinkOK {
+			problems = append(problems, check)
+		}
+	}
+	if err := writeLinkChecks(out.report, opts.format, problems); err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(out.messages, "Checked %d symlinks, %d broken or changed\n", len(checks), len(problems))
+	return len(problems), nil
+}
+
+// writeLinkChecks writes the problems found by --verify-links to w in format.
+func writeLinkChecks(w io.Writer, format outputFormat, problems []dedup.LinkCheck) error {
+	switch format {
+	case formatJSON:
+		records := make([]linkCheckJSON, 0, len(problems))
+		for _, check := range problems {
+			records = append(records, linkCheckJSON{
+				Path:   check.Path,
+				Target: check.Target,
+				Status: check.Status,
+				Error:  check.Err.Error(),
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("error writing JSON output: %w", err)
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"path", "target", "status", "error"})
+		for _, check := range problems {
+			writer.Write([]string{check.Path, check.Target, string(check.Status), check.Err.Error()})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing CSV output: %w", err)
+		}
+		return nil
+	default:
+		for _, check := range problems {
+			fmt.Fprintf(w, "%s: %s -> %s: %v\n", check.Status, check.Path, check.Target, check.Err)
+		}
+		return nil
+	}
+}
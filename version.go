@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build details, which release builds may set with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+// Unset values are filled in from the build info Go embeds in the binary.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the running build: its version, the commit it
+// was built from and when that commit was made or the build ran.
+func versionString() string {
+	v, c, d := version, commit, date
+	modified := false
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	} else if modified && commit == "" {
+		c += "-dirty"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("dedup %s (commit %s, built %s)", v, c, d)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVersionExitsEarly(t *testing.T) {
+	for _, args := range [][]string{{"--version"}, {"-v"}, {"-v", "only-one-path"}, {"--jobs", "2", "--version"}} {
+		opts, valid := validateArgs(args, io.Discard, io.Discard)
+		if !valid || !opts.version {
+			t.Errorf("validateArgs(%q) = version %v, valid %v, want both true", args, opts.version, valid)
+		}
+	}
+	// A flag's value is not a flag
+	if opts, _ := validateArgs([]string{"--exclude", "-v", "a", "b"}, io.Discard, io.Discard); opts.version {
+		t.Error(`validateArgs treated the value of --exclude as -v`)
+	}
+
+	code, stdout, _ := runCommand(t, "", "--version")
+	if code != exitOK || !strings.HasPrefix(stdout, "dedup ") || !strings.Contains(stdout, "(commit ") {
+		t.Errorf("--version exited %d printing %q", code, stdout)
+	}
+}
+
+func TestVersionStringUsesLinkerValues(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "v1.2.3", "abc123", "2024-01-02"
+
+	if got, want := versionString(), "dedup v1.2.3 (commit abc123, built 2024-01-02)"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+}